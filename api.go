@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// requireToken rejects requests that don't carry token as a bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as the JSON body of the response with the given status
+func writeJSON(log *logrus.Logger, w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("failed to write response")
+	}
+}
+
+type reloadResponse struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// reloadHandler rebuilds the test iso from its source and responds with the new checksum
+// the new iso is renamed over the old one so downloads already in progress keep reading the old file
+func reloadHandler(log *logrus.Logger, builder *testISOBuilder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		checksum, err := builder.build()
+		if err != nil {
+			log.WithError(err).Error("failed to reload iso")
+			http.Error(w, "failed to rebuild iso", http.StatusInternalServerError)
+			return
+		}
+		log.Infof("reloaded iso %s with sha256 %s", builder.isoPath, checksum)
+
+		writeJSON(log, w, http.StatusOK, reloadResponse{
+			Name:   filepath.Base(builder.isoPath),
+			SHA256: checksum,
+		})
+	})
+}
+
+type bmcInsertRequest struct {
+	Address string `json:"address"`
+	// may only be left out for a BMC given by BMC_ADDRESS or BMC_CONFIG_FILE, which is then used with its own
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// name of a served iso
+	Image string `json:"image"`
+}
+
+type bmcInsertResponse struct {
+	System       string `json:"system"`
+	VirtualMedia string `json:"virtualMedia"`
+	Image        string `json:"image"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// bmcInsertHandler inserts a served iso into the BMC given in the request, sets the host to boot from it once,
+// and resets the host
+// the operation is abandoned and the media ejected once ctx is done, the request going away doesn't stop it
+// a request without credentials is only accepted for an address among configured, whose credentials it uses, so
+// the configured ones are never sent to a BMC picked by the caller
+func bmcInsertHandler(ctx context.Context, log *logrus.Logger, httpClient *http.Client, configured []bmcTarget, isos http.FileSystem, baseURL string, operationTimeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req bmcInsertRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if req.Address == "" || req.Image == "" {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: "address and image are required"})
+			return
+		}
+		target := bmcTarget{address: req.Address, credentials: bmcCredentials{user: req.Username, password: req.Password}}
+		if req.Username == "" && req.Password == "" {
+			known, ok := configuredTarget(configured, req.Address)
+			if !ok {
+				writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("username and password are required for %s, which is not a configured BMC", req.Address)})
+				return
+			}
+			target = known
+		}
+		if path.Base(req.Image) != req.Image {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid image name %q", req.Image)})
+			return
+		}
+		f, err := isos.Open("/" + req.Image)
+		if err != nil {
+			writeJSON(log, w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("image %s not found", req.Image)})
+			return
+		}
+		f.Close()
+		isoURL, err := url.JoinPath(baseURL, "images", req.Image)
+		if err != nil {
+			writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+
+		bmcLog := log.WithField("bmc", req.Address)
+		var systemURI, vmURI string
+		err = withOperationTimeout(ctx, bmcLog, httpClient, target, isoURL, operationTimeout, func(ctx context.Context) error {
+			var err error
+			systemURI, vmURI, err = insertAndBoot(ctx, bmcLog, httpClient, target, isoURL)
+			return err
+		})
+		if err != nil {
+			log.WithError(err).Errorf("failed to insert %s on %s", isoURL, req.Address)
+			writeJSON(log, w, http.StatusBadGateway, errorResponse{Error: err.Error()})
+			return
+		}
+		log.Infof("inserted %s on %s and booted host", isoURL, req.Address)
+		writeJSON(log, w, http.StatusOK, bmcInsertResponse{
+			System:       systemURI,
+			VirtualMedia: vmURI,
+			Image:        isoURL,
+		})
+	})
+}
+
+// configuredTarget returns the target among targets with address, ignoring a trailing slash
+func configuredTarget(targets []bmcTarget, address string) (bmcTarget, bool) {
+	for _, target := range targets {
+		if strings.TrimSuffix(target.address, "/") == strings.TrimSuffix(address, "/") {
+			return target, true
+		}
+	}
+	return bmcTarget{}, false
+}
+
+type createISORequest struct {
+	// defaults to a random name
+	Name        string    `json:"name"`
+	VolumeLabel string    `json:"volumeLabel"`
+	Files       []isoFile `json:"files"`
+	// builds a cloud-init NoCloud seed or an OpenStack config drive on top of files, labelled cidata or config-2
+	// unless volumeLabel says otherwise, only one may be set
+	NoCloud     *noCloudSeed     `json:"nocloud"`
+	ConfigDrive *configDriveSeed `json:"configDrive"`
+	// paths among files of El Torito boot images making the iso bootable, set both for an iso booting with BIOS or UEFI
+	// efiBootDir instead packs a directory among files into a generated EFI system partition image
+	BIOSBootImage string `json:"biosBootImage"`
+	EFIBootImage  string `json:"efiBootImage"`
+	EFIBootDir    string `json:"efiBootDir"`
+	// how long the iso is served for as a duration string, defaults to ISO_TTL
+	TTL string `json:"ttl"`
+}
+
+type createISOResponse struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// isosHandler sends GET requests to list and POST requests to create
+func isosHandler(list, create http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			list.ServeHTTP(w, r)
+		case http.MethodPost:
+			create.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// listISOsHandler responds with the details of every iso in the isos directory
+func listISOsHandler(log *logrus.Logger, store *isoStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isos, err := store.list()
+		if err != nil {
+			log.WithError(err).Error("failed to list isos")
+			writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(log, w, http.StatusOK, isos)
+	})
+}
+
+// createISOHandler builds a new iso from the files in the request and responds with its download URL
+func createISOHandler(log *logrus.Logger, store *isoStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req createISORequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid request body: %v", err)})
+			return
+		}
+		if req.Name == "" {
+			req.Name = uuid.New().String() + ".iso"
+		}
+		ttl, err := parseISOTTL(req.TTL)
+		if err != nil {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		var seed isoSeed
+		switch {
+		case req.NoCloud != nil && req.ConfigDrive != nil:
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: "only one of nocloud and configDrive may be set"})
+			return
+		case req.NoCloud != nil:
+			seed = req.NoCloud
+		case req.ConfigDrive != nil:
+			seed = req.ConfigDrive
+		}
+		if seed != nil && req.VolumeLabel == "" {
+			req.VolumeLabel = seed.volumeLabel()
+		}
+
+		if req.EFIBootImage != "" && req.EFIBootDir != "" {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: "only one of efiBootImage and efiBootDir may be set"})
+			return
+		}
+		boot := bootImages{bios: req.BIOSBootImage, efi: req.EFIBootImage, efiDir: req.EFIBootDir}
+		err = store.create(req.Name, req.VolumeLabel, req.Files, seed, boot, ttl)
+		writeCreatedISO(log, w, store, req.Name, err)
+	})
+}
+
+// createISOFromArchiveHandler builds a new iso from the tar, tar.gz, or zip archive in the request body and responds
+// with its download URL, the name, volumeLabel, ttl, and boot images are set by query parameters named as in
+// createISORequest, archives larger than maxSize bytes are rejected
+func createISOFromArchiveHandler(log *logrus.Logger, store *isoStore, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.ContentLength > maxSize {
+			writeJSON(log, w, http.StatusRequestEntityTooLarge, errorResponse{Error: fmt.Sprintf("archive is larger than %d bytes", maxSize)})
+			return
+		}
+
+		query := r.URL.Query()
+		name := query.Get("name")
+		if name == "" {
+			name = uuid.New().String() + ".iso"
+		}
+		ttl, err := parseISOTTL(query.Get("ttl"))
+		if err != nil {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		boot := bootImages{bios: query.Get("biosBootImage"), efi: query.Get("efiBootImage"), efiDir: query.Get("efiBootDir")}
+		if boot.efi != "" && boot.efiDir != "" {
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: "only one of efiBootImage and efiBootDir may be set"})
+			return
+		}
+
+		err = store.createFromArchive(name, query.Get("volumeLabel"), http.MaxBytesReader(w, r.Body, maxSize), boot, ttl)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeJSON(log, w, http.StatusRequestEntityTooLarge, errorResponse{Error: fmt.Sprintf("archive is larger than %d bytes", maxSize)})
+			return
+		}
+		writeCreatedISO(log, w, store, name, err)
+	})
+}
+
+// parseISOTTL parses the ttl of an iso created through the API, zero if ttl is empty
+func parseISOTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q", ttl)
+	}
+	return d, nil
+}
+
+// writeCreatedISO responds with the download URL and checksum of the iso called name, or with the error err
+// creating it returned, failed builds are server errors and anything else is the request's fault
+func writeCreatedISO(log *logrus.Logger, w http.ResponseWriter, store *isoStore, name string, err error) {
+	switch {
+	case errors.Is(err, os.ErrExist):
+		writeJSON(log, w, http.StatusConflict, errorResponse{Error: fmt.Sprintf("iso %s already exists", name)})
+		return
+	case errors.Is(err, ErrISOBuild):
+		log.WithError(err).Errorf("failed to create iso %s", name)
+		writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	case err != nil:
+		writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	checksum, err := imageChecksum(store.path(name))
+	if err != nil {
+		log.WithError(err).Errorf("failed to checksum iso %s", name)
+		writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	isoURL, err := store.url(name)
+	if err != nil {
+		writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+		return
+	}
+	log.Infof("created iso %s", name)
+	writeJSON(log, w, http.StatusCreated, createISOResponse{Name: name, URL: isoURL, SHA256: checksum})
+}
+
+// uploadISOHandler stores the request body as the iso named by the request path
+// bodies larger than maxSize bytes are rejected
+func uploadISOHandler(log *logrus.Logger, store *isoStore, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if r.ContentLength > maxSize {
+			writeJSON(log, w, http.StatusRequestEntityTooLarge, errorResponse{Error: fmt.Sprintf("iso is larger than %d bytes", maxSize)})
+			return
+		}
+
+		checksum, replaced, err := store.upload(name, http.MaxBytesReader(w, r.Body, maxSize))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeJSON(log, w, http.StatusRequestEntityTooLarge, errorResponse{Error: fmt.Sprintf("iso is larger than %d bytes", maxSize)})
+				return
+			}
+			log.WithError(err).Errorf("failed to upload iso %s", name)
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+		isoURL, err := store.url(name)
+		if err != nil {
+			writeJSON(log, w, http.StatusInternalServerError, errorResponse{Error: err.Error()})
+			return
+		}
+
+		log.Infof("uploaded iso %s with sha256 %s", name, checksum)
+		status := http.StatusCreated
+		if replaced {
+			status = http.StatusOK
+		}
+		writeJSON(log, w, status, createISOResponse{Name: name, URL: isoURL, SHA256: checksum})
+	})
+}
+
+// deleteISOHandler removes the iso named by the request path from the isos directory
+func deleteISOHandler(log *logrus.Logger, store *isoStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		err := store.delete(name)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			writeJSON(log, w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("iso %s not found", name)})
+		case errors.Is(err, errISOInUse):
+			writeJSON(log, w, http.StatusConflict, errorResponse{Error: fmt.Sprintf("iso %s is being downloaded", name)})
+		case err != nil:
+			writeJSON(log, w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		default:
+			log.Infof("deleted iso %s", name)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
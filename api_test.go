@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// credentialRecorder serves a mockBMC and records the basic auth user and password of each request to it that has
+// them, the service root is read without
+type credentialRecorder struct {
+	mu    sync.Mutex
+	mock  *mockBMC
+	users []string
+}
+
+func (c *credentialRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, ok := r.BasicAuth(); ok {
+		c.mu.Lock()
+		c.users = append(c.users, user+":"+password)
+		c.mu.Unlock()
+	}
+	c.mock.ServeHTTP(w, r)
+}
+
+// seen returns the distinct credentials requests were made with
+func (c *credentialRecorder) seen() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := map[string]bool{}
+	for _, user := range c.users {
+		seen[user] = true
+	}
+	return seen
+}
+
+func TestBMCInsertHandlerCredentials(t *testing.T) {
+	withOptions(t)
+	Options.MediaType = mediaTypeCD
+	Options.BMCResetType = "On"
+
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "test.iso"), 'a', 64*1024)
+	isoServer := httptest.NewServer(http.StripPrefix("/images", http.FileServer(mergedDirs{isosDir})))
+	defer isoServer.Close()
+
+	configured := &credentialRecorder{mock: newTestMockBMC()}
+	configuredServer := httptest.NewServer(configured)
+	defer configuredServer.Close()
+	other := &credentialRecorder{mock: newTestMockBMC()}
+	otherServer := httptest.NewServer(other)
+	defer otherServer.Close()
+
+	targets := []bmcTarget{{address: configuredServer.URL + mockSystemURI, credentials: bmcCredentials{user: "admin", password: "configured"}}}
+	handler := bmcInsertHandler(context.Background(), discardLog().Logger, http.DefaultClient, targets, mergedDirs{isosDir}, isoServer.URL, time.Minute)
+
+	for _, tc := range []struct {
+		name     string
+		bmc      *credentialRecorder
+		address  string
+		user     string
+		password string
+		status   int
+		seen     string
+	}{
+		{name: "configured BMC", bmc: configured, address: configuredServer.URL + mockSystemURI + "/", status: http.StatusOK, seen: "admin:configured"},
+		{name: "configured BMC with credentials", bmc: configured, address: configuredServer.URL + mockSystemURI, user: "operator", password: "given", status: http.StatusOK, seen: "operator:given"},
+		// the configured credentials must never reach a BMC the caller picks
+		{name: "other BMC", bmc: other, address: otherServer.URL + mockSystemURI, status: http.StatusBadRequest},
+		{name: "other BMC with credentials", bmc: other, address: otherServer.URL + mockSystemURI, user: "operator", password: "given", status: http.StatusOK, seen: "operator:given"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.bmc.mu.Lock()
+			tc.bmc.users = nil
+			tc.bmc.mu.Unlock()
+			body, err := json.Marshal(bmcInsertRequest{Address: tc.address, Username: tc.user, Password: tc.password, Image: "test.iso"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bmc/insert", bytes.NewReader(body)))
+			if rec.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, rec.Code, rec.Body)
+			}
+
+			seen := tc.bmc.seen()
+			if tc.seen == "" {
+				if len(seen) != 0 {
+					t.Fatalf("expected no requests to the BMC, got some with %v", seen)
+				}
+				return
+			}
+			if len(seen) != 1 || !seen[tc.seen] {
+				t.Fatalf("expected requests with %s, got %v", tc.seen, seen)
+			}
+		})
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := requireToken("s3cret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		auth   string
+		status int
+	}{
+		{auth: "Bearer s3cret", status: http.StatusNoContent},
+		{auth: "", status: http.StatusUnauthorized},
+		{auth: "s3cret", status: http.StatusUnauthorized},
+		{auth: "Basic s3cret", status: http.StatusUnauthorized},
+		{auth: "Bearer wrong", status: http.StatusUnauthorized},
+		{auth: "Bearer ", status: http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/isos", nil)
+		if tc.auth != "" {
+			r.Header.Set("Authorization", tc.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("Authorization %q got status %d, expected %d", tc.auth, w.Code, tc.status)
+		}
+	}
+}
+
+// newTestISOStore returns a store serving isos from a temp dir at http://isos.example.com/images
+func newTestISOStore(t *testing.T) *isoStore {
+	t.Helper()
+	expiry, err := newISOExpiry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &isoStore{
+		dataDir:   t.TempDir(),
+		isosDir:   t.TempDir(),
+		baseURL:   "http://isos.example.com",
+		expiry:    expiry,
+		downloads: newDownloadTracker(),
+		format:    rockRidgeFormat,
+	}
+}
+
+// serveAPI sends a request with method, path, and body to handler and returns the response, decoding a JSON body
+// into v if it is set
+func serveAPI(t *testing.T, handler http.Handler, method, path string, body []byte, v interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, path, bytes.NewReader(body)))
+	if v != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("failed to decode response %q: %v", w.Body, err)
+		}
+	}
+	return w
+}
+
+func TestCreateISOHandler(t *testing.T) {
+	store := newTestISOStore(t)
+	handler := createISOHandler(discardLog().Logger, store)
+
+	body := []byte(`{"name": "created.iso", "files": [{"path": "config", "content": "config-data"}, {"path": "dir/bin", "content": "AAEC", "encoding": "base64"}]}`)
+	var created createISOResponse
+	if w := serveAPI(t, handler, http.MethodPost, "/api/isos", body, &created); w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	if created.Name != "created.iso" || created.URL != "http://isos.example.com/images/created.iso" {
+		t.Errorf("created %s at %s", created.Name, created.URL)
+	}
+	if checksum, err := fileSHA256(store.path("created.iso")); err != nil || checksum != created.SHA256 {
+		t.Errorf("response has sha256 %s, the iso has %s (%v)", created.SHA256, checksum, err)
+	}
+	iso := openISO(t, store.path("created.iso"))
+	if got := readISOFile(t, iso, "/config"); got != "config-data" {
+		t.Errorf("iso has %q for /config", got)
+	}
+	if got := readISOFile(t, iso, "/dir/bin"); got != "\x00\x01\x02" {
+		t.Errorf("iso has %q for /dir/bin", got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "existing name", body: `{"name": "created.iso", "files": [{"path": "config", "content": "x"}]}`, status: http.StatusConflict},
+		{name: "invalid body", body: `{"name": `, status: http.StatusBadRequest},
+		{name: "invalid name", body: `{"name": "../escape.iso", "files": []}`, status: http.StatusBadRequest},
+		{name: "invalid ttl", body: `{"ttl": "forever"}`, status: http.StatusBadRequest},
+		{name: "two seeds", body: `{"nocloud": {}, "configDrive": {}}`, status: http.StatusBadRequest},
+		{name: "two EFI boot images", body: `{"efiBootImage": "efi.img", "efiBootDir": "EFI"}`, status: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serveAPI(t, handler, http.MethodPost, "/api/isos", []byte(tc.body), nil); w.Code != tc.status {
+				t.Fatalf("got %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+	if w := serveAPI(t, handler, http.MethodGet, "/api/isos", nil, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestListISOsHandler(t *testing.T) {
+	store := newTestISOStore(t)
+	handler := isosHandler(listISOsHandler(discardLog().Logger, store), http.NotFoundHandler())
+
+	var isos []isoInfo
+	if w := serveAPI(t, handler, http.MethodGet, "/api/isos", nil, &isos); w.Code != http.StatusOK {
+		t.Fatalf("list got %d: %s", w.Code, w.Body)
+	}
+	if len(isos) != 0 {
+		t.Fatalf("empty isos dir listed %d isos", len(isos))
+	}
+
+	writeFakeISO(t, store.path("b.iso"), 'b', 64*1024)
+	writeFakeISO(t, store.path("a.iso"), 'a', 64*1024)
+	checksum, err := writeChecksumFile(store.path("a.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// neither of these is an iso
+	writeTree(t, store.isosDir, map[string]string{"notes.txt": "x", ".upload-123": "x"})
+
+	if w := serveAPI(t, handler, http.MethodGet, "/api/isos", nil, &isos); w.Code != http.StatusOK {
+		t.Fatalf("list got %d: %s", w.Code, w.Body)
+	}
+	if len(isos) != 2 || isos[0].Name != "a.iso" || isos[1].Name != "b.iso" {
+		t.Fatalf("listed %+v, expected a.iso and b.iso", isos)
+	}
+	a := isos[0]
+	if a.SHA256 != checksum || a.Size != 64*1024 || a.URL != "http://isos.example.com/images/a.iso" ||
+		a.ChecksumURL != a.URL+checksumSuffix || a.SignatureURL != "" {
+		t.Errorf("a.iso listed as %+v", a)
+	}
+	// hashed when there is no checksum file
+	if checksum, err := fileSHA256(store.path("b.iso")); err != nil || isos[1].SHA256 != checksum {
+		t.Errorf("b.iso listed with sha256 %s, it has %s (%v)", isos[1].SHA256, checksum, err)
+	}
+
+	if w := serveAPI(t, handler, http.MethodPut, "/api/isos", nil, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT got %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestDeleteISOHandler(t *testing.T) {
+	store := newTestISOStore(t)
+	handler := deleteISOHandler(discardLog().Logger, store)
+	writeFakeISO(t, store.path("a.iso"), 'a', 64*1024)
+	if _, err := writeChecksumFile(store.path("a.iso")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a download in progress
+	store.downloads.active["a.iso"] = 1
+	if w := serveAPI(t, handler, http.MethodDelete, "/a.iso", nil, nil); w.Code != http.StatusConflict {
+		t.Fatalf("delete while downloading got %d, expected %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	delete(store.downloads.active, "a.iso")
+
+	if w := serveAPI(t, handler, http.MethodDelete, "/a.iso", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("delete got %d: %s", w.Code, w.Body)
+	}
+	entries, err := os.ReadDir(store.isosDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the iso and its checksum to be removed, %d entries are left", len(entries))
+	}
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{method: http.MethodDelete, path: "/a.iso", status: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/notes.txt", status: http.StatusBadRequest},
+		{method: http.MethodGet, path: "/a.iso", status: http.StatusMethodNotAllowed},
+	} {
+		if w := serveAPI(t, handler, tc.method, tc.path, nil, nil); w.Code != tc.status {
+			t.Errorf("%s %s got %d, expected %d", tc.method, tc.path, w.Code, tc.status)
+		}
+	}
+}
+
+func TestUploadISOHandler(t *testing.T) {
+	store := newTestISOStore(t)
+	const maxSize = 128 * 1024
+	handler := uploadISOHandler(discardLog().Logger, store, maxSize)
+	isoData := func(fill byte, size int) []byte {
+		path := filepath.Join(t.TempDir(), "upload.iso")
+		writeFakeISO(t, path, fill, size)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, tc := range []struct {
+		name   string
+		body   []byte
+		status int
+		fill   byte
+	}{
+		{name: "new", body: isoData('a', 64*1024), status: http.StatusCreated, fill: 'a'},
+		{name: "replaced", body: isoData('b', 64*1024), status: http.StatusOK, fill: 'b'},
+		// the served iso is left as it was
+		{name: "not an iso", body: []byte("not an iso"), status: http.StatusBadRequest, fill: 'b'},
+		{name: "too large", body: isoData('c', 2*maxSize), status: http.StatusRequestEntityTooLarge, fill: 'b'},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var uploaded createISOResponse
+			w := serveAPI(t, handler, http.MethodPut, "/upload.iso", tc.body, &uploaded)
+			if w.Code != tc.status {
+				t.Fatalf("got %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+			f, err := os.Open(store.path("upload.iso"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			readFill(t, f, 0, tc.fill)
+			checksum, err := imageChecksum(store.path("upload.iso"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hashed, err := fileSHA256(store.path("upload.iso")); err != nil || checksum != hashed {
+				t.Fatalf("checksum file has %s, the iso has %s (%v)", checksum, hashed, err)
+			}
+			if w.Code < 300 && (uploaded.SHA256 != checksum || uploaded.URL != "http://isos.example.com/images/upload.iso") {
+				t.Fatalf("uploaded as %+v", uploaded)
+			}
+		})
+	}
+
+	if w := serveAPI(t, handler, http.MethodPut, "/notes.txt", isoData('a', 64*1024), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("upload of notes.txt got %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	entries, err := os.ReadDir(store.isosDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only upload.iso and its checksum in the isos dir, got %d entries", len(entries))
+	}
+}
+
+func TestCreateISOFromArchiveHandler(t *testing.T) {
+	store := newTestISOStore(t)
+	const maxSize = 64 * 1024
+	handler := createISOFromArchiveHandler(discardLog().Logger, store, maxSize)
+	archive := tarData(t, []archiveEntry{{name: "dir", dir: true}, {name: "dir/config", content: "config-data"}}, true)
+
+	var created createISOResponse
+	if w := serveAPI(t, handler, http.MethodPost, "/api/isos/from-archive?name=archive.iso&volumeLabel=ARCHIVE", archive, &created); w.Code != http.StatusCreated {
+		t.Fatalf("create got %d: %s", w.Code, w.Body)
+	}
+	if created.Name != "archive.iso" {
+		t.Errorf("created %s", created.Name)
+	}
+	if got := readISOFile(t, openISO(t, store.path("archive.iso")), "/dir/config"); got != "config-data" {
+		t.Errorf("iso has %q for /dir/config", got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		query  string
+		body   []byte
+		status int
+	}{
+		{name: "existing name", query: "?name=archive.iso", body: archive, status: http.StatusConflict},
+		{name: "not an archive", query: "?name=other.iso", body: []byte("not an archive"), status: http.StatusBadRequest},
+		{name: "invalid ttl", query: "?ttl=-1h", body: archive, status: http.StatusBadRequest},
+		{name: "two EFI boot images", query: "?efiBootImage=efi.img&efiBootDir=EFI", body: archive, status: http.StatusBadRequest},
+		{name: "too large", query: "?name=large.iso", body: make([]byte, 2*maxSize), status: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serveAPI(t, handler, http.MethodPost, "/api/isos/from-archive"+tc.query, tc.body, nil); w.Code != tc.status {
+				t.Fatalf("got %d, expected %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	source := t.TempDir()
+	writeTree(t, source, map[string]string{"config": "first"})
+	expiry, err := newISOExpiry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := &testISOBuilder{
+		log:     discardLog().Logger,
+		dataDir: t.TempDir(),
+		source:  source,
+		isoPath: filepath.Join(t.TempDir(), "test.iso"),
+		expiry:  expiry,
+		format:  rockRidgeFormat,
+	}
+	handler := reloadHandler(discardLog().Logger, builder)
+
+	for _, content := range []string{"first", "second"} {
+		writeTree(t, source, map[string]string{"config": content})
+		var reloaded reloadResponse
+		if w := serveAPI(t, handler, http.MethodPost, "/reload", nil, &reloaded); w.Code != http.StatusOK {
+			t.Fatalf("reload got %d: %s", w.Code, w.Body)
+		}
+		if checksum, err := fileSHA256(builder.isoPath); err != nil || reloaded.Name != "test.iso" || reloaded.SHA256 != checksum {
+			t.Fatalf("reloaded as %+v, the iso has sha256 %s (%v)", reloaded, checksum, err)
+		}
+		if got := readISOFile(t, openISO(t, builder.isoPath), "/config"); got != content {
+			t.Fatalf("reloaded iso has %q for /config, expected %q", got, content)
+		}
+	}
+
+	if err := os.RemoveAll(source); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveAPI(t, handler, http.MethodPost, "/reload", nil, nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("reload of a missing source got %d, expected %d", w.Code, http.StatusInternalServerError)
+	}
+	if w := serveAPI(t, handler, http.MethodGet, "/reload", nil, nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type sourceType int
+
+const (
+	sourceDir sourceType = iota
+	sourceTar
+	sourceTarGz
+	sourceZip
+)
+
+// detectSourceType determines whether source is a directory, tarball, gzipped tarball, or zip
+// archives are identified by their content, falling back to the file extension
+func detectSourceType(source string) (sourceType, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+	if info.IsDir() {
+		return sourceDir, nil
+	}
+
+	f, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		return sourceZip, nil
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return sourceTarGz, nil
+	case len(header) > 262 && string(header[257:262]) == "ustar":
+		return sourceTar, nil
+	}
+
+	switch name := strings.ToLower(source); {
+	case strings.HasSuffix(name, ".zip"):
+		return sourceZip, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return sourceTarGz, nil
+	case strings.HasSuffix(name, ".tar"):
+		return sourceTar, nil
+	}
+	return 0, fmt.Errorf("unable to determine source type of %s", source)
+}
+
+// extractArchive extracts the archive at source of the given type into destDir
+func extractArchive(source string, typ sourceType, destDir string) error {
+	switch typ {
+	case sourceZip:
+		return extractZip(source, destDir)
+	case sourceTar, sourceTarGz:
+		f, err := os.Open(source)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = bufio.NewReader(f)
+		if typ == sourceTarGz {
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		return extractTar(r, destDir)
+	}
+	return fmt.Errorf("%s is not an archive", source)
+}
+
+// securePath returns the path name resolves to under destDir
+// names that are absolute or would escape destDir are rejected
+func securePath(destDir, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q escapes the destination directory", name)
+	}
+	return filepath.Join(destDir, clean), nil
+}
+
+func extractTar(r io.Reader, destDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dest, err := securePath(destDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeArchiveFile(tr, dest, mode); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry type for %q", hdr.Name)
+		}
+	}
+}
+
+func extractZip(source, destDir string) error {
+	zr, err := zip.OpenReader(source)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		dest, err := securePath(destDir, zf.Name)
+		if err != nil {
+			return err
+		}
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(dest, mode.Perm()|0700); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := zf.Open()
+			if err != nil {
+				return err
+			}
+			err = writeArchiveFile(rc, dest, mode.Perm())
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry type for %q", zf.Name)
+		}
+	}
+	return nil
+}
+
+// writeArchiveFile writes the contents of r to a new file at dest, creating parent directories as needed
+func writeArchiveFile(r io.Reader, dest string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
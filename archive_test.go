@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archiveEntry is a file, directory, or symlink written into a test archive
+type archiveEntry struct {
+	name     string
+	content  string
+	dir      bool
+	linkname string
+}
+
+func writeTar(t *testing.T, path string, entries []archiveEntry, gzipped bool) {
+	t.Helper()
+	if err := os.WriteFile(path, tarData(t, entries, gzipped), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tarData returns a tarball of entries, gzipped if set
+func tarData(t *testing.T, entries []archiveEntry, gzipped bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		switch {
+		case e.dir:
+			hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeDir, 0755, 0
+		case e.linkname != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.linkname, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if gzipped {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		if _, err := zw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data = gz.Bytes()
+	}
+	return data
+}
+
+func writeZip(t *testing.T, path string, entries []archiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		hdr.SetMode(0644)
+		switch {
+		case e.dir:
+			hdr.SetMode(os.ModeDir | 0755)
+		case e.linkname != "":
+			hdr.SetMode(os.ModeSymlink | 0777)
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// zip keeps the target of a symlink as its content
+		if _, err := w.Write([]byte(e.content + e.linkname)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+var archiveContent = []archiveEntry{
+	{name: "dir/", dir: true},
+	{name: "dir/config", content: "config-data"},
+	{name: "top", content: "top-level"},
+}
+
+func TestCopySource(t *testing.T) {
+	sources := t.TempDir()
+	dirSource := filepath.Join(sources, "dir-source")
+	writeTree(t, dirSource, map[string]string{"dir/config": "config-data", "top": "top-level"})
+	writeTar(t, filepath.Join(sources, "content.tar"), archiveContent, false)
+	writeTar(t, filepath.Join(sources, "content.tar.gz"), archiveContent, true)
+	writeZip(t, filepath.Join(sources, "content.zip"), archiveContent)
+	// detected by content even without a known extension
+	writeTar(t, filepath.Join(sources, "content-tgz"), archiveContent, true)
+	writeZip(t, filepath.Join(sources, "content-zip"), archiveContent)
+
+	for source, typ := range map[string]sourceType{
+		"dir-source":     sourceDir,
+		"content.tar":    sourceTar,
+		"content.tar.gz": sourceTarGz,
+		"content.zip":    sourceZip,
+		"content-tgz":    sourceTarGz,
+		"content-zip":    sourceZip,
+	} {
+		t.Run(source, func(t *testing.T) {
+			path := filepath.Join(sources, source)
+			detected, err := detectSourceType(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected != typ {
+				t.Fatalf("detected type %d, expected %d", detected, typ)
+			}
+
+			workDir := t.TempDir()
+			if err := copySource(path, "", t.TempDir(), workDir, nil); err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"dir/config": "config-data", "top": "top-level"} {
+				data, err := os.ReadFile(filepath.Join(workDir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("%s has %q, expected %q", name, data, content)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRejectsMaliciousEntries(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		entry archiveEntry
+	}{
+		{name: "parent dir", entry: archiveEntry{name: "../escaped", content: "x"}},
+		{name: "nested parent dir", entry: archiveEntry{name: "dir/../../escaped", content: "x"}},
+		{name: "absolute path", entry: archiveEntry{name: "/escaped", content: "x"}},
+		{name: "symlink", entry: archiveEntry{name: "link", linkname: "../escaped"}},
+	} {
+		for _, format := range []string{"tar", "tar.gz", "zip"} {
+			t.Run(tc.name+" "+format, func(t *testing.T) {
+				root := t.TempDir()
+				archive := filepath.Join(root, "content."+format)
+				entries := []archiveEntry{{name: "ok", content: "ok"}, tc.entry}
+				typ := sourceZip
+				switch format {
+				case "tar":
+					writeTar(t, archive, entries, false)
+					typ = sourceTar
+				case "tar.gz":
+					writeTar(t, archive, entries, true)
+					typ = sourceTarGz
+				default:
+					writeZip(t, archive, entries)
+				}
+
+				destDir := filepath.Join(root, "dest", "extract")
+				if err := os.MkdirAll(destDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := extractArchive(archive, typ, destDir); err == nil {
+					t.Fatal("expected the archive to be rejected")
+				}
+				for _, p := range []string{filepath.Join(root, "escaped"), filepath.Join(root, "dest", "escaped"), "/escaped"} {
+					if _, err := os.Lstat(p); !os.IsNotExist(err) {
+						t.Errorf("%s was written outside the destination", p)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	auditInsertMedia  = "InsertMedia"
+	auditEjectMedia   = "EjectMedia"
+	auditReset        = "Reset"
+	auditBootOverride = "BootOverride"
+)
+
+// audit records the BMC mutations of this run, nil when AUDIT_LOG_FILE isn't set
+var audit *auditLog
+
+// auditRecord is a line of the audit log
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// address of the BMC target the action was made on
+	BMC    string `json:"bmc"`
+	Action string `json:"action"`
+	// redfish resource acted on, or the IPMI command
+	Resource     string `json:"resource"`
+	Image        string `json:"image,omitempty"`
+	ResetType    string `json:"resetType,omitempty"`
+	BootOverride string `json:"bootOverride,omitempty"`
+	// success or failure
+	Result     string `json:"result"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// auditLog appends an auditRecord as a JSON line to a file for every change made to a BMC
+type auditLog struct {
+	mu  sync.Mutex
+	log *logrus.Logger
+	f   *os.File
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if needed
+func openAuditLog(log *logrus.Logger, path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s: %w", path, err)
+	}
+	return &auditLog{log: log, f: f}, nil
+}
+
+// record writes r to the audit log with the current time and the result of err, it does nothing on a nil log
+// failing to write is logged rather than failing the action, which has already been made
+func (a *auditLog) record(r auditRecord, err error) {
+	if a == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	r.Result = "success"
+	if err != nil {
+		r.Result = "failure"
+		r.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(r)
+	if marshalErr != nil {
+		a.log.WithError(marshalErr).Error("failed to encode audit record")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		a.log.WithError(err).Errorf("failed to write audit record for %s on %s", r.Action, r.BMC)
+		return
+	}
+	if err := a.f.Sync(); err != nil {
+		a.log.WithError(err).Errorf("failed to sync audit log")
+	}
+}
+
+type auditTargetKey struct{}
+
+// withAuditTarget returns ctx carrying address as the BMC target requests made with it are audited under
+func withAuditTarget(ctx context.Context, address string) context.Context {
+	return context.WithValue(ctx, auditTargetKey{}, address)
+}
+
+// auditTransport records the requests that insert or eject media, reset the host, or change its boot override
+// once their response arrives, other requests are passed through untouched
+type auditTransport struct {
+	next http.RoundTripper
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if audit == nil || (req.Method != http.MethodPost && req.Method != http.MethodPatch) {
+		return t.next.RoundTrip(req)
+	}
+	record, ok := auditRequest(req)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	result := err
+	if err == nil {
+		record.StatusCode = resp.StatusCode
+		if resp.StatusCode >= http.StatusBadRequest {
+			result = fmt.Errorf("BMC responded %s", resp.Status)
+		}
+	}
+	audit.record(record, result)
+	return resp, err
+}
+
+// auditRequest returns the audit record for req if it is one of the audited mutations
+func auditRequest(req *http.Request) (auditRecord, bool) {
+	var body struct {
+		Image     string `json:"Image"`
+		ResetType string `json:"ResetType"`
+		Boot      *struct {
+			BootSourceOverrideEnabled string `json:"BootSourceOverrideEnabled"`
+			BootSourceOverrideTarget  string `json:"BootSourceOverrideTarget"`
+		} `json:"Boot"`
+	}
+	if req.GetBody != nil {
+		if reader, err := req.GetBody(); err == nil {
+			// a body that isn't JSON leaves the fields empty
+			_ = json.NewDecoder(io.LimitReader(reader, 1<<20)).Decode(&body)
+			reader.Close()
+		}
+	}
+
+	bmc, _ := req.Context().Value(auditTargetKey{}).(string)
+	if bmc == "" {
+		bmc = req.URL.Scheme + "://" + req.URL.Host
+	}
+	record := auditRecord{BMC: bmc, Resource: req.URL.Path}
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	switch {
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/VirtualMedia.InsertMedia"):
+		record.Action = auditInsertMedia
+		record.Image = body.Image
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/VirtualMedia.EjectMedia"):
+		record.Action = auditEjectMedia
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/ComputerSystem.Reset"):
+		record.Action = auditReset
+		record.ResetType = body.ResetType
+	case req.Method == http.MethodPatch && body.Boot != nil:
+		record.Action = auditBootOverride
+		record.BootOverride = strings.TrimSpace(body.Boot.BootSourceOverrideEnabled + " " + body.Boot.BootSourceOverrideTarget)
+	case req.Method == http.MethodPatch && body.Image != "":
+		// the OEM insert used on HPE iLO
+		record.Action = auditInsertMedia
+		record.Image = body.Image
+	default:
+		return auditRecord{}, false
+	}
+	return record, true
+}
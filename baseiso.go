@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+const (
+	// logical block size of iso9660, independent of the sector size of the image
+	isoBlockSize = 2048
+	// volume descriptors start at this sector and end with a terminator
+	firstVolumeDescriptor = 16
+	maxVolumeDescriptors  = 64
+	elToritoSystemID      = "EL TORITO SPECIFICATION"
+	// El Torito platform ids
+	elToritoPlatformBIOS = 0x00
+	elToritoPlatformEFI  = 0xef
+	// El Torito boot catalog entry and section header ids
+	elToritoBootable     = 0x88
+	elToritoSection      = 0x90
+	elToritoFinalSection = 0x91
+)
+
+// baseISOInfo is what an overlay carries over from a base iso besides its files
+type baseISOInfo struct {
+	label string
+	// boot images of the base iso found in its file tree
+	boot bootImages
+	// platforms with a boot image outside the file tree, such as an appended EFI partition, which can't be carried over
+	unreachable []string
+}
+
+// readBaseISO returns the volume label and boot images of the iso at isoPath
+// installers find their media by label and firmware boots the images in the boot catalog, so an overlay
+// keeps both to stay a working installer
+func readBaseISO(isoPath string) (baseISOInfo, error) {
+	d, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return baseISOInfo{}, fmt.Errorf("failed to open base iso %s: %w", isoPath, err)
+	}
+	defer d.File.Close()
+
+	d.LogicalBlocksize = isoBlockSize
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		return baseISOInfo{}, fmt.Errorf("failed to read filesystem of base iso %s: %w", isoPath, err)
+	}
+	info := baseISOInfo{label: strings.TrimRight(fs.Label(), " \x00")}
+	images, err := elToritoImages(d.File)
+	if err != nil {
+		return baseISOInfo{}, fmt.Errorf("failed to read boot catalog of base iso %s: %w", isoPath, err)
+	}
+	if len(images) == 0 {
+		return info, nil
+	}
+
+	paths := make(map[uint32]string)
+	if err := isoFileLocations(fs, "/", paths); err != nil {
+		return baseISOInfo{}, fmt.Errorf("failed to read base iso %s: %w", isoPath, err)
+	}
+	for _, platform := range []struct {
+		id    byte
+		name  string
+		image *string
+	}{
+		{elToritoPlatformBIOS, "BIOS", &info.boot.bios},
+		{elToritoPlatformEFI, "EFI", &info.boot.efi},
+	} {
+		lba, ok := images[platform.id]
+		if !ok {
+			continue
+		}
+		if p, ok := paths[lba]; ok {
+			*platform.image = p
+		} else {
+			info.unreachable = append(info.unreachable, platform.name)
+		}
+	}
+	return info, nil
+}
+
+// elToritoImages returns the sector of the first bootable image in the boot catalog of the iso in r for each platform
+// an iso without a boot catalog has none
+func elToritoImages(r io.ReaderAt) (map[byte]uint32, error) {
+	sector := make([]byte, isoBlockSize)
+	var catalog uint32
+	for i := 0; i < maxVolumeDescriptors && catalog == 0; i++ {
+		if _, err := r.ReadAt(sector, int64(firstVolumeDescriptor+i)*isoBlockSize); err != nil {
+			return nil, err
+		}
+		if string(sector[1:6]) != "CD001" || sector[0] == 0xff {
+			break
+		}
+		// a boot record volume descriptor
+		if sector[0] == 0 && strings.HasPrefix(string(sector[7:39]), elToritoSystemID) {
+			catalog = binary.LittleEndian.Uint32(sector[71:75])
+		}
+	}
+	images := make(map[byte]uint32)
+	if catalog == 0 {
+		return images, nil
+	}
+
+	if _, err := r.ReadAt(sector, int64(catalog)*isoBlockSize); err != nil {
+		return nil, err
+	}
+	// a validation entry naming the platform of the default entry that follows it
+	if sector[0] != 1 {
+		return nil, fmt.Errorf("boot catalog has no validation entry")
+	}
+	if sector[32] == elToritoBootable {
+		images[sector[1]] = binary.LittleEndian.Uint32(sector[40:44])
+	}
+	for offset := 64; offset+32 <= len(sector); {
+		header := sector[offset : offset+32]
+		if header[0] != elToritoSection && header[0] != elToritoFinalSection {
+			break
+		}
+		platform := header[1]
+		count := int(binary.LittleEndian.Uint16(header[2:4]))
+		offset += 32
+		for i := 0; i < count && offset+32 <= len(sector); i++ {
+			entry := sector[offset : offset+32]
+			if _, ok := images[platform]; !ok && entry[0] == elToritoBootable {
+				images[platform] = binary.LittleEndian.Uint32(entry[8:12])
+			}
+			offset += 32
+		}
+		if header[0] == elToritoFinalSection {
+			break
+		}
+	}
+	return images, nil
+}
+
+// isoFileLocations records the path of every file under dir of fs by the sector it starts at
+func isoFileLocations(fs filesystem.FileSystem, dir string, paths map[uint32]string) error {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		if info.IsDir() {
+			if err := isoFileLocations(fs, name, paths); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		if file, ok := f.(*iso9660.File); ok && file.Size() > 0 {
+			paths[file.Location()] = name
+		}
+	}
+	return nil
+}
+
+// extractISO copies the file tree of the iso at isoPath into workDir
+// files are written writable so overlay content can replace them, the boot catalog isn't copied
+// but readBaseISO finds the boot images in it to configure again
+func extractISO(isoPath, workDir string) error {
+	d, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return fmt.Errorf("failed to open base iso %s: %w", isoPath, err)
+	}
+	defer d.File.Close()
+
+	d.LogicalBlocksize = isoBlockSize
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		return fmt.Errorf("failed to read filesystem of base iso %s: %w", isoPath, err)
+	}
+	return extractISODir(fs, "/", workDir)
+}
+
+// extractISODir recursively copies dir of fs into destDir
+func extractISODir(fs filesystem.FileSystem, dir, destDir string) error {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		dest, err := securePath(destDir, name[1:])
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+			if err := extractISODir(fs, name, destDir); err != nil {
+				return err
+			}
+			continue
+		}
+
+		src, err := fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		if err := writeArchiveFile(src, dest, 0644); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1064 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// bmcTarget is the redfish system to connect to and the credentials to use
+type bmcTarget struct {
+	// URL of the BMC including the path to the computer system, which may be omitted if it only has one
+	address     string
+	credentials bmcCredentials
+	// picks the computer system when address doesn't include its path
+	system systemSelector
+	// host specific values its own iso is rendered with, see hostISODefinitions
+	hostname     string
+	templateVars map[string]string
+	// nmstate file or keyfile dir embedded into the host's own iso
+	networkConfig string
+	// URL of the host's own iso, inserted instead of the shared test iso when set
+	isoURL string
+}
+
+// systemSelector picks one of the computer systems of a BMC by its identity
+type systemSelector struct {
+	serialNumber string
+	assetTag     string
+	// position in the Systems collection, unset when nil
+	index *int
+}
+
+// empty returns true if s doesn't select anything
+func (s systemSelector) empty() bool {
+	return s.serialNumber == "" && s.assetTag == "" && s.index == nil
+}
+
+// matches returns true if system, at position i in the Systems collection, has every property set in s
+func (s systemSelector) matches(i int, system *redfish.ComputerSystem) bool {
+	if s.serialNumber != "" && system.SerialNumber != s.serialNumber {
+		return false
+	}
+	if s.assetTag != "" && system.AssetTag != s.assetTag {
+		return false
+	}
+	return s.index == nil || *s.index == i
+}
+
+func (s systemSelector) String() string {
+	var fields []string
+	if s.serialNumber != "" {
+		fields = append(fields, fmt.Sprintf("serial number %q", s.serialNumber))
+	}
+	if s.assetTag != "" {
+		fields = append(fields, fmt.Sprintf("asset tag %q", s.assetTag))
+	}
+	if s.index != nil {
+		fields = append(fields, fmt.Sprintf("index %d", *s.index))
+	}
+	return strings.Join(fields, " and ")
+}
+
+// testVirtualMedia connects to the BMC at target and inserts and removes the test ISO
+// httpClient is used for all requests to the BMC
+// if callbacks is not nil the host must also phone home from the booted iso within Options.PhoneHomeTimeout
+// if events is not nil the wait mode subscribes to the BMC's events to notice the boot instead of only polling
+func testVirtualMedia(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string, callbacks *phoneHome, events *redfishEvents) (err error) {
+	if err := validateWaitMode(Options.WaitMode); err != nil {
+		return err
+	}
+
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	if err := identifyBMC(log, client, system, Options.RequireVendor); err != nil {
+		return err
+	}
+
+	// system was read before anything was changed so its boot settings are the ones to put back, and a host that
+	// was off powering on after the reset shows it booted again
+	savedBoot := system.Boot
+	poweredOff := system.PowerState != redfish.OnPowerState
+	var overridden bool
+	if Options.WaitMode != waitModeNone {
+		// the host still needs the override to boot the media left inserted when not waiting
+		defer func() {
+			if !overridden {
+				return
+			}
+			if restoreErr := restoreBootOverride(ctx, log, httpClient, target, system, savedBoot); restoreErr != nil {
+				if err != nil {
+					log.WithError(restoreErr).Error("failed to restore boot override")
+					return
+				}
+				err = restoreErr
+				return
+			}
+			log.Infof("restored boot override to %s %s", savedBoot.BootSourceOverrideEnabled, savedBoot.BootSourceOverrideTarget)
+		}()
+	}
+	// set up just before the reset and torn down once the test is over
+	var stopConsole, unsubscribe func()
+	defer func() {
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+		if stopConsole != nil {
+			stopConsole()
+		}
+	}()
+	var before bootProgress
+	var bootEvents <-chan struct{}
+	isoVM, err := bootFromMedia(ctx, log, client, system, isoURL, func() error {
+		overridden = true
+		log.Info("media inserted, booting host")
+
+		if Options.ConsoleCapture {
+			stop, err := startConsoleCapture(ctx, log, client, system, target)
+			if err != nil {
+				log.WithError(err).Warn("not capturing serial console")
+			} else {
+				stopConsole = stop
+			}
+		}
+		var err error
+		if before, err = getBootProgress(client, system.ODataID); err != nil {
+			return err
+		}
+		if events != nil && Options.WaitMode == waitModeWait {
+			// subscribed before the reset so the events it causes aren't missed
+			sub, err := events.subscribe(ctx, log, client, system.ODataID)
+			if err != nil {
+				log.WithError(err).Warn("not subscribing to BMC events, polling for the boot")
+				return nil
+			}
+			log.Infof("subscribed to BMC events at %s", sub.uri)
+			bootEvents = sub.events
+			unsubscribe = func() {
+				if err := unsubscribeEvents(ctx, log, httpClient, target, client, events, sub); err != nil {
+					log.WithError(err).Warn("failed to delete event subscription")
+				}
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNoCDMedia) && Options.IPMIFallback {
+		log.Warn("BMC has no redfish virtual media, booting from CD over IPMI")
+		return ipmiBootFromCD(ctx, log, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	if Options.PowerStableChecks > 0 {
+		if err := waitForPowerStable(ctx, client, system.ODataID, Options.PowerStableChecks, Options.PowerStableInterval, Options.PowerStableTimeout); err != nil {
+			return err
+		}
+		log.Infof("host reported power on for %d consecutive checks", Options.PowerStableChecks)
+	}
+
+	if Options.WaitMode != waitModeWait {
+		if err := waitForPhoneHome(ctx, log, callbacks, system.UUID); err != nil {
+			saveScreenshot(log, client, system, target.address)
+			return err
+		}
+	}
+
+	switch Options.WaitMode {
+	case waitModeNone:
+		log.Info("host booting, leaving media inserted")
+		return nil
+	case waitModeUntilEjectedExternally:
+		log.Info("waiting for media to be ejected externally")
+		if err := waitForExternalEject(ctx, client, isoVM.ODataID, Options.WaitPollInterval); err != nil {
+			return err
+		}
+		log.Info("media ejected externally")
+		return nil
+	}
+
+	log.Infof("waiting up to %s for the host to boot", Options.BMCBootWait)
+	bootErr := waitForBoot(ctx, log, client, system.ODataID, isoVM.ODataID, before, poweredOff, bootEvents, Options.WaitPollInterval, Options.BMCBootWait)
+	if bootErr == nil {
+		bootErr = waitForPhoneHome(ctx, log, callbacks, system.UUID)
+	}
+	if bootErr != nil {
+		saveScreenshot(log, client, system, target.address)
+	}
+
+	if Options.KeepMediaInserted {
+		log.Info("leaving media inserted")
+		return bootErr
+	}
+	if err := retryBMCCall(ctx, log, "eject", func() error { return ejectVirtualMedia(ctx, client, isoVM) }); err != nil {
+		return wrapError(ErrEjectMedia, err)
+	}
+	log.Info("media ejected")
+
+	return bootErr
+}
+
+const (
+	bmcActionFullTest = "full-test"
+	bmcActionInsert   = "insert"
+	bmcActionEject    = "eject"
+)
+
+// validateBMCAction returns an error if action is not one of the supported BMC actions
+func validateBMCAction(action string) error {
+	switch action {
+	case bmcActionFullTest, bmcActionInsert, bmcActionEject:
+		return nil
+	}
+	return fmt.Errorf("unsupported BMC action %q", action)
+}
+
+// attachMedia inserts isoURL into the virtual media of target and leaves it there without booting the host
+func attachMedia(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string) error {
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	if err := identifyBMC(log, client, system, Options.RequireVendor); err != nil {
+		return err
+	}
+	vm, err := insertMedia(ctx, log, client, system, isoURL)
+	if err != nil {
+		return err
+	}
+	log.Infof("%s inserted in %s", isoURL, vm.ODataID)
+	return nil
+}
+
+// ejectAllMedia ejects whatever is inserted in the virtual media of Options.MediaType of target
+func ejectAllMedia(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget) error {
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	vms, err := testMediaDevices(client, system)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if !vm.Inserted {
+			continue
+		}
+		log.Infof("ejecting %s from %s", vm.Image, vm.ODataID)
+		if err := retryBMCCall(ctx, log, "eject", func() error { return ejectVirtualMedia(ctx, client, vm) }); err != nil {
+			return wrapError(ErrEjectMedia, fmt.Errorf("%s: %w", vm.Image, err))
+		}
+	}
+	return nil
+}
+
+// saveScreenshot saves a screenshot of the host console if SCREENSHOT_ON_FAILURE is set
+// failing to take one is only logged so the boot failure is still what gets reported
+func saveScreenshot(log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, address string) {
+	if !Options.ScreenshotOnFailure {
+		return
+	}
+	path, err := captureScreenshot(log, client, system, address)
+	if err != nil {
+		log.WithError(err).Warn("failed to take screenshot")
+		return
+	}
+	log.Infof("saved screenshot to %s", path)
+}
+
+// waitForPhoneHome waits for the host with systemUUID to call back, it returns immediately if callbacks is nil
+func waitForPhoneHome(ctx context.Context, log *logrus.Entry, callbacks *phoneHome, systemUUID string) error {
+	if callbacks == nil {
+		return nil
+	}
+	log.Infof("waiting up to %s for system %q to phone home", Options.PhoneHomeTimeout, systemUUID)
+	if err := callbacks.wait(ctx, systemUUID, Options.PhoneHomeTimeout); err != nil {
+		return err
+	}
+	log.Info("host phoned home")
+	return nil
+}
+
+// ejectTimeout bounds the best effort eject after an operation times out or is cancelled
+const ejectTimeout = 30 * time.Second
+
+// withOperationTimeout runs op against target with a context that is done once timeout elapses, a timeout of zero
+// waits forever, or once ctx is done
+// op must use the context for all its BMC calls and waits so it returns as soon as the operation is abandoned,
+// isoURL is then ejected from the BMC on a best effort basis unless KEEP_MEDIA_INSERTED is set
+func withOperationTimeout(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string, timeout time.Duration, op func(context.Context) error) error {
+	opCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		opCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := op(opCtx)
+	if err == nil || opCtx.Err() == nil {
+		return err
+	}
+
+	abandoned := wrapError(ErrOperationTimeout, fmt.Errorf("operation did not finish within %s", timeout))
+	if ctx.Err() != nil {
+		abandoned = wrapError(ErrOperationCancelled, ctx.Err())
+	}
+	if Options.KeepMediaInserted {
+		log.Warnf("%v, leaving %s inserted", abandoned, isoURL)
+		return abandoned
+	}
+	log.Warnf("%v, ejecting %s", abandoned, isoURL)
+	// the context of the operation is done so the eject gets its own
+	ejectCtx, cancel := context.WithTimeout(context.Background(), ejectTimeout)
+	defer cancel()
+	if err := ejectImage(ejectCtx, log, httpClient, target, isoURL); err != nil {
+		log.WithError(err).Errorf("failed to eject %s", isoURL)
+	}
+	return abandoned
+}
+
+// ejectImage ejects any media of Options.MediaType on target with isoURL inserted
+func ejectImage(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string) error {
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	vms, err := testMediaDevices(client, system)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		if !vm.Inserted || vm.Image != isoURL {
+			continue
+		}
+		if err := retryBMCCall(ctx, log, "eject", func() error { return ejectVirtualMedia(ctx, client, vm) }); err != nil {
+			return wrapError(ErrEjectMedia, err)
+		}
+	}
+	return nil
+}
+
+const (
+	waitModeWait                   = "wait"
+	waitModeNone                   = "none"
+	waitModeUntilEjectedExternally = "until-ejected-externally"
+)
+
+// validateWaitMode returns an error if mode is not one of the supported wait modes
+func validateWaitMode(mode string) error {
+	switch mode {
+	case waitModeWait, waitModeNone, waitModeUntilEjectedExternally:
+		return nil
+	}
+	return fmt.Errorf("unsupported wait mode %q", mode)
+}
+
+// bootOnceFromMedia sets system to boot from the virtual CD or USB stick of Options.MediaType on its next boot only
+func bootOnceFromMedia(system *redfish.ComputerSystem) error {
+	err := system.SetBoot(redfish.Boot{
+		BootSourceOverrideEnabled: redfish.OnceBootSourceOverrideEnabled,
+		BootSourceOverrideTarget:  bootOverrideTarget(Options.MediaType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set boot override: %w", err)
+	}
+	return nil
+}
+
+// restoreBootOverride calls restoreBoot on system, or on a new connection to target with a context of its own
+// once ctx is done so the override is restored when the test is cancelled too
+func restoreBootOverride(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, system *redfish.ComputerSystem, saved redfish.Boot) error {
+	if ctx.Err() == nil {
+		return restoreBoot(system, saved)
+	}
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), ejectTimeout)
+	defer cancel()
+	_, current, disconnect, err := connectBMC(cleanupCtx, log, httpClient, target)
+	if err != nil {
+		return fmt.Errorf("failed to restore boot override: %w", err)
+	}
+	defer disconnect()
+	return restoreBoot(current, saved)
+}
+
+// unsubscribeEvents deletes sub from the BMC of client, reconnecting to target if ctx is already done
+func unsubscribeEvents(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, client common.Client, events *redfishEvents, sub *eventSubscription) error {
+	if ctx.Err() == nil {
+		return events.unsubscribe(ctx, log, client, sub)
+	}
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), ejectTimeout)
+	defer cancel()
+	current, _, disconnect, err := connectBMC(cleanupCtx, log, httpClient, target)
+	if err != nil {
+		events.remove(sub)
+		return err
+	}
+	defer disconnect()
+	return events.unsubscribe(cleanupCtx, log, current, sub)
+}
+
+// restoreBoot sets the boot override of system back to saved, the settings read before bootOnceFromMedia
+// nothing is done if the BMC didn't report an override
+func restoreBoot(system *redfish.ComputerSystem, saved redfish.Boot) error {
+	if saved.BootSourceOverrideEnabled == "" {
+		return nil
+	}
+	boot := redfish.Boot{
+		BootSourceOverrideEnabled: saved.BootSourceOverrideEnabled,
+		BootSourceOverrideTarget:  saved.BootSourceOverrideTarget,
+		BootSourceOverrideMode:    saved.BootSourceOverrideMode,
+	}
+	if saved.BootSourceOverrideTarget == redfish.UefiTargetBootSourceOverrideTarget {
+		boot.UefiTargetBootSourceOverride = saved.UefiTargetBootSourceOverride
+	}
+	if err := system.SetBoot(boot); err != nil {
+		return fmt.Errorf("failed to restore boot override: %w", err)
+	}
+	return nil
+}
+
+// resetTypes are the values allowed for BMC_RESET_TYPE
+var resetTypes = []redfish.ResetType{
+	redfish.OnResetType,
+	redfish.ForceRestartResetType,
+	redfish.GracefulRestartResetType,
+	redfish.PowerCycleResetType,
+}
+
+// validateResetType returns an error if resetType is not one of resetTypes
+func validateResetType(resetType string) error {
+	for _, t := range resetTypes {
+		if redfish.ResetType(resetType) == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported reset type %q", resetType)
+}
+
+// resetSystem resets system with Options.BMCResetType so it boots from the inserted media
+func resetSystem(ctx context.Context, log *logrus.Entry, system *redfish.ComputerSystem) error {
+	resetType := redfish.ResetType(Options.BMCResetType)
+	if resetType == redfish.OnResetType && system.PowerState == redfish.OnPowerState {
+		log.Warn("host is already powered on so an On reset won't reboot it, set BMC_RESET_TYPE to restart it instead")
+	}
+	if err := retryBMCCall(ctx, log, "reset", func() error { return system.Reset(resetType) }); err != nil {
+		return wrapError(ErrSystemReset, err)
+	}
+	return nil
+}
+
+// waitForExternalEject polls the virtual media at vmURI every interval until it is no longer inserted
+func waitForExternalEject(ctx context.Context, client common.Client, vmURI string, interval time.Duration) error {
+	for {
+		vm, err := redfish.GetVirtualMedia(client, vmURI)
+		if err != nil {
+			return fmt.Errorf("failed to get virtual media %s: %w", vmURI, err)
+		}
+		if !vm.Inserted {
+			return nil
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// waitForPowerStable polls the power state of the system at systemURI every interval until it reports On
+// for checks consecutive polls, a host that powers off again after reset restarts the count
+func waitForPowerStable(ctx context.Context, client common.Client, systemURI string, checks int, interval, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	consecutive := 0
+	var state redfish.PowerState
+	for {
+		system, err := redfish.GetComputerSystem(client, systemURI)
+		if err != nil {
+			return fmt.Errorf("failed to get computer system: %w", err)
+		}
+		state = system.PowerState
+		if state == redfish.OnPowerState {
+			consecutive++
+		} else {
+			consecutive = 0
+		}
+		if consecutive >= checks {
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return wrapError(ErrPowerUnstable, fmt.Errorf("power state %s after %s", state, timeout))
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// insertAndBoot inserts isoURL into the virtual media of target and boots the host from it once
+// returns the redfish paths of the system and the virtual media used
+func insertAndBoot(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string) (string, string, error) {
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return "", "", err
+	}
+	defer disconnect()
+
+	if err := identifyBMC(log, client, system, Options.RequireVendor); err != nil {
+		return "", "", err
+	}
+
+	vm, err := bootFromMedia(ctx, log, client, system, isoURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	return system.ODataID, vm.ODataID, nil
+}
+
+// bootFromMedia inserts isoURL into the virtual media of system, sets the host to boot from it once, and resets it
+// beforeReset, if not nil, is called once the boot override is set, for whatever has to be in place
+// before the host restarts
+// returns the virtual media used
+func bootFromMedia(ctx context.Context, log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, isoURL string, beforeReset func() error) (*redfish.VirtualMedia, error) {
+	vm, err := insertMedia(ctx, log, client, system, isoURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := bootOnceFromMedia(system); err != nil {
+		return nil, err
+	}
+	if beforeReset != nil {
+		if err := beforeReset(); err != nil {
+			return nil, err
+		}
+	}
+	if err := resetSystem(ctx, log, system); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// identifyBMC logs the vendor, model, and firmware of system and its managers
+// if vendors is not empty the system or one of its managers must have a manufacturer in it, ignoring case
+func identifyBMC(log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, vendors []string) error {
+	manufacturers := []string{system.Manufacturer}
+	log.Infof("system %s: manufacturer %q, model %q", system.ODataID, system.Manufacturer, system.Model)
+	for _, m := range system.ManagedBy {
+		manager, err := redfish.GetManager(client, m)
+		if err != nil {
+			return fmt.Errorf("failed to get manager %s: %w", m, err)
+		}
+		log.Infof("manager %s: manufacturer %q, model %q, firmware %q", manager.ODataID, manager.Manufacturer, manager.Model, manager.FirmwareVersion)
+		manufacturers = append(manufacturers, manager.Manufacturer)
+	}
+
+	if len(vendors) == 0 {
+		return nil
+	}
+	for _, vendor := range vendors {
+		for _, manufacturer := range manufacturers {
+			if strings.EqualFold(strings.TrimSpace(vendor), manufacturer) {
+				return nil
+			}
+		}
+	}
+	return wrapError(ErrUnsupportedVendor, fmt.Errorf("%q is not one of %s", system.Manufacturer, strings.Join(vendors, ", ")))
+}
+
+// insertMedia inserts isoURL into the first virtual media of Options.MediaType of system, ejecting whatever was inserted before
+// media that already has isoURL inserted is left alone unless Options.ForceReinsert is set
+func insertMedia(ctx context.Context, log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, isoURL string) (*redfish.VirtualMedia, error) {
+	if err := validateTransferProtocol(Options.VirtualMediaTransferProtocol); err != nil {
+		return nil, err
+	}
+
+	vms, err := testMediaDevices(client, system)
+	if err != nil {
+		return nil, err
+	}
+	isoVM := vms[0]
+
+	if isoVM.Inserted && isoVM.Image == isoURL && !Options.ForceReinsert {
+		log.Infof("%s is already inserted in %s", isoURL, isoVM.ODataID)
+		return isoVM, nil
+	}
+	if err := ejectBeforeInsert(ctx, log, client, isoVM); err != nil {
+		return nil, wrapError(ErrEjectMedia, err)
+	}
+	if Options.BMCPushCACertFile != "" && strings.HasPrefix(strings.ToLower(isoURL), "https://") {
+		if err := pushVirtualMediaCA(log, client, isoVM, Options.BMCPushCACertFile); err != nil {
+			return nil, err
+		}
+	}
+	quirks := quirksFor(system)
+	config := insertMediaConfig(isoURL, quirks)
+	if Options.InsertTimeout > 0 {
+		if err := insertWithTimeout(ctx, log, client, isoVM, config, quirks, Options.InsertTimeout); err != nil {
+			return nil, err
+		}
+		return isoVM, nil
+	}
+	insert := func() error { return insertVirtualMedia(ctx, log, client, isoVM, config, quirks) }
+	if err := retryBMCCall(ctx, log, "insert", insert); err != nil {
+		return nil, wrapError(ErrInsertMedia, err)
+	}
+	if err := verifyInserted(ctx, client, isoVM, isoURL); err != nil {
+		return nil, err
+	}
+	return isoVM, nil
+}
+
+// insertVerifyAttempts is how many times the virtual media is read back after an insert before giving up
+const insertVerifyAttempts = 5
+
+// verifyInserted reads vm back until it reports isoURL inserted as some BMCs acknowledge an insert and then fail
+// to download the image without an error, the media is ejected if the BMC never reports the right image
+func verifyInserted(ctx context.Context, client common.Client, vm *redfish.VirtualMedia, isoURL string) error {
+	var current *redfish.VirtualMedia
+	for attempt := 1; ; attempt++ {
+		var err error
+		current, err = redfish.GetVirtualMedia(client, vm.ODataID)
+		if err != nil {
+			return fmt.Errorf("failed to get virtual media %s: %w", vm.ODataID, err)
+		}
+		if current.Inserted && imageMatches(current.Image, isoURL) {
+			return nil
+		}
+		if attempt == insertVerifyAttempts {
+			break
+		}
+		if err := sleepContext(ctx, insertConfirmInterval); err != nil {
+			return err
+		}
+	}
+
+	cause := fmt.Errorf("%s reports Inserted %t and Image %q", vm.ODataID, current.Inserted, current.Image)
+	if current.Inserted {
+		if err := ejectVirtualMedia(ctx, client, vm); err != nil {
+			cause = fmt.Errorf("%v, eject also failed: %w", cause, err)
+		}
+	}
+	return wrapError(ErrInsertUnconfirmed, cause)
+}
+
+// imageMatches returns true if the Image reported by a BMC is isoURL
+// BMCs that only report the file name of the image are matched on it
+func imageMatches(image, isoURL string) bool {
+	if image == isoURL {
+		return true
+	}
+	if strings.Contains(image, "://") {
+		return false
+	}
+	return image != "" && image == path.Base(isoURL)
+}
+
+// ejectBeforeInsert ejects vm even when it isn't reported inserted, as some BMCs report Inserted false while
+// an image is still attached and then reject the insert with a conflict
+// ejecting media that isn't reported inserted may be rejected as there is nothing to eject, any other error is returned
+func ejectBeforeInsert(ctx context.Context, log *logrus.Entry, client common.Client, vm *redfish.VirtualMedia) error {
+	if !vm.Inserted && !vm.SupportsMediaEject {
+		return nil
+	}
+	err := retryBMCCall(ctx, log, "eject", func() error { return ejectVirtualMedia(ctx, client, vm) })
+	if err == nil || vm.Inserted {
+		return err
+	}
+	if nothingToEject(err) {
+		log.WithError(err).Debugf("nothing to eject from %s", vm.ODataID)
+		return nil
+	}
+	return err
+}
+
+// nothingToEject returns true for the redfish errors BMCs reject an eject with when no media is inserted
+func nothingToEject(err error) bool {
+	var redfishErr *common.Error
+	if !errors.As(err, &redfishErr) {
+		return false
+	}
+	switch redfishErr.HTTPReturnedStatusCode {
+	case http.StatusBadRequest, http.StatusConflict, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// insertConfirmInterval is how often the virtual media is polled to confirm an insert took effect
+const insertConfirmInterval = time.Second
+
+// insertWithTimeout inserts the image in config into vm and waits until the BMC reports it inserted
+// if that doesn't happen within timeout the media is ejected and an error wrapping ErrInsertTimeout is returned
+func insertWithTimeout(ctx context.Context, log *logrus.Entry, client common.Client, vm *redfish.VirtualMedia, config redfish.VirtualMediaConfig, quirks bmcQuirks, timeout time.Duration) error {
+	isoURL := config.Image
+	deadline := time.Now().Add(timeout)
+
+	// gofish calls only follow the context the client was created with so a slow insert is abandoned rather than
+	// interrupted, cancelling insertCtx keeps it from being retried or sent at all once it is
+	insertCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- retryBMCCall(insertCtx, log, "insert", func() error { return insertVirtualMedia(insertCtx, log, client, vm, config, quirks) })
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return wrapError(ErrInsertMedia, err)
+		}
+	case <-time.After(timeout):
+		// the abandoned insert must not be retried after the eject
+		cancel()
+		return insertTimedOut(ctx, client, vm, fmt.Errorf("insert request did not complete within %s", timeout))
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for {
+		current, err := redfish.GetVirtualMedia(client, vm.ODataID)
+		if err != nil {
+			return fmt.Errorf("failed to get virtual media %s: %w", vm.ODataID, err)
+		}
+		if current.Inserted && imageMatches(current.Image, isoURL) {
+			return nil
+		}
+		if time.Now().Add(insertConfirmInterval).After(deadline) {
+			return insertTimedOut(ctx, client, vm, fmt.Errorf("media not reported inserted within %s", timeout))
+		}
+		if err := sleepContext(ctx, insertConfirmInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// insertTimedOut ejects vm to clean up after an insert that timed out and returns cause wrapped in ErrInsertTimeout
+func insertTimedOut(ctx context.Context, client common.Client, vm *redfish.VirtualMedia, cause error) error {
+	if err := ejectVirtualMedia(ctx, client, vm); err != nil {
+		cause = fmt.Errorf("%v, eject also failed: %w", cause, err)
+	}
+	return wrapError(ErrInsertTimeout, cause)
+}
+
+// insertMediaConfig builds the InsertMedia request for isoURL including any transfer hints and credentials from Options
+// adjusted for the quirks of the BMC
+func insertMediaConfig(isoURL string, quirks bmcQuirks) redfish.VirtualMediaConfig {
+	config := redfish.VirtualMediaConfig{
+		Image:                isoURL,
+		Inserted:             true,
+		WriteProtected:       true,
+		TransferProtocolType: Options.VirtualMediaTransferProtocol,
+		TransferMethod:       Options.VirtualMediaTransferMethod,
+		UserName:             Options.VirtualMediaUser,
+		Password:             Options.VirtualMediaPassword,
+	}
+	if quirks.minimalInsert {
+		// both are omitted from the request when false
+		config.Inserted = false
+		config.WriteProtected = false
+	}
+	return config
+}
+
+// validateTransferProtocol returns an error if protocol is set to something other than a redfish TransferProtocolType
+func validateTransferProtocol(protocol string) error {
+	switch redfish.TransferProtocolType(protocol) {
+	case "", redfish.CIFSTransferProtocolType, redfish.FTPTransferProtocolType, redfish.SFTPTransferProtocolType,
+		redfish.HTTPTransferProtocolType, redfish.HTTPSTransferProtocolType, redfish.NFSTransferProtocolType,
+		redfish.SCPTransferProtocolType, redfish.TFTPTransferProtocolType, redfish.OEMTransferProtocolType:
+		return nil
+	}
+	return fmt.Errorf("unsupported virtual media transfer protocol %q", protocol)
+}
+
+// transferProtocolAuto selects the transfer protocol matching the scheme of the iso URL
+const transferProtocolAuto = "auto"
+
+// transferProtocolForURL returns the redfish transfer protocol matching the scheme of mediaURL
+func transferProtocolForURL(mediaURL string) (redfish.TransferProtocolType, error) {
+	u, err := url.Parse(mediaURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse media URL %s: %w", mediaURL, err)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return redfish.HTTPTransferProtocolType, nil
+	case "https":
+		return redfish.HTTPSTransferProtocolType, nil
+	case "nfs":
+		return redfish.NFSTransferProtocolType, nil
+	case "cifs", "smb":
+		return redfish.CIFSTransferProtocolType, nil
+	case "ftp":
+		return redfish.FTPTransferProtocolType, nil
+	case "sftp":
+		return redfish.SFTPTransferProtocolType, nil
+	case "scp":
+		return redfish.SCPTransferProtocolType, nil
+	case "tftp":
+		return redfish.TFTPTransferProtocolType, nil
+	}
+	return "", fmt.Errorf("unsupported media URL scheme %q", u.Scheme)
+}
+
+// bmcEndpoint returns the redfish service endpoint (scheme and host) of bmcURL
+// the host is re-encoded so IPv6 literals keep their brackets and escaped zone identifiers
+func bmcEndpoint(bmcURL *url.URL) string {
+	return (&url.URL{Scheme: bmcURL.Scheme, Host: bmcURL.Host}).String()
+}
+
+// connectBMC connects to the BMC at target and returns the client along with the computer system
+// identified by the address path, or the only system of the BMC if the address has no path
+// a redfish session is created instead of using basic auth if Options.BMCSessionAuth is set
+// every request of the client is made with ctx
+// disconnect must be called once the client is no longer needed
+func connectBMC(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget) (client *gofish.APIClient, system *redfish.ComputerSystem, disconnect func(), err error) {
+	bmcURL, err := url.Parse(target.address)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to parse BMC Address %s: %w", target.address, err)
+	}
+
+	user, password, err := target.credentials.get()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get credentials for %s: %w", target.address, err)
+	}
+	config := gofish.ClientConfig{
+		Endpoint:   bmcEndpoint(bmcURL),
+		Username:   user,
+		Password:   password,
+		BasicAuth:  !Options.BMCSessionAuth,
+		HTTPClient: httpClient,
+	}
+	// the logrus writer runs a goroutine until closed so only create it when dumps are requested
+	disconnect = func() {}
+	if Options.BMCDump {
+		dumpWriter := log.WriterLevel(logrus.DebugLevel)
+		config.DumpWriter = dumpWriter
+		disconnect = func() { dumpWriter.Close() }
+	}
+
+	// requests carry the target so the audit log names it rather than only the BMC host
+	client, err = gofish.ConnectContext(withAuditTarget(ctx, target.address), config)
+	if err != nil {
+		disconnect()
+		return nil, nil, nil, wrapError(ErrBMCConnect, err)
+	}
+	if !config.BasicAuth {
+		// ends the redfish session so sessions don't pile up on the BMC across connections, BMCs only keep a few
+		bmcSessions.track(log, httpClient, config.Endpoint, client)
+		closeDump := disconnect
+		disconnect = func() {
+			bmcSessions.logout(client)
+			closeDump()
+		}
+	}
+
+	if strings.Trim(bmcURL.Path, "/") == "" {
+		system, err = discoverSystem(log, client, target.system)
+	} else {
+		system, err = redfish.GetComputerSystem(client, bmcURL.Path)
+	}
+	if err != nil {
+		disconnect()
+		return nil, nil, nil, fmt.Errorf("failed to get computer system: %w", err)
+	}
+	return client, system, disconnect, nil
+}
+
+// discoverSystem returns the computer system of the BMC picked by selector, or its only one if selector is empty
+// BMCs managing several systems are otherwise an error listing them as the system must then be named
+func discoverSystem(log *logrus.Entry, client *gofish.APIClient, selector systemSelector) (*redfish.ComputerSystem, error) {
+	systems, err := listSystems(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list computer systems: %w", err)
+	}
+	if len(systems) == 0 {
+		return nil, fmt.Errorf("BMC has no computer systems")
+	}
+
+	candidates := make([]string, 0, len(systems))
+	for _, system := range systems {
+		candidates = append(candidates, fmt.Sprintf("%s (serial number %q, asset tag %q)", system.ODataID, system.SerialNumber, system.AssetTag))
+	}
+
+	if selector.empty() {
+		if len(systems) == 1 {
+			log.Infof("using computer system %s", systems[0].ODataID)
+			return systems[0], nil
+		}
+		return nil, fmt.Errorf("BMC has %d computer systems, add the path of one to the address or select one by serial number, asset tag, or index: %s",
+			len(systems), strings.Join(candidates, ", "))
+	}
+
+	var matched []*redfish.ComputerSystem
+	for i, system := range systems {
+		if selector.matches(i, system) {
+			matched = append(matched, system)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return nil, fmt.Errorf("no computer system matches %s, the BMC has: %s", selector, strings.Join(candidates, ", "))
+	case 1:
+		log.Infof("using computer system %s matching %s", matched[0].ODataID, selector)
+		return matched[0], nil
+	}
+	return nil, fmt.Errorf("%d computer systems match %s", len(matched), selector)
+}
+
+// listSystems returns the computer systems of the BMC in the order of the Systems collection
+// which gofish doesn't keep as it fetches them concurrently
+func listSystems(client *gofish.APIClient) ([]*redfish.ComputerSystem, error) {
+	var root struct {
+		Systems common.Link `json:"Systems"`
+	}
+	if err := getJSON(client, common.DefaultServiceRoot, &root); err != nil {
+		return nil, err
+	}
+	if root.Systems == "" {
+		return nil, nil
+	}
+	var collection struct {
+		Members common.Links `json:"Members"`
+	}
+	if err := getJSON(client, string(root.Systems), &collection); err != nil {
+		return nil, err
+	}
+
+	systems := make([]*redfish.ComputerSystem, 0, len(collection.Members))
+	for _, member := range collection.Members {
+		system, err := redfish.GetComputerSystem(client, string(member))
+		if err != nil {
+			return nil, err
+		}
+		systems = append(systems, system)
+	}
+	return systems, nil
+}
+
+// testMediaDevices returns the virtual media at Options.VirtualMediaURI if set,
+// otherwise all virtual media devices supporting Options.MediaType attached to system, or if it has none
+// those found through the managers of system
+func testMediaDevices(client common.Client, system *redfish.ComputerSystem) ([]*redfish.VirtualMedia, error) {
+	if Options.VirtualMediaURI != "" {
+		vm, err := redfish.GetVirtualMedia(client, Options.VirtualMediaURI)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get virtual media %s: %w", Options.VirtualMediaURI, err)
+		}
+		return []*redfish.VirtualMedia{vm}, nil
+	}
+
+	link, err := systemVirtualMediaLink(client, system.ODataID)
+	if err != nil {
+		return nil, err
+	}
+	vms, err := redfish.ListReferencedVirtualMedias(client, link)
+	if err != nil {
+		return nil, err
+	}
+	mediaType := virtualMediaType(Options.MediaType)
+	matching := filterMediaType(vms, mediaType)
+	if len(matching) > 0 {
+		return matching, nil
+	}
+
+	for _, m := range system.ManagedBy {
+		manager, err := redfish.GetManager(client, m)
+		if err != nil {
+			return nil, err
+		}
+		vms, err := manager.VirtualMedia()
+		if err != nil {
+			return nil, err
+		}
+		matching = append(matching, filterMediaType(vms, mediaType)...)
+	}
+
+	if len(matching) == 0 {
+		return nil, noMediaError(Options.MediaType)
+	}
+
+	return matching, nil
+}
+
+// filterMediaType returns the virtual media in vms that support mediaType
+func filterMediaType(vms []*redfish.VirtualMedia, mediaType redfish.VirtualMediaType) []*redfish.VirtualMedia {
+	var matching []*redfish.VirtualMedia
+	for _, vm := range vms {
+		for _, vmType := range vm.MediaTypes {
+			if vmType == mediaType {
+				matching = append(matching, vm)
+				break
+			}
+		}
+	}
+	return matching
+}
+
+// systemVirtualMediaLink returns the virtual media collection of the system at systemURI,
+// empty for older schemas that only attach virtual media to managers, which gofish doesn't model
+func systemVirtualMediaLink(client common.Client, systemURI string) (string, error) {
+	var system struct {
+		VirtualMedia common.Link `json:"VirtualMedia"`
+	}
+	if err := getJSON(client, systemURI, &system); err != nil {
+		return "", err
+	}
+	return string(system.VirtualMedia), nil
+}
+
+// cleanupVirtualMedia ejects any media of Options.MediaType on the BMC whose image is served from baseURL
+// media inserted from anywhere else is left alone
+func cleanupVirtualMedia(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, baseURL string) error {
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	vms, err := testMediaDevices(client, system)
+	if err != nil {
+		return err
+	}
+
+	prefix := strings.TrimSuffix(baseURL, "/") + "/"
+	for _, vm := range vms {
+		if !vm.Inserted || !strings.HasPrefix(vm.Image, prefix) {
+			continue
+		}
+		log.Infof("ejecting stale media %s from %s", vm.Image, vm.ODataID)
+		if err := retryBMCCall(ctx, log, "eject", func() error { return ejectVirtualMedia(ctx, client, vm) }); err != nil {
+			return wrapError(ErrEjectMedia, fmt.Errorf("%s: %w", vm.Image, err))
+		}
+	}
+	return nil
+}
+
+// getJSON decodes the redfish resource at uri into v
+func getJSON(client common.Client, uri string, v interface{}) error {
+	resp, err := client.Get(uri)
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", uri, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", uri, err)
+	}
+	return nil
+}
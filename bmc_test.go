@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// slowInsertBMC serves a virtual media device whose InsertMedia takes insertDelay and then fails with a transient
+// error, recording when each insert and eject arrived
+type slowInsertBMC struct {
+	mu          sync.Mutex
+	insertDelay time.Duration
+	inserts     []time.Time
+	ejects      []time.Time
+}
+
+func (b *slowInsertBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == mockVirtualMediaURI:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"@odata.id":  mockVirtualMediaURI,
+			"MediaTypes": []string{"CD"},
+			"Actions": map[string]interface{}{
+				"#VirtualMedia.InsertMedia": map[string]string{"target": mockVirtualMediaURI + "/Actions/VirtualMedia.InsertMedia"},
+				"#VirtualMedia.EjectMedia":  map[string]string{"target": mockVirtualMediaURI + "/Actions/VirtualMedia.EjectMedia"},
+			},
+		})
+	case r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"@odata.id": "/redfish/v1/"})
+	case r.URL.Path == mockVirtualMediaURI+"/Actions/VirtualMedia.InsertMedia":
+		b.mu.Lock()
+		b.inserts = append(b.inserts, time.Now())
+		b.mu.Unlock()
+		time.Sleep(b.insertDelay)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	case r.URL.Path == mockVirtualMediaURI+"/Actions/VirtualMedia.EjectMedia":
+		b.mu.Lock()
+		b.ejects = append(b.ejects, time.Now())
+		b.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// withOptions restores Options once the test is over, so it can change them freely
+func withOptions(t *testing.T) {
+	saved := Options
+	t.Cleanup(func() { Options = saved })
+}
+
+func discardLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logrus.NewEntry(logger)
+}
+
+func TestInsertWithTimeoutEjects(t *testing.T) {
+	withOptions(t)
+	Options.BMCRetries = 5
+	Options.BMCRetryBackoff = 10 * time.Millisecond
+	Options.BMCRetryMaxBackoff = 10 * time.Millisecond
+
+	bmc := &slowInsertBMC{insertDelay: 300 * time.Millisecond}
+	server := httptest.NewServer(bmc)
+	defer server.Close()
+	client, err := gofish.ConnectDefault(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm, err := redfish.GetVirtualMedia(client, mockVirtualMediaURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the insert is still being retried when the timeout fires, had it run its course it would fail with ErrInsertMedia
+	err = insertWithTimeout(context.Background(), discardLog(), client, vm, redfish.VirtualMediaConfig{Image: "http://example.com/test.iso"}, bmcQuirks{}, 100*time.Millisecond)
+	if !errors.Is(err, ErrInsertTimeout) {
+		t.Fatalf("expected %v, got %v", ErrInsertTimeout, err)
+	}
+
+	// the abandoned insert fails after the eject, which must not lead to it being retried
+	time.Sleep(2 * bmc.insertDelay)
+	bmc.mu.Lock()
+	defer bmc.mu.Unlock()
+	if len(bmc.ejects) != 1 {
+		t.Fatalf("expected 1 eject, got %d", len(bmc.ejects))
+	}
+	for _, insert := range bmc.inserts {
+		if insert.After(bmc.ejects[0]) {
+			t.Fatalf("insert sent %s after the eject", insert.Sub(bmc.ejects[0]))
+		}
+	}
+	if len(bmc.inserts) != 1 {
+		t.Fatalf("expected 1 insert, got %d", len(bmc.inserts))
+	}
+}
+
+func TestEjectBeforeInsert(t *testing.T) {
+	withOptions(t)
+	Options.BMCRetries = 1
+	Options.BMCRetryBackoff = time.Millisecond
+	Options.BMCRetryMaxBackoff = time.Millisecond
+
+	for _, tc := range []struct {
+		status int
+		err    bool
+	}{
+		{status: http.StatusNoContent},
+		// nothing inserted to eject
+		{status: http.StatusBadRequest},
+		{status: http.StatusConflict},
+		{status: http.StatusUnauthorized, err: true},
+		{status: http.StatusForbidden, err: true},
+		{status: http.StatusInternalServerError, err: true},
+	} {
+		t.Run(http.StatusText(tc.status), func(t *testing.T) {
+			server := serveMockBMC(t, map[string]http.HandlerFunc{
+				"POST " + mockVirtualMediaURI + "/Actions/VirtualMedia.EjectMedia": func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tc.status)
+				},
+			})
+			client, err := gofish.ConnectDefault(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm, err := redfish.GetVirtualMedia(client, mockVirtualMediaURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vm.Inserted {
+				t.Fatal("expected the mock BMC to report nothing inserted")
+			}
+			err = ejectBeforeInsert(context.Background(), discardLog(), client, vm)
+			if tc.err && err == nil {
+				t.Fatalf("expected an eject answered with %d to fail", tc.status)
+			}
+			if !tc.err && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestIPv6URLs(t *testing.T) {
+	for address, endpoint := range map[string]string{
+		"https://[2001:db8::1]/redfish/v1/Systems/1":         "https://[2001:db8::1]",
+		"https://[2001:db8::1]:8443/redfish/v1/Systems/1":    "https://[2001:db8::1]:8443",
+		"https://[fe80::1%25eth0]:8443/redfish/v1/Systems/1": "https://[fe80::1%25eth0]:8443",
+		"https://192.0.2.1/redfish/v1/Systems/1":             "https://192.0.2.1",
+	} {
+		bmcURL, err := url.Parse(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bmcEndpoint(bmcURL); got != endpoint {
+			t.Errorf("endpoint of %s is %s, expected %s", address, got, endpoint)
+		}
+		if _, err := url.Parse(bmcEndpoint(bmcURL)); err != nil {
+			t.Errorf("endpoint of %s is not a valid URL: %v", address, err)
+		}
+	}
+
+	for bind, addr := range map[string]string{
+		"":             "localhost:8080",
+		"::":           "localhost:8080",
+		"::1":          "[::1]:8080",
+		"fe80::1%eth0": "[fe80::1%eth0]:8080",
+		"192.0.2.1":    "192.0.2.1:8080",
+	} {
+		if got := localServerAddress(bind, "8080"); got != addr {
+			t.Errorf("local address of %q is %s, expected %s", bind, got, addr)
+		}
+	}
+
+	for baseURL, isoURL := range map[string]string{
+		"http://[2001:db8::1]:8080":          "http://[2001:db8::1]:8080/images/test.iso",
+		"http://[2001:db8::1]:8080/":         "http://[2001:db8::1]:8080/images/test.iso",
+		"http://[fe80::1%25eth0]:8080/isos/": "http://[fe80::1%25eth0]:8080/isos/images/test.iso",
+	} {
+		got, err := url.JoinPath(baseURL, "images", "test.iso")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != isoURL {
+			t.Errorf("iso URL under %s is %s, expected %s", baseURL, got, isoURL)
+		}
+	}
+}
+
+// listenIPv6 returns a listener on the IPv6 loopback address, skipping the test if there is none
+func listenIPv6(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return listener
+}
+
+func TestInsertMediaIPv6(t *testing.T) {
+	withOptions(t)
+	Options.MediaType = mediaTypeCD
+
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "test.iso"), 'a', 64*1024)
+	isoServer := &httptest.Server{Listener: listenIPv6(t), Config: &http.Server{Handler: http.StripPrefix("/images/", http.FileServer(mergedDirs{isosDir}))}}
+	isoServer.Start()
+	defer isoServer.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	mock := &mockBMC{log: logger, power: "Off", bootState: "None", boot: map[string]string{}, client: http.DefaultClient}
+	bmcServer := &httptest.Server{Listener: listenIPv6(t), Config: &http.Server{Handler: mock}}
+	bmcServer.Start()
+	defer bmcServer.Close()
+
+	isoURL, err := url.JoinPath(isoServer.URL, "images", "test.iso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := bmcTarget{address: bmcServer.URL + mockSystemURI}
+	client, system, disconnect, err := connectBMC(context.Background(), discardLog(), http.DefaultClient, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	if _, err := insertMedia(context.Background(), discardLog(), client, system, isoURL); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	if mock.image != isoURL {
+		t.Fatalf("BMC was asked to insert %q, expected %q", mock.image, isoURL)
+	}
+	if u, err := url.Parse(mock.image); err != nil || u.Hostname() != "::1" {
+		t.Fatalf("BMC was asked to insert %q which doesn't name the IPv6 host: %v", mock.image, err)
+	}
+}
+
+func TestConnectBMCDumpDoesNotLeak(t *testing.T) {
+	withOptions(t)
+	Options.BMCDump = true
+	server := serveMockBMC(t, nil)
+	failing := serveMockBMC(t, map[string]http.HandlerFunc{"GET " + mockSystemURI: http.NotFound})
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	httpClient := &http.Client{Transport: &http.Transport{}}
+
+	connect := func() {
+		client, _, disconnect, err := connectBMC(context.Background(), discardLog(), httpClient, bmcTarget{address: server.URL + mockSystemURI})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := redfish.GetVirtualMedia(client, mockVirtualMediaURI); err != nil {
+			t.Fatal(err)
+		}
+		disconnect()
+		// failing to get the system or to connect at all must not leak either
+		for _, address := range []string{failing.URL + mockSystemURI, unreachable.URL} {
+			if _, _, _, err := connectBMC(context.Background(), discardLog(), httpClient, bmcTarget{address: address}); err == nil {
+				t.Fatalf("expected connecting to %s to fail", address)
+			}
+		}
+		httpClient.CloseIdleConnections()
+	}
+
+	// the first round starts whatever runs for the whole test, such as the servers' connection handling
+	connect()
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		connect()
+	}
+	// goroutines of closed connections take a moment to exit
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Fatalf("%d goroutines left running after 20 BMC operations, %d before", n, baseline)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// pushVirtualMediaCA adds the PEM certificate in caCertFile to the certificates vm trusts for HTTPS images
+// nothing is sent if the BMC already has it
+func pushVirtualMediaCA(log *logrus.Entry, client common.Client, vm *redfish.VirtualMedia, caCertFile string) error {
+	pem, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificate %s: %w", caCertFile, err)
+	}
+	cert := strings.TrimSpace(string(pem))
+
+	var vmRaw struct {
+		Certificates common.Link `json:"Certificates"`
+	}
+	if err := getJSON(client, vm.ODataID, &vmRaw); err != nil {
+		return err
+	}
+	if vmRaw.Certificates == "" {
+		return fmt.Errorf("virtual media %s has no certificates collection to trust the server certificate", vm.ODataID)
+	}
+	collection := string(vmRaw.Certificates)
+
+	var certs struct {
+		Members []common.Link `json:"Members"`
+	}
+	if err := getJSON(client, collection, &certs); err != nil {
+		return err
+	}
+	for _, member := range certs.Members {
+		var existing struct {
+			CertificateString string `json:"CertificateString"`
+		}
+		if err := getJSON(client, string(member), &existing); err != nil {
+			return err
+		}
+		if strings.TrimSpace(existing.CertificateString) == cert {
+			log.Debugf("CA certificate already trusted by %s", vm.ODataID)
+			return nil
+		}
+	}
+
+	resp, err := client.Post(collection, map[string]string{
+		"CertificateString": cert,
+		"CertificateType":   "PEM",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add CA certificate to %s: %w", collection, err)
+	}
+	resp.Body.Close()
+	log.Infof("added CA certificate %s to %s", caCertFile, collection)
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+)
+
+// correlationIDHeader carries the per-run id on every BMC request so BMC logs can be tied back to a run
+const correlationIDHeader = "X-Correlation-ID"
+
+// newBMCHTTPClient returns an http client to be shared by all BMC connections in a run
+// so connections are pooled rather than established for every request
+// pooled connections carry no credentials, every request is authenticated with those of the operation making it
+// every request is sent with userAgent and correlationID, tlsConfig may be nil to use the system roots
+// requests that change the BMC are recorded in the audit log
+// connectTimeout limits dialing and the TLS handshake, requestTimeout each whole request, zero disables either
+// requests the BMC asks to be retried later with Retry-After are resent within requestTimeout
+func newBMCHTTPClient(log *logrus.Logger, maxIdleConns int, connectTimeout, requestTimeout time.Duration, userAgent, correlationID string, tlsConfig *tls.Config) *http.Client {
+	defaultTransport := http.DefaultTransport.(*http.Transport)
+	transport := defaultTransport.Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+
+	return &http.Client{Timeout: requestTimeout, Transport: &headerTransport{
+		userAgent:     userAgent,
+		correlationID: correlationID,
+		next:          &auditTransport{next: &retryAfterTransport{log: log, next: &keepAliveTransport{next: transport}}},
+	}}
+}
+
+// bmcTLSConfig returns the TLS config for BMC connections or nil if neither caCertFile nor insecure are set
+// caCertFile is a PEM bundle trusted in addition to the system roots
+func bmcTLSConfig(caCertFile string, insecure bool) (*tls.Config, error) {
+	if caCertFile == "" && !insecure {
+		return nil, nil
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if caCertFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read BMC CA bundle %s: %w", caCertFile, err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in BMC CA bundle %s", caCertFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+// headerTransport sets the user agent and correlation id headers, replacing the user agent gofish sets
+type headerTransport struct {
+	userAgent     string
+	correlationID string
+	next          http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set(correlationIDHeader, t.correlationID)
+	return t.next.RoundTrip(req)
+}
+
+// keepAliveTransport allows connections to be reused for requests that ask to be closed
+// gofish marks every request with Close which would otherwise defeat connection pooling
+type keepAliveTransport struct {
+	next http.RoundTripper
+}
+
+func (t *keepAliveTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Close {
+		req = req.Clone(req.Context())
+		req.Close = false
+	}
+	return t.next.RoundTrip(req)
+}
+
+// retryAfterAttempts is the most times a single request is resent because the BMC asked for it with Retry-After
+const retryAfterAttempts = 10
+
+// retryAfterTransport resends requests the BMC answers with 503, 409, or 429 and a Retry-After header once the
+// time it asks for has passed, as iDRACs do while a previous file transfer is still in progress
+// once the BMC asks to wait longer than the deadline of the request allows, more than retryAfterAttempts times, or
+// for a body that can't be resent, the response is returned as a retryAfterError, which retryBMCCall doesn't retry,
+// so the waits the BMC asks for aren't multiplied by Options.BMCRetries
+type retryAfterTransport struct {
+	log  *logrus.Logger
+	next http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !retryAfterStatus(resp.StatusCode) {
+			return resp, err
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return resp, nil
+		}
+		deadline, hasDeadline := req.Context().Deadline()
+		if attempt > retryAfterAttempts || (req.Body != nil && req.GetBody == nil) ||
+			(hasDeadline && time.Now().Add(wait).After(deadline)) {
+			return nil, newRetryAfterError(resp)
+		}
+
+		bmc, _ := req.Context().Value(auditTargetKey{}).(string)
+		t.log.WithField("bmc", bmc).Warnf("%s %s responded %s, retrying in %s as asked by Retry-After (%d/%d)",
+			req.Method, req.URL.Path, resp.Status, wait, attempt, retryAfterAttempts)
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		resp.Body.Close()
+		if err := sleepContext(req.Context(), wait); err != nil {
+			return nil, err
+		}
+
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// retryAfterError is a response with Retry-After that retryAfterTransport gave up waiting on
+// it wraps the redfish error of the response so its status is still found with errors.As
+type retryAfterError struct {
+	err error
+}
+
+// newRetryAfterError reads and closes the body of resp
+func newRetryAfterError(resp *http.Response) *retryAfterError {
+	defer resp.Body.Close()
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return &retryAfterError{err: common.ConstructError(resp.StatusCode, []byte(err.Error()))}
+	}
+	return &retryAfterError{err: common.ConstructError(resp.StatusCode, payload)}
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("BMC is still busy after the waits it asked for with Retry-After: %v", e.err)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// retryAfterStatus returns true for the statuses a BMC sends with Retry-After when it is only busy
+func retryAfterStatus(code int) bool {
+	switch code {
+	case http.StatusServiceUnavailable, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter returns the wait asked for by a Retry-After header, given in seconds or as an HTTP date
+// relative to now, and false if header is empty or invalid
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
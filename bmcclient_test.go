@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/common"
+)
+
+// countingTransport counts the connections its requests get, and how many of them were new
+type countingTransport struct {
+	mu    sync.Mutex
+	conns int
+	fresh int
+	next  http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.conns++
+		if !info.Reused {
+			t.fresh++
+		}
+	}}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func TestBMCHTTPClientReusesConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"@odata.id": r.URL.Path})
+	}))
+	defer server.Close()
+
+	httpClient := newBMCHTTPClient(logrus.New(), 2, time.Second, 10*time.Second, "simple-iso-test", "test-run", nil)
+	counter := &countingTransport{next: httpClient.Transport}
+	httpClient.Transport = counter
+
+	// each connect stands for a separate BMC operation in the same run
+	for i := 0; i < 3; i++ {
+		client, err := gofish.ConnectContext(withAuditTarget(context.Background(), server.URL), gofish.ClientConfig{Endpoint: server.URL, HTTPClient: httpClient})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			resp, err := client.Get("/redfish/v1/Systems")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.conns != 18 {
+		t.Fatalf("expected 18 requests, got %d", counter.conns)
+	}
+	if counter.fresh != 1 {
+		t.Fatalf("expected all requests to share 1 connection, %d were opened", counter.fresh)
+	}
+}
+
+// busyBMC answers the first busy requests past the service root with 503, with retryAfter as Retry-After if it is set
+type busyBMC struct {
+	busy       int32
+	retryAfter string
+	requests   int32
+}
+
+func (b *busyBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/redfish/v1/" && atomic.AddInt32(&b.requests, 1) <= b.busy {
+		if b.retryAfter != "" {
+			w.Header().Set("Retry-After", b.retryAfter)
+		}
+		http.Error(w, `{"error": {"message": "busy"}}`, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"@odata.id": r.URL.Path})
+}
+
+func TestRetryAfter(t *testing.T) {
+	withOptions(t)
+	Options.BMCRetries = 3
+	Options.BMCRetryBackoff = time.Millisecond
+	Options.BMCRetryMaxBackoff = time.Millisecond
+
+	for _, tc := range []struct {
+		name     string
+		bmc      *busyBMC
+		timeout  time.Duration
+		err      bool
+		requests int32
+	}{
+		{name: "waited on", bmc: &busyBMC{busy: 2, retryAfter: "0"}, requests: 3},
+		// the transport's retries aren't multiplied by those of retryBMCCall
+		{name: "still busy", bmc: &busyBMC{busy: 100, retryAfter: "0"}, err: true, requests: retryAfterAttempts + 1},
+		{name: "wait beyond the deadline", bmc: &busyBMC{busy: 100, retryAfter: "60"}, timeout: time.Second, err: true, requests: 1},
+		{name: "without Retry-After", bmc: &busyBMC{busy: 2}, requests: 3},
+		{name: "without Retry-After retries exhausted", bmc: &busyBMC{busy: 100}, err: true, requests: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(tc.bmc)
+			defer server.Close()
+			timeout := tc.timeout
+			if timeout == 0 {
+				timeout = 10 * time.Second
+			}
+			httpClient := newBMCHTTPClient(discardLog().Logger, 2, time.Second, timeout, "simple-iso-test", "test-run", nil)
+			client, err := gofish.ConnectContext(context.Background(), gofish.ClientConfig{Endpoint: server.URL, HTTPClient: httpClient})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = retryBMCCall(context.Background(), discardLog(), "get", func() error {
+				resp, err := client.Get("/redfish/v1/Systems")
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			})
+			if tc.err {
+				var redfishErr *common.Error
+				if !errors.As(err, &redfishErr) || redfishErr.HTTPReturnedStatusCode != http.StatusServiceUnavailable {
+					t.Fatalf("expected a 503 redfish error, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := atomic.LoadInt32(&tc.bmc.requests); got != tc.requests {
+				t.Fatalf("BMC got %d requests, expected %d", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		header string
+		wait   time.Duration
+		ok     bool
+	}{
+		{header: "5", wait: 5 * time.Second, ok: true},
+		{header: " 0 ", ok: true},
+		{header: now.Add(time.Minute).Format(http.TimeFormat), wait: time.Minute, ok: true},
+		{header: now.Add(-time.Minute).Format(http.TimeFormat), ok: true},
+		{header: ""},
+		{header: "-1"},
+		{header: "soon"},
+	} {
+		wait, ok := parseRetryAfter(tc.header, now)
+		if wait != tc.wait || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, expected %s, %t", tc.header, wait, ok, tc.wait, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// bmcConfig is the contents of BMC_CONFIG_FILE
+type bmcConfig struct {
+	BMCs []bmcConfigEntry `json:"bmcs"`
+}
+
+// bmcConfigEntry is a single BMC to test, credentials left empty default to BMC_USER and BMC_PASSWORD or their files
+type bmcConfigEntry struct {
+	// URL of the BMC, may include the path to the computer system
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// files holding the credentials instead, relative paths are from the directory of the config file
+	UsernameFile string `json:"usernameFile"`
+	PasswordFile string `json:"passwordFile"`
+	// redfish path of the computer system, appended to Address when set
+	System string `json:"system"`
+	// select the computer system of a BMC managing several by identity instead of by path
+	SerialNumber string `json:"serialNumber"`
+	AssetTag     string `json:"assetTag"`
+	// position of the computer system in the Systems collection of the BMC
+	SystemIndex *int `json:"systemIndex"`
+	// name of the host, its Hostname template var and the name of its own iso with PER_HOST_ISOS
+	Hostname string `json:"hostname"`
+	// values the host's own iso is rendered with on top of the shared ones, such as its network config
+	TemplateVars map[string]string `json:"templateVars"`
+	// nmstate YAML file or directory of NetworkManager keyfiles with the static network config of the host,
+	// embedded into its own iso with PER_HOST_ISOS
+	// relative paths are from the directory of the config file
+	NetworkConfig string `json:"networkConfig"`
+}
+
+// loadBMCTargets reads the BMCs listed in the YAML or JSON file at path
+// credentials an entry doesn't set are taken from defaults
+func loadBMCTargets(path string, defaults bmcCredentials) ([]bmcTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read BMC config %s: %w", path, err)
+	}
+	var config bmcConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse BMC config %s: %w", path, err)
+	}
+
+	targets := make([]bmcTarget, 0, len(config.BMCs))
+	for i, entry := range config.BMCs {
+		if entry.Address == "" {
+			return nil, fmt.Errorf("BMC %d in %s has no address", i, path)
+		}
+		selector := systemSelector{serialNumber: entry.SerialNumber, assetTag: entry.AssetTag, index: entry.SystemIndex}
+		if selector.index != nil && *selector.index < 0 {
+			return nil, fmt.Errorf("BMC %d in %s has a negative systemIndex", i, path)
+		}
+		if !selector.empty() && (entry.System != "" || hasSystemPath(entry.Address)) {
+			return nil, fmt.Errorf("BMC %d in %s selects its system both by path and by %s", i, path, selector)
+		}
+		address := entry.Address
+		if entry.System != "" {
+			address, err = url.JoinPath(strings.TrimSuffix(entry.Address, "/"), entry.System)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address for BMC %d in %s: %w", i, path, err)
+			}
+		}
+		credentials := bmcCredentials{
+			user:         entry.Username,
+			password:     entry.Password,
+			userFile:     configRelative(path, entry.UsernameFile),
+			passwordFile: configRelative(path, entry.PasswordFile),
+		}
+		if err := credentials.check("username", "password"); err != nil {
+			return nil, fmt.Errorf("BMC %d in %s: %w", i, path, err)
+		}
+		networkConfig := configRelative(path, entry.NetworkConfig)
+		if networkConfig != "" {
+			if err := checkNetworkConfig(networkConfig); err != nil {
+				return nil, fmt.Errorf("BMC %d in %s: %w", i, path, err)
+			}
+		}
+		targets = append(targets, bmcTarget{
+			address:       address,
+			credentials:   credentials.withDefaults(defaults),
+			system:        selector,
+			hostname:      entry.Hostname,
+			templateVars:  entry.TemplateVars,
+			networkConfig: networkConfig,
+		})
+	}
+	return targets, nil
+}
+
+// hasSystemPath returns true if address includes a path, which names the computer system
+func hasSystemPath(address string) bool {
+	bmcURL, err := url.Parse(address)
+	return err == nil && strings.Trim(bmcURL.Path, "/") != ""
+}
+
+// configRelative returns file resolved against the directory of the config file at configPath
+func configRelative(configPath, file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(filepath.Dir(configPath), file)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// bmcResult is the outcome of testing virtual media on a single BMC
+type bmcResult struct {
+	target bmcTarget
+	err    error
+}
+
+// testBMCTargets tests virtual media on each of targets using up to workers at once
+// each target is cleaned up first if Options.CleanupOnStart is set, results are returned in the order of targets
+func testBMCTargets(ctx context.Context, log *logrus.Logger, httpClient *http.Client, targets []bmcTarget, isoURL string, callbacks *phoneHome, events *redfishEvents, workers int) []bmcResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]bmcResult, len(targets))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = bmcResult{target: targets[i], err: testBMCTarget(ctx, log, httpClient, targets[i], isoURL, callbacks, events)}
+			}
+		}()
+	}
+	for i := range targets {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// testBMCTarget runs Options.BMCAction on target logging with its address
+// the iso of target is used instead of isoURL if it has its own
+func testBMCTarget(ctx context.Context, log *logrus.Logger, httpClient *http.Client, target bmcTarget, isoURL string, callbacks *phoneHome, events *redfishEvents) error {
+	if target.isoURL != "" {
+		isoURL = target.isoURL
+	}
+	targetLog := log.WithField("bmc", target.address)
+	if ctx.Err() != nil {
+		// shutting down, don't start on targets that are still queued
+		return wrapError(ErrOperationCancelled, ctx.Err())
+	}
+	targetLog.Infof("running %s", Options.BMCAction)
+	if Options.DryRun {
+		return dryRunBMC(ctx, targetLog, httpClient, target, isoURL)
+	}
+	if Options.CleanupOnStart {
+		if err := cleanupVirtualMedia(ctx, targetLog, httpClient, target, Options.BaseURL); err != nil {
+			targetLog.WithError(err).Error("failed to clean up virtual media")
+		}
+	}
+	return withOperationTimeout(ctx, targetLog, httpClient, target, isoURL, Options.BMCOperationTimeout, func(ctx context.Context) error {
+		switch Options.BMCAction {
+		case bmcActionInsert:
+			return attachMedia(ctx, targetLog, httpClient, target, isoURL)
+		case bmcActionEject:
+			return ejectAllMedia(ctx, targetLog, httpClient, target)
+		}
+		return testVirtualMedia(ctx, targetLog, httpClient, target, isoURL, callbacks, events)
+	})
+}
+
+// logBMCResults logs the outcome of every target followed by a summary and returns the number that failed
+func logBMCResults(log *logrus.Logger, results []bmcResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.err != nil {
+			failed++
+			log.WithField("bmc", r.target.address).WithError(r.err).Errorf("%s failed", Options.BMCAction)
+			continue
+		}
+		log.WithField("bmc", r.target.address).Infof("%s succeeded", Options.BMCAction)
+	}
+	log.Infof("%s finished: %d succeeded, %d failed", Options.BMCAction, len(results)-failed, failed)
+	return failed
+}
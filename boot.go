@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+// bootImages are the paths inside the iso of the El Torito boot images, an iso with neither is not bootable
+// setting both makes an iso that boots with either BIOS or UEFI firmware as a CD, one with an EFI image also boots
+// with UEFI from a USB stick it is written to, see writeHybridMBR
+type bootImages struct {
+	bios string
+	efi  string
+	// directory in the iso packed into a generated EFI system partition image used instead of efi
+	efiDir string
+}
+
+// elTorito returns the boot catalog for the images or nil if none are set
+// each image must be a regular file in workDir, the image for efiDir is written into workDir
+func (b bootImages) elTorito(workDir string) (*iso9660.ElTorito, error) {
+	if b.efiDir != "" {
+		image, err := buildEFIBootImage(workDir, b.efiDir)
+		if err != nil {
+			return nil, err
+		}
+		b.efi = image
+	}
+	var entries []*iso9660.ElToritoEntry
+	if b.bios != "" {
+		bootFile, err := bootImagePath(workDir, b.bios)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &iso9660.ElToritoEntry{
+			Platform:  iso9660.BIOS,
+			Emulation: iso9660.NoEmulation,
+			BootFile:  bootFile,
+			BootTable: true,
+			LoadSize:  4,
+		})
+	}
+	if b.efi != "" {
+		bootFile, err := bootImagePath(workDir, b.efi)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &iso9660.ElToritoEntry{
+			Platform:  iso9660.EFI,
+			Emulation: iso9660.NoEmulation,
+			BootFile:  bootFile,
+		})
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &iso9660.ElTorito{
+		// diskfs looks for a visible catalog in the work dir when adding rock ridge extensions
+		HideBootCatalog: true,
+		Entries:         entries,
+		Platform:        entries[0].Platform,
+	}, nil
+}
+
+// efiBootFile returns the path in the work dir of the EFI boot image of elTorito, empty if it has none
+func efiBootFile(elTorito *iso9660.ElTorito) string {
+	if elTorito == nil {
+		return ""
+	}
+	for _, entry := range elTorito.Entries {
+		if entry.Platform == iso9660.EFI {
+			return entry.BootFile
+		}
+	}
+	return ""
+}
+
+// bootImagePath checks that image exists in workDir and returns its path in the form diskfs expects
+func bootImagePath(workDir, image string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+image), "/")
+	src, err := securePath(workDir, name)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("boot image %s not found in iso contents", image)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat boot image %s: %w", image, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("boot image %s is not a regular file", image)
+	}
+	return name, nil
+}
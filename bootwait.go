@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// bootProgress is the BootProgress of a computer system, which gofish doesn't model
+type bootProgress struct {
+	LastState     string `json:"LastState"`
+	LastStateTime string `json:"LastStateTime"`
+	// set when LastState is OEM
+	OemLastState string `json:"OemLastState"`
+	// how long the last boot took to reach OSRunning, only updated once it does
+	LastBootTimeSeconds float64 `json:"LastBootTimeSeconds"`
+}
+
+// state returns the OEM state when LastState is OEM, otherwise LastState
+func (p bootProgress) state() string {
+	if p.LastState == "OEM" && p.OemLastState != "" {
+		return p.OemLastState
+	}
+	return p.LastState
+}
+
+// osBootStates are the BootProgress states reported once the host has handed over to the booted media
+var osBootStates = map[string]bool{
+	"OSBootStarted": true,
+	"OSRunning":     true,
+}
+
+// bootSuccessStates returns the BootProgress states that confirm the boot, states if any are configured
+// otherwise osBootStates
+func bootSuccessStates(states []string) map[string]bool {
+	if len(states) == 0 {
+		return osBootStates
+	}
+	success := make(map[string]bool, len(states))
+	for _, state := range states {
+		success[state] = true
+	}
+	return success
+}
+
+// getBootProgress returns the BootProgress of the system at systemURI, empty if the BMC doesn't report it
+func getBootProgress(client common.Client, systemURI string) (bootProgress, error) {
+	var system struct {
+		BootProgress bootProgress `json:"BootProgress"`
+	}
+	if err := getJSON(client, systemURI, &system); err != nil {
+		return bootProgress{}, err
+	}
+	return system.BootProgress, nil
+}
+
+// waitForBoot polls the system at systemURI and the virtual media at vmURI every interval until the host is
+// confirmed to be booting from the media or timeout elapses
+// when events is not nil it is checked whenever a boot related event arrives and only polled every
+// eventFallbackInterval
+// the boot is confirmed by BootProgress reaching one of BOOT_SUCCESS_STATES, by default an OS state, that differs
+// from before, the progress reported before the reset, or by LastBootTimeSeconds changing when OSRunning confirms it
+// when the BMC doesn't report BootProgress the host has to be seen powering on with the media connected, after being
+// off before the reset, poweredOff, or during the wait
+// a boot nothing confirms keeps the media in for all of timeout and is reported as unconfirmed
+func waitForBoot(ctx context.Context, log *logrus.Entry, client common.Client, systemURI, vmURI string, before bootProgress, poweredOff bool, events <-chan struct{}, interval, timeout time.Duration) error {
+	successStates := bootSuccessStates(Options.BootSuccessStates)
+	deadline := time.Now().Add(timeout)
+	for {
+		system, err := redfish.GetComputerSystem(client, systemURI)
+		if err != nil {
+			return fmt.Errorf("failed to get computer system: %w", err)
+		}
+		progress, err := getBootProgress(client, systemURI)
+		if err != nil {
+			return err
+		}
+		vm, err := redfish.GetVirtualMedia(client, vmURI)
+		if err != nil {
+			return fmt.Errorf("failed to get virtual media %s: %w", vmURI, err)
+		}
+		if !vm.Inserted {
+			return fmt.Errorf("media was ejected before the boot was confirmed")
+		}
+		log.Debugf("power %s, boot progress %q, media connected via %q", system.PowerState, progress.state(), vm.ConnectedVia)
+
+		if system.PowerState != redfish.OnPowerState {
+			poweredOff = true
+		}
+		if system.PowerState == redfish.OnPowerState {
+			if progress.LastState == "" && poweredOff && vm.ConnectedVia != "" && vm.ConnectedVia != redfish.NotConnectedConnectedVia {
+				log.Infof("host powered on with media connected via %s", vm.ConnectedVia)
+				return nil
+			}
+			if successStates[progress.state()] && progress != before {
+				log.Infof("host boot progress reached %s", progress.state())
+				return nil
+			}
+			if successStates["OSRunning"] && progress.LastBootTimeSeconds > 0 && progress.LastBootTimeSeconds != before.LastBootTimeSeconds {
+				log.Infof("host reached OSRunning in %gs", progress.LastBootTimeSeconds)
+				return nil
+			}
+		}
+
+		wait := interval
+		if events != nil && wait < eventFallbackInterval {
+			wait = eventFallbackInterval
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 || (events == nil && wait > remaining) {
+			return wrapError(ErrBootNotConfirmed, fmt.Errorf("nothing showed the host booting, power %s, boot progress %q after %s", system.PowerState, progress.state(), timeout))
+		}
+		if wait > remaining {
+			// an event may still arrive before the deadline
+			wait = remaining
+		}
+		if err := waitForEvent(ctx, events, wait); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+)
+
+// fakeBootSystem serves a computer system whose power state and BootProgress step through a script, one entry per
+// read of the system, the last entry repeating, and a virtual media device connected with an image
+type fakeBootSystem struct {
+	mu       sync.Mutex
+	power    []string
+	progress []bootProgress
+	reads    int
+}
+
+func (f *fakeBootSystem) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resource interface{}
+	switch r.URL.Path {
+	case "/redfish/v1/", "/redfish/v1":
+		resource = map[string]string{"@odata.id": "/redfish/v1/"}
+	case mockSystemURI:
+		// waitForBoot reads the system twice per poll, for its power and its BootProgress
+		step := f.reads / 2
+		f.reads++
+		resource = map[string]interface{}{
+			"@odata.id":    mockSystemURI,
+			"PowerState":   f.power[minInt(step, len(f.power)-1)],
+			"BootProgress": f.progress[minInt(step, len(f.progress)-1)],
+		}
+	case mockVirtualMediaURI:
+		resource = map[string]interface{}{
+			"@odata.id":    mockVirtualMediaURI,
+			"Inserted":     true,
+			"Image":        "http://example.com/test.iso",
+			"ConnectedVia": "URI",
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestWaitForBoot(t *testing.T) {
+	const (
+		interval = 20 * time.Millisecond
+		timeout  = 200 * time.Millisecond
+	)
+	for _, tc := range []struct {
+		name       string
+		power      []string
+		progress   []bootProgress
+		before     bootProgress
+		poweredOff bool
+		confirmed  bool
+	}{
+		{
+			name:     "no boot progress and power never off",
+			power:    []string{"On"},
+			progress: []bootProgress{{}},
+		},
+		{
+			name:      "no boot progress and power cycled",
+			power:     []string{"On", "Off", "On"},
+			progress:  []bootProgress{{}},
+			confirmed: true,
+		},
+		{
+			name:       "no boot progress and powered off before the reset",
+			power:      []string{"On"},
+			progress:   []bootProgress{{}},
+			poweredOff: true,
+			confirmed:  true,
+		},
+		{
+			name:     "boot progress left in an OS state",
+			power:    []string{"On"},
+			progress: []bootProgress{{LastState: "OSRunning"}},
+			before:   bootProgress{LastState: "OSRunning"},
+		},
+		{
+			name:      "boot progress reaches an OS state",
+			power:     []string{"On"},
+			progress:  []bootProgress{{LastState: "OSRunning"}, {LastState: "PCIResourceConfigStarted"}, {LastState: "OSBootStarted"}},
+			before:    bootProgress{LastState: "OSRunning"},
+			confirmed: true,
+		},
+		{
+			name:      "boot progress reaches OSRunning again",
+			power:     []string{"On"},
+			progress:  []bootProgress{{LastState: "OSRunning", LastStateTime: "1"}, {LastState: "OSRunning", LastStateTime: "2"}},
+			before:    bootProgress{LastState: "OSRunning", LastStateTime: "1"},
+			confirmed: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(&fakeBootSystem{power: tc.power, progress: tc.progress})
+			defer server.Close()
+			client, err := gofish.ConnectDefault(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+
+			start := time.Now()
+			err = waitForBoot(context.Background(), logrus.NewEntry(logger), client, mockSystemURI, mockVirtualMediaURI, tc.before, tc.poweredOff, nil, interval, timeout)
+			if tc.confirmed {
+				if err != nil {
+					t.Fatalf("expected the boot to be confirmed, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrBootNotConfirmed) {
+				t.Fatalf("expected %v, got %v", ErrBootNotConfirmed, err)
+			}
+			// the media has to stay in for the whole wait when nothing confirms the boot
+			if elapsed := time.Since(start); elapsed < timeout-interval {
+				t.Fatalf("gave up after %s, expected to wait %s", elapsed, timeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumSuffix is appended to the name of a served image for its sidecar checksum file
+const checksumSuffix = ".sha256"
+
+// sidecarSuffixes name the files served next to an image, which are replaced and removed along with it
+var sidecarSuffixes = []string{checksumSuffix, signatureSuffix}
+
+// checksumPath returns the path of the sidecar checksum file of the image at path
+func checksumPath(path string) string {
+	return path + checksumSuffix
+}
+
+// writeChecksumFile hashes the image at path and writes its sidecar checksum file, returning the checksum
+func writeChecksumFile(path string) (string, error) {
+	checksum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	return checksum, writeChecksum(path, checksum)
+}
+
+// writeChecksum writes checksum as the sidecar checksum file of the image at path in the format sha256sum -c reads
+// the file is replaced by a rename so a reader never sees it half written
+// it is given the modification time of the image, which tells it apart from the sidecar of a replaced image
+func writeChecksum(path, checksum string) error {
+	image, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".checksum-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s  %s\n", checksum, filepath.Base(path)); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Chtimes(f.Name(), image.ModTime(), image.ModTime()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), checksumPath(path))
+}
+
+// imageChecksum returns the sha256 of the image at path from its sidecar checksum file, or by hashing the image if
+// that is missing or older than the image
+func imageChecksum(path string) (string, error) {
+	image, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if sidecar, err := os.Stat(checksumPath(path)); err == nil && !sidecar.ModTime().Before(image.ModTime()) {
+		if data, err := os.ReadFile(checksumPath(path)); err == nil {
+			if fields := strings.Fields(string(data)); len(fields) > 0 && len(fields[0]) == 64 {
+				return fields[0], nil
+			}
+		}
+	}
+	return fileSHA256(path)
+}
+
+// removeSidecarFiles removes the checksum and signature files of the image at path that there are
+func removeSidecarFiles(path string) error {
+	for _, suffix := range sidecarSuffixes {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sidecarImage returns the name of the image the sidecar file called name belongs to, name if it isn't one
+func sidecarImage(name string) string {
+	for _, suffix := range sidecarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// cloud-init and other config drive consumers look for a filesystem with this label
+	configDriveVolumeLabel = "config-2"
+	// directory of the metadata version every consumer reads
+	configDriveDir = "openstack/latest"
+)
+
+// configDriveSeed is the content of the files of an OpenStack config drive
+// files left empty are kept from the rest of the iso content, meta_data.json is generated if there is none
+type configDriveSeed struct {
+	UserData string `json:"userData"`
+	// JSON documents, checked to be valid before they are written
+	MetaData    string `json:"metaData"`
+	NetworkData string `json:"networkData"`
+	// added to the public_keys of meta_data.json, which cloud-init installs for the default user
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+func (s *configDriveSeed) volumeLabel() string {
+	return configDriveVolumeLabel
+}
+
+// loadConfigDriveSeed reads the config drive files at the given paths, any of which may be empty
+func loadConfigDriveSeed(userDataFile, metaDataFile, networkDataFile string) (*configDriveSeed, error) {
+	seed := &configDriveSeed{}
+	for _, f := range []struct {
+		path    string
+		content *string
+	}{
+		{userDataFile, &seed.UserData},
+		{metaDataFile, &seed.MetaData},
+		{networkDataFile, &seed.NetworkData},
+	} {
+		if f.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config drive file: %w", err)
+		}
+		*f.content = string(data)
+	}
+	return seed, nil
+}
+
+// write writes the files of the config drive into openstack/latest under workDir
+func (s *configDriveSeed) write(workDir string) error {
+	dir := filepath.Join(workDir, configDriveDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, f := range []struct {
+		name    string
+		content string
+		json    bool
+	}{
+		{"user_data", s.UserData, false},
+		{"meta_data.json", s.MetaData, true},
+		{"network_data.json", s.NetworkData, true},
+	} {
+		if f.content == "" {
+			continue
+		}
+		if f.json && !json.Valid([]byte(f.content)) {
+			return fmt.Errorf("config drive %s is not valid JSON", f.name)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.name), []byte(f.content), 0644); err != nil {
+			return err
+		}
+	}
+
+	metaData := filepath.Join(dir, "meta_data.json")
+	if _, err := os.Stat(metaData); os.IsNotExist(err) {
+		// consumers require meta_data.json and identify the instance by its uuid
+		generated, err := json.Marshal(map[string]string{"uuid": uuid.New().String()})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(metaData, generated, 0644); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(s.SSHAuthorizedKeys) > 0 {
+		return addConfigDrivePublicKeys(metaData, s.SSHAuthorizedKeys)
+	}
+	return nil
+}
+
+// addConfigDrivePublicKeys adds keys to the public_keys of the meta_data.json file at path, named key-0, key-1, and
+// so on skipping names already taken
+func addConfigDrivePublicKeys(path string, keys []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var metaData map[string]interface{}
+	if err := json.Unmarshal(data, &metaData); err != nil {
+		return fmt.Errorf("failed to parse config drive meta_data.json: %w", err)
+	}
+	if metaData == nil {
+		metaData = map[string]interface{}{}
+	}
+	publicKeys, ok := metaData["public_keys"].(map[string]interface{})
+	if !ok {
+		if metaData["public_keys"] != nil {
+			return fmt.Errorf("config drive meta_data.json public_keys must be an object to add SSH keys to")
+		}
+		publicKeys = map[string]interface{}{}
+	}
+	n := 0
+	for _, key := range keys {
+		for publicKeys[fmt.Sprintf("key-%d", n)] != nil {
+			n++
+		}
+		publicKeys[fmt.Sprintf("key-%d", n)] = key
+		n++
+	}
+	metaData["public_keys"] = publicKeys
+	data, err = json.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// consoleStopTimeout is how long ipmitool gets to close the SOL session before it is killed
+const consoleStopTimeout = 5 * time.Second
+
+// startConsoleCapture streams the serial console of the host behind target to a log file under DATA_DIR/console
+// using IPMI Serial-over-LAN, as redfish only advertises the serial console and doesn't carry it
+// the returned function ends the session and must be called once the boot is over
+func startConsoleCapture(ctx context.Context, log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, target bmcTarget) (func(), error) {
+	if err := checkSerialConsole(client, system); err != nil {
+		return nil, err
+	}
+	host, err := ipmiHost(log, target)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := bmcArtifactPath("console", target.address, "log")
+	if err != nil {
+		return nil, err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create console log: %w", err)
+	}
+
+	// a session left behind by an earlier run would make activate fail
+	_, _ = ipmitool(ctx, host, target, "sol", "deactivate")
+
+	// the session outlives ctx so it can still be closed cleanly by the returned function
+	cmd, err := ipmitoolCommand(context.Background(), host, target, "sol", "activate")
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to start console capture: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to start console capture: %w", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	log.Infof("capturing serial console to %s", path)
+
+	return func() {
+		// ~. is the ipmitool escape sequence that closes the session
+		_, _ = io.WriteString(stdin, "\n~.")
+		stdin.Close()
+		select {
+		case <-done:
+		case <-time.After(consoleStopTimeout):
+			_ = cmd.Process.Kill()
+			<-done
+			_, _ = ipmitool(context.Background(), host, target, "sol", "deactivate")
+		}
+		out.Close()
+		log.Infof("serial console saved to %s", path)
+	}, nil
+}
+
+// checkSerialConsole returns an error if a manager of system reports a serial console that can't be reached over IPMI
+// managers that don't describe their serial console are assumed to support SOL
+func checkSerialConsole(client common.Client, system *redfish.ComputerSystem) error {
+	for _, m := range system.ManagedBy {
+		manager, err := redfish.GetManager(client, m)
+		if err != nil {
+			return err
+		}
+		console := manager.SerialConsole
+		if len(console.ConnectTypesSupported) == 0 {
+			continue
+		}
+		if !console.ServiceEnabled {
+			return fmt.Errorf("serial console of manager %s is disabled", manager.ODataID)
+		}
+		for _, t := range console.ConnectTypesSupported {
+			if t == redfish.IPMISerialConnectTypesSupported {
+				return nil
+			}
+		}
+		return fmt.Errorf("serial console of manager %s doesn't support IPMI", manager.ODataID)
+	}
+	return nil
+}
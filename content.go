@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+const templateSuffix = ".tmpl"
+
+// isoContentSource returns the source the iso is built from, contentDir if it is set, which must then be a directory
+// setting both source and contentDir is an error
+func isoContentSource(source, contentDir string) (string, error) {
+	if contentDir == "" {
+		return source, nil
+	}
+	if source != "" {
+		return "", fmt.Errorf("only one of SOURCE and CONTENT_DIR may be set")
+	}
+	info, err := os.Stat(contentDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read CONTENT_DIR: %w", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("CONTENT_DIR %s is not a directory", contentDir)
+	}
+	return contentDir, nil
+}
+
+// copySource populates workDir from source which may be a directory, tarball, or zip archive, only from the directory
+// subPath of it if that is set
+// archives are extracted to a temporary directory under dataDir before being copied
+func copySource(source, subPath, dataDir, workDir string, vars map[string]string) error {
+	typ, err := detectSourceType(source)
+	if err != nil {
+		return err
+	}
+	if typ == sourceDir {
+		src, err := sourceSubDir(source, subPath)
+		if err != nil {
+			return err
+		}
+		return copyContent(source, src, workDir, vars)
+	}
+
+	extractDir, err := os.MkdirTemp(dataDir, "source")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(extractDir)
+
+	if err := extractArchive(source, typ, extractDir); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", source, err)
+	}
+	src, err := sourceSubDir(extractDir, subPath)
+	if err != nil {
+		return err
+	}
+	return copyContent(extractDir, src, workDir, vars)
+}
+
+// sourceSubDir returns the directory subPath of dir, dir itself if subPath is empty
+func sourceSubDir(dir, subPath string) (string, error) {
+	src, err := securePath(dir, strings.TrimPrefix(path.Clean("/"+subPath), "/"))
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("source path %s not found", subPath)
+	} else if err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("source path %s is not a directory", subPath)
+	}
+	return src, nil
+}
+
+// copyContent copies the tree at srcDir, which is under root, into workDir
+// files ending in templateSuffix are rendered as go templates using vars and written without the suffix
+// files already in workDir, such as those extracted from a base iso, are replaced
+// symlinks are resolved within root and replaced by the file they point to, those that don't point to a regular file,
+// such as links to directories or links left dangling, are left out
+func copyContent(root, srcDir, workDir string, vars map[string]string) error {
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(workDir, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		src := path
+		if info.Mode()&os.ModeSymlink != 0 {
+			src, info, err = resolveSymlink(root, path)
+			if err != nil {
+				return err
+			}
+			if info == nil || !info.Mode().IsRegular() {
+				return nil
+			}
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dest, info.Mode().Perm())
+		case !info.Mode().IsRegular():
+			return fmt.Errorf("unsupported file type for %s", path)
+		case strings.HasSuffix(path, templateSuffix):
+			return renderTemplate(src, strings.TrimSuffix(dest, templateSuffix), info.Mode().Perm(), vars)
+		default:
+			return copyFile(src, dest, info.Mode().Perm())
+		}
+	})
+}
+
+// maxSymlinks bounds the symlinks followed resolving a path, links in a loop point to nothing
+const maxSymlinks = 40
+
+// resolveSymlink returns the file the symlink at p under root points to, and its info, or nil info if it doesn't
+// point to anything, as it is dangling or part of a loop
+// every component is resolved within root with absolute targets taken from it, as if it were the filesystem root
+// as it is for an image, so no link leads outside root
+func resolveSymlink(root, p string) (string, os.FileInfo, error) {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "", nil, err
+	}
+	remaining := strings.Split(filepath.ToSlash(rel), "/")
+	resolved := ""
+	links := 0
+	for len(remaining) > 0 {
+		part := remaining[0]
+		remaining = remaining[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(next)))
+		if os.IsNotExist(err) {
+			return "", nil, nil
+		} else if err != nil {
+			return "", nil, err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			if len(remaining) > 0 && !info.IsDir() {
+				return "", nil, nil
+			}
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", nil, nil
+		}
+		target, err := os.Readlink(filepath.Join(root, filepath.FromSlash(next)))
+		if err != nil {
+			return "", nil, err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = ""
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	// no component of resolved is a symlink
+	resolvedPath := filepath.Join(root, filepath.FromSlash(resolved))
+	info, err := os.Lstat(resolvedPath)
+	return resolvedPath, info, err
+}
+
+// templateFuncs are available to templates in addition to the builtin functions
+var templateFuncs = template.FuncMap{
+	"env": templateEnv,
+}
+
+// templateEnv returns the environment variable name, which must be listed in TEMPLATE_ENV and set
+// anything else is an error so a template can't write secrets of the process, such as BMC_PASSWORD, into an iso
+// or silently render an empty value
+func templateEnv(name string) (string, error) {
+	for _, allowed := range Options.TemplateEnv {
+		if name != allowed {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("environment variable %s is not listed in TEMPLATE_ENV", name)
+}
+
+// isoTemplateVars returns the values templates are rendered with, builtins overridden by the YAML or JSON map in file,
+// if set, overridden by vars
+func isoTemplateVars(builtins map[string]string, file string, vars map[string]string) (map[string]string, error) {
+	merged := make(map[string]string, len(builtins)+len(vars))
+	for k, v := range builtins {
+		merged[k] = v
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template vars %s: %w", file, err)
+		}
+		var fileVars map[string]string
+		if err := yaml.UnmarshalStrict(data, &fileVars); err != nil {
+			return nil, fmt.Errorf("failed to parse template vars %s: %w", file, err)
+		}
+		for k, v := range fileVars {
+			merged[k] = v
+		}
+	}
+	for k, v := range vars {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// renderTemplate executes the template at src with vars and writes the result to dest
+// referencing a key missing from vars is an error rather than rendering an empty value
+func renderTemplate(src, dest string, perm os.FileMode, vars map[string]string) error {
+	tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Funcs(templateFuncs).ParseFiles(src)
+	if err != nil {
+		return fmt.Errorf("failed to parse template %s: %w", src, err)
+	}
+
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tmpl.Execute(f, vars); err != nil {
+		return fmt.Errorf("failed to render template %s: %w", src, err)
+	}
+	return nil
+}
+
+// copyFile copies the regular file at src to dest with the given permissions
+func copyFile(src, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplateEnv(t *testing.T) {
+	withOptions(t)
+	Options.TemplateEnv = []string{"SITE", "UNSET_SITE"}
+	t.Setenv("SITE", "lab")
+	t.Setenv("BMC_PASSWORD", "secret")
+	os.Unsetenv("UNSET_SITE")
+
+	for _, tc := range []struct {
+		name     string
+		template string
+		rendered string
+		err      string
+	}{
+		{name: "allowed", template: `site={{ env "SITE" }}`, rendered: "site=lab"},
+		{name: "not allowed", template: `{{ env "BMC_PASSWORD" }}`, err: "not listed in TEMPLATE_ENV"},
+		{name: "allowed but unset", template: `{{ env "UNSET_SITE" }}`, err: "UNSET_SITE is not set"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "config.tmpl")
+			if err := os.WriteFile(src, []byte(tc.template), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dest := filepath.Join(dir, "config")
+			err := renderTemplate(src, dest, 0644, map[string]string{})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				if data, _ := os.ReadFile(dest); strings.Contains(string(data), "secret") {
+					t.Fatalf("rendered %q despite the error", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.rendered {
+				t.Fatalf("rendered %q, expected %q", data, tc.rendered)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+const (
+	// isoModeCoreOS embeds an Ignition config into the CoreOS live iso in BASE_ISO
+	isoModeCoreOS = "coreos"
+	// file in live isos naming the file whose extent is the Ignition embed area
+	coreOSIgnInfoPath = "/coreos/igninfo.json"
+	// older live isos instead describe the embed area with a header at the end of the system area
+	coreOSHeaderOffset = 32768 - 24
+	coreOSHeaderMagic  = "coreiso+"
+	// name of the config inside the embedded archive, where Ignition looks for it in the initramfs
+	coreOSIgnitionName = "config.ign"
+)
+
+// embedIgnition copies the CoreOS live iso at baseISO to outPath with the Ignition config at ignitionFile embedded,
+// as coreos-installer iso ignition embed does, so the live system applies it on boot
+// sshKeys are added to the core user of the config, any config already embedded in baseISO is replaced
+func embedIgnition(baseISO, ignitionFile, outPath string, sshKeys []string) error {
+	config, err := os.ReadFile(ignitionFile)
+	if err != nil {
+		return fmt.Errorf("failed to read Ignition config: %w", err)
+	}
+	if !json.Valid(config) {
+		return fmt.Errorf("Ignition config %s is not valid JSON", ignitionFile)
+	}
+	if len(sshKeys) > 0 {
+		if config, err = addIgnitionSSHKeys(config, sshKeys); err != nil {
+			return err
+		}
+	}
+	offset, length, err := coreOSEmbedArea(baseISO)
+	if err != nil {
+		return err
+	}
+	archive, err := ignitionArchive(config)
+	if err != nil {
+		return err
+	}
+	if int64(len(archive)) > length {
+		return fmt.Errorf("compressed Ignition config is %d bytes, the embed area of %s only holds %d", len(archive), baseISO, length)
+	}
+
+	if err := copyFile(baseISO, outPath, 0644); err != nil {
+		return fmt.Errorf("failed to copy base iso %s: %w", baseISO, err)
+	}
+	f, err := os.OpenFile(outPath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the rest of the area is zeroed so nothing of a previous config is left after the archive
+	area := make([]byte, length)
+	copy(area, archive)
+	if _, err := f.WriteAt(area, offset); err != nil {
+		return fmt.Errorf("failed to embed Ignition config: %w", err)
+	}
+	return f.Close()
+}
+
+// coreOSEmbedArea returns the offset and length in the iso at isoPath of the area an Ignition config is embedded in
+func coreOSEmbedArea(isoPath string) (int64, int64, error) {
+	d, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open base iso %s: %w", isoPath, err)
+	}
+	defer d.File.Close()
+
+	d.LogicalBlocksize = 2048
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read filesystem of base iso %s: %w", isoPath, err)
+	}
+	info, err := fs.OpenFile(coreOSIgnInfoPath, os.O_RDONLY)
+	if err != nil {
+		return coreOSHeaderEmbedArea(d.File, isoPath)
+	}
+	var ignInfo struct {
+		File string `json:"file"`
+	}
+	if err := json.NewDecoder(info).Decode(&ignInfo); err != nil {
+		return 0, 0, fmt.Errorf("failed to decode %s in %s: %w", coreOSIgnInfoPath, isoPath, err)
+	}
+	if ignInfo.File == "" {
+		return 0, 0, fmt.Errorf("%s in %s names no embed file", coreOSIgnInfoPath, isoPath)
+	}
+
+	embed, err := fs.OpenFile(path.Join("/", ignInfo.File), os.O_RDONLY)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open Ignition embed file %s in %s: %w", ignInfo.File, isoPath, err)
+	}
+	file, ok := embed.(*iso9660.File)
+	if !ok {
+		return 0, 0, fmt.Errorf("unexpected file type for %s in %s", ignInfo.File, isoPath)
+	}
+	return int64(file.Location()) * d.LogicalBlocksize, file.Size(), nil
+}
+
+// coreOSHeaderEmbedArea reads the embed area from the header older live isos have in their system area
+func coreOSHeaderEmbedArea(r io.ReaderAt, isoPath string) (int64, int64, error) {
+	header := make([]byte, 24)
+	if _, err := r.ReadAt(header, coreOSHeaderOffset); err != nil {
+		return 0, 0, fmt.Errorf("failed to read system area of %s: %w", isoPath, err)
+	}
+	if string(header[:8]) != coreOSHeaderMagic {
+		return 0, 0, fmt.Errorf("%s is not a CoreOS live iso, it has neither %s nor an embed area header", isoPath, coreOSIgnInfoPath)
+	}
+	offset := binary.LittleEndian.Uint64(header[8:16])
+	length := binary.LittleEndian.Uint64(header[16:24])
+	if offset == 0 || length == 0 {
+		return 0, 0, fmt.Errorf("embed area header of %s is empty", isoPath)
+	}
+	return int64(offset), int64(length), nil
+}
+
+// ignitionArchive returns config packed as the gzip compressed newc cpio archive the live initramfs loads
+func ignitionArchive(config []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := writeCPIOEntry(gz, coreOSIgnitionName, 0100644, config); err != nil {
+		return nil, err
+	}
+	if err := writeCPIOEntry(gz, "TRAILER!!!", 0, nil); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeCPIOEntry writes a newc cpio entry for the file name with mode and data to w
+// the name and data are each padded to a multiple of 4 bytes as the format requires
+func writeCPIOEntry(w io.Writer, name string, mode uint32, data []byte) error {
+	nlink := 0
+	if mode != 0 {
+		nlink = 1
+	}
+	// magic, inode, mode, uid, gid, nlink, mtime, filesize, devmajor, devminor, rdevmajor, rdevminor, namesize, check
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		0, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	entry := append([]byte(header), name...)
+	entry = append(entry, 0)
+	entry = append(entry, make([]byte, cpioPadding(len(entry)))...)
+	entry = append(entry, data...)
+	entry = append(entry, make([]byte, cpioPadding(len(data)))...)
+	_, err := w.Write(entry)
+	return err
+}
+
+// cpioPadding returns the bytes needed to pad n to a multiple of 4
+func cpioPadding(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readIgnitionArchive returns the files of the gzip compressed newc cpio archive at the start of area
+func readIgnitionArchive(t *testing.T, area []byte) map[string]string {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(area))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the first gzip member is the archive, the zeroed rest of the area follows it
+	gz.Multistream(false)
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for len(data) > 0 {
+		if len(data) < 110 || string(data[:6]) != "070701" {
+			t.Fatalf("invalid cpio header %q", data[:6])
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(v)
+		}
+		size, nameSize := field(6), field(11)
+		name := string(data[110 : 110+nameSize-1])
+		start := 110 + nameSize + cpioPadding(110+nameSize)
+		if name == "TRAILER!!!" {
+			break
+		}
+		files[name] = string(data[start : start+size])
+		data = data[start+size+cpioPadding(size):]
+	}
+	return files
+}
+
+func TestEmbedIgnition(t *testing.T) {
+	const areaSize = 8192
+	config := `{"ignition": {"version": "3.3.0"}}`
+
+	// current live isos name the embed file in igninfo.json, older ones have a header in the system area
+	withIgnInfo := func(t *testing.T) string {
+		workDir := t.TempDir()
+		writeTree(t, workDir, map[string]string{
+			"coreos/igninfo.json": `{"file": "images/ignition.img"}`,
+			"images/ignition.img": strings.Repeat("x", areaSize),
+		})
+		isoPath := filepath.Join(t.TempDir(), "live.iso")
+		if err := create(isoPath, workDir, "live", bootImages{}, rockRidgeFormat); err != nil {
+			t.Fatal(err)
+		}
+		return isoPath
+	}
+	withHeader := func(t *testing.T) string {
+		workDir := t.TempDir()
+		writeTree(t, workDir, map[string]string{"config": "config-data"})
+		isoPath := filepath.Join(t.TempDir(), "live.iso")
+		if err := create(isoPath, workDir, "live", bootImages{}, rockRidgeFormat); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(isoPath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		header := []byte(coreOSHeaderMagic)
+		header = binary.LittleEndian.AppendUint64(header, 4096)
+		header = binary.LittleEndian.AppendUint64(header, areaSize)
+		if _, err := f.WriteAt(header, coreOSHeaderOffset); err != nil {
+			t.Fatal(err)
+		}
+		return isoPath
+	}
+
+	for name, base := range map[string]func(t *testing.T) string{"igninfo": withIgnInfo, "header": withHeader} {
+		t.Run(name, func(t *testing.T) {
+			baseISO := base(t)
+			ignitionFile := filepath.Join(t.TempDir(), "config.ign")
+			if err := os.WriteFile(ignitionFile, []byte(config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			outPath := filepath.Join(t.TempDir(), "out.iso")
+			if err := embedIgnition(baseISO, ignitionFile, outPath, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			offset, length, err := coreOSEmbedArea(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if length != areaSize {
+				t.Fatalf("embed area is %d bytes, expected %d", length, areaSize)
+			}
+			data, err := os.ReadFile(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := readIgnitionArchive(t, data[offset:offset+length])
+			if files[coreOSIgnitionName] != config {
+				t.Fatalf("embedded archive has %q as %s, expected %q", files[coreOSIgnitionName], coreOSIgnitionName, config)
+			}
+			// the base iso is left as it was
+			before, err := os.ReadFile(baseISO)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(before[:offset], data[:offset]) || !bytes.Equal(before[offset+length:], data[offset+length:]) {
+				t.Fatal("output differs from the base iso outside the embed area")
+			}
+		})
+	}
+}
+
+func TestEmbedIgnitionErrors(t *testing.T) {
+	workDir := t.TempDir()
+	writeTree(t, workDir, map[string]string{
+		"coreos/igninfo.json": `{"file": "images/ignition.img"}`,
+		"images/ignition.img": "tiny",
+	})
+	liveISO := filepath.Join(t.TempDir(), "live.iso")
+	if err := create(liveISO, workDir, "live", bootImages{}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+	plainDir := t.TempDir()
+	writeTree(t, plainDir, map[string]string{"config": "config-data"})
+	plainISO := filepath.Join(t.TempDir(), "plain.iso")
+	if err := create(plainISO, plainDir, "plain", bootImages{}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.ign")
+	invalid := filepath.Join(dir, "invalid.ign")
+	writeTree(t, dir, map[string]string{"valid.ign": `{"ignition": {"version": "3.3.0"}}`, "invalid.ign": "{"})
+
+	for _, tc := range []struct {
+		name     string
+		baseISO  string
+		ignition string
+		err      string
+	}{
+		{name: "invalid config", baseISO: liveISO, ignition: invalid, err: "not valid JSON"},
+		{name: "not a live iso", baseISO: plainISO, ignition: valid, err: "not a CoreOS live iso"},
+		{name: "embed area too small", baseISO: liveISO, ignition: valid, err: "only holds 4"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := embedIgnition(tc.baseISO, tc.ignition, filepath.Join(t.TempDir(), "out.iso"), nil)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
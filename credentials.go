@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// bmcCredentials are the user and password of a BMC, each given directly or as a file holding it
+// files are read again on every use so credentials rotated on disk, for example by a secrets sidecar,
+// are picked up by later BMC operations without a restart
+// they are only read when an operation connects, one already in progress keeps using the redfish session or IPMI
+// connection it opened with the old credentials until it is done
+type bmcCredentials struct {
+	user         string
+	password     string
+	userFile     string
+	passwordFile string
+}
+
+// check returns an error if a field is set both directly and from a file or a file can't be read
+// userName and passwordName are how the fields are referred to in the error
+func (c bmcCredentials) check(userName, passwordName string) error {
+	if _, err := secretValue(userName, c.user, c.userFile); err != nil {
+		return err
+	}
+	_, err := secretValue(passwordName, c.password, c.passwordFile)
+	return err
+}
+
+// get returns the user and password, reading those set from files
+func (c bmcCredentials) get() (string, string, error) {
+	user, err := secretValue("user", c.user, c.userFile)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := secretValue("password", c.password, c.passwordFile)
+	if err != nil {
+		return "", "", err
+	}
+	return user, password, nil
+}
+
+// withDefaults returns c with the user and password it doesn't set in any way taken from defaults
+func (c bmcCredentials) withDefaults(defaults bmcCredentials) bmcCredentials {
+	if c.user == "" && c.userFile == "" {
+		c.user, c.userFile = defaults.user, defaults.userFile
+	}
+	if c.password == "" && c.passwordFile == "" {
+		c.password, c.passwordFile = defaults.password, defaults.passwordFile
+	}
+	return c
+}
+
+// secretValue returns the contents of file if set, without the trailing newline most secret files end with,
+// otherwise value
+// setting both is an error so it's clear which one is used
+func secretValue(name, value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("%s is set both directly and from file %s", name, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s file: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBMCCredentialsRotation(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials := bmcCredentials{user: "admin", passwordFile: passwordFile}
+	if _, password, err := credentials.get(); err != nil || password != "old" {
+		t.Fatalf("got password %q, %v", password, err)
+	}
+	if err := os.WriteFile(passwordFile, []byte("new\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, password, err := credentials.get(); err != nil || password != "new" {
+		t.Fatalf("got password %q after rotating it, %v", password, err)
+	}
+
+	if err := (bmcCredentials{password: "direct", passwordFile: passwordFile}).check("BMC_USER", "BMC_PASSWORD"); err == nil {
+		t.Fatal("expected a password set both directly and from a file to be rejected")
+	}
+}
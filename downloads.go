@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// downloadTracker counts the downloads in progress for each served iso
+type downloadTracker struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{active: make(map[string]int)}
+}
+
+// handler counts requests to next as downloads of the iso named by the request path
+// next is expected to serve paths relative to the isos dir
+func (t *downloadTracker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		t.mu.Lock()
+		t.active[name]++
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			t.active[name]--
+			if t.active[name] == 0 {
+				delete(t.active, name)
+			}
+			t.mu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ifIdle calls fn while holding off new downloads if name has no downloads in progress
+// returns false without calling fn if name is being downloaded
+func (t *downloadTracker) ifIdle(name string, fn func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active[name] > 0 {
+		return false
+	}
+	fn()
+	return true
+}
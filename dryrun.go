@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dryRunBMC connects to target and logs the calls Options.BMCAction would make without making them
+// the iso URL is checked to be reachable from here when it is served over http
+func dryRunBMC(ctx context.Context, log *logrus.Entry, httpClient *http.Client, target bmcTarget, isoURL string) error {
+	if err := validateTransferProtocol(Options.VirtualMediaTransferProtocol); err != nil {
+		return err
+	}
+
+	client, system, disconnect, err := connectBMC(ctx, log, httpClient, target)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	if err := identifyBMC(log, client, system, Options.RequireVendor); err != nil {
+		return err
+	}
+	vms, err := testMediaDevices(client, system)
+	if err != nil {
+		return err
+	}
+	log.Infof("found %s virtual media %s", Options.MediaType, vms[0].ODataID)
+
+	if Options.BMCAction == bmcActionEject {
+		for _, vm := range vms {
+			if vm.Inserted {
+				log.Infof("dry run: would eject %s from %s", vm.Image, vm.ODataID)
+			}
+		}
+		return nil
+	}
+
+	if err := checkISOReachable(isoURL); err != nil {
+		return err
+	}
+	isoVM := vms[0]
+	if isoVM.Inserted && isoVM.Image == isoURL && !Options.ForceReinsert {
+		log.Infof("dry run: %s is already inserted in %s, would leave it", isoURL, isoVM.ODataID)
+	} else {
+		if isoVM.Inserted {
+			log.Infof("dry run: would eject %s from %s", isoVM.Image, isoVM.ODataID)
+		}
+		config := insertMediaConfig(isoURL, quirksFor(system))
+		if config.Password != "" {
+			config.Password = "REDACTED"
+		}
+		body, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		log.Infof("dry run: would insert into %s with %s", isoVM.ODataID, body)
+	}
+	if Options.BMCAction == bmcActionInsert {
+		return nil
+	}
+
+	log.Infof("dry run: would set %s to boot once from Cd", system.ODataID)
+	if Options.WaitMode == waitModeWait && Options.BMCEvents {
+		log.Infof("dry run: would subscribe to events from %s", system.ODataID)
+	}
+	log.Infof("dry run: would reset %s with %s, power is currently %s", system.ODataID, Options.BMCResetType, system.PowerState)
+	if Options.WaitMode == waitModeWait && Options.KeepMediaInserted {
+		log.Infof("dry run: would wait up to %s for the host to boot and leave %s inserted", Options.BMCBootWait, isoURL)
+	} else if Options.WaitMode == waitModeWait {
+		log.Infof("dry run: would wait up to %s for the host to boot then eject %s", Options.BMCBootWait, isoURL)
+	}
+	return nil
+}
+
+// checkISOReachable sends a HEAD request for isoURL if it is an http URL and returns an error unless it succeeds
+func checkISOReachable(isoURL string) error {
+	if !strings.HasPrefix(isoURL, "http://") && !strings.HasPrefix(isoURL, "https://") {
+		return nil
+	}
+	resp, err := http.Head(isoURL)
+	if err != nil {
+		return fmt.Errorf("iso %s is not reachable: %w", isoURL, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("iso %s is not reachable: %s", isoURL, resp.Status)
+	}
+	return nil
+}
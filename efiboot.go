@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// path inside the iso of the EFI system partition image built from an EFI boot dir
+	efiBootImagePath = "images/efiboot.img"
+	efiBootLabel     = "EFIBOOT"
+)
+
+// buildEFIBootImage packs dir of workDir into a FAT EFI system partition image written into workDir, the files of
+// dir keep their path so a dir of EFI holds the EFI/BOOT/BOOTX64.EFI firmware looks for
+// returns the path of the image inside the iso
+func buildEFIBootImage(workDir, dir string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+dir), "/")
+	src, err := securePath(workDir, name)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(src); os.IsNotExist(err) {
+		return "", fmt.Errorf("EFI boot dir %s not found in iso contents", dir)
+	} else if err != nil {
+		return "", fmt.Errorf("failed to stat EFI boot dir %s: %w", dir, err)
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("EFI boot dir %s is not a directory", dir)
+	}
+
+	size, err := fatImageSize(src)
+	if err != nil {
+		return "", fmt.Errorf("failed to read EFI boot dir %s: %w", dir, err)
+	}
+
+	imagePath, err := securePath(workDir, efiBootImagePath)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFATImage(imagePath, size, efiBootLabel, src, name); err != nil {
+		return "", fmt.Errorf("failed to build EFI boot image from %s: %w", dir, err)
+	}
+	return efiBootImagePath, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import "errors"
+
+// failure modes of the BMC and iso flows, returned errors wrap one of these along with the underlying cause
+// so callers can branch on them using errors.Is
+var (
+	ErrBMCConnect         = errors.New("failed to connect to BMC")
+	ErrUnsupportedVendor  = errors.New("unsupported BMC vendor")
+	ErrNoCDMedia          = errors.New("failed to find CD type virtual media")
+	ErrNoUSBMedia         = errors.New("failed to find USBStick type virtual media")
+	ErrInsertMedia        = errors.New("failed to insert media")
+	ErrInsertTimeout      = errors.New("timed out inserting media")
+	ErrInsertUnconfirmed  = errors.New("BMC accepted the insert but did not report the media inserted")
+	ErrEjectMedia         = errors.New("failed to eject media")
+	ErrSystemReset        = errors.New("failed to boot system")
+	ErrPowerUnstable      = errors.New("host did not stay powered on")
+	ErrOperationTimeout   = errors.New("BMC operation timed out")
+	ErrOperationCancelled = errors.New("BMC operation cancelled")
+	ErrBootNotConfirmed   = errors.New("host boot not confirmed")
+	ErrNoPhoneHome        = errors.New("host did not phone home")
+	ErrISOBuild           = errors.New("failed to create iso")
+)
+
+// flowError pairs a failure mode with the error that caused it
+// both are matched by errors.Is and errors.As
+type flowError struct {
+	kind error
+	err  error
+}
+
+// wrapError returns err annotated with the failure mode kind
+func wrapError(kind, err error) error {
+	return &flowError{kind: kind, err: err}
+}
+
+func (e *flowError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *flowError) Unwrap() error {
+	return e.err
+}
+
+func (e *flowError) Is(target error) bool {
+	return target == e.kind
+}
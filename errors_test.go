@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestWrapError(t *testing.T) {
+	cause := &json.SyntaxError{}
+	err := fmt.Errorf("context: %w", wrapError(ErrInsertMedia, cause))
+	if !errors.Is(err, ErrInsertMedia) {
+		t.Fatalf("%v is not %v", err, ErrInsertMedia)
+	}
+	if errors.Is(err, ErrEjectMedia) {
+		t.Fatalf("%v is %v", err, ErrEjectMedia)
+	}
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr != cause {
+		t.Fatalf("cause of %v is not kept", err)
+	}
+}
+
+// newTestMockBMC returns a mockBMC whose host is powered off and not set to boot from media
+func newTestMockBMC() *mockBMC {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &mockBMC{
+		log:       logger,
+		power:     "Off",
+		bootState: "None",
+		boot:      map[string]string{"BootSourceOverrideEnabled": "Disabled", "BootSourceOverrideTarget": "None"},
+		client:    http.DefaultClient,
+	}
+}
+
+// serveMockBMC serves a mockBMC, with the responses in overrides, keyed by method and path, replacing its own
+func serveMockBMC(t *testing.T, overrides map[string]http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	mock := newTestMockBMC()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if override, ok := overrides[r.Method+" "+r.URL.Path]; ok {
+			override(w, r)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestTestVirtualMediaErrors(t *testing.T) {
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "test.iso"), 'a', 64*1024)
+	isoServer := httptest.NewServer(http.FileServer(mergedDirs{isosDir}))
+	defer isoServer.Close()
+
+	noMedia := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"Members": []interface{}{}})
+	}
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	for _, tc := range []struct {
+		name      string
+		address   string
+		overrides map[string]http.HandlerFunc
+		isoURL    string
+		configure func()
+		err       error
+	}{
+		{
+			name:    "unreachable BMC",
+			address: closed.URL,
+			err:     ErrBMCConnect,
+		},
+		{
+			name:      "unsupported vendor",
+			configure: func() { Options.RequireVendor = []string{"acme"} },
+			err:       ErrUnsupportedVendor,
+		},
+		{
+			name:      "no CD",
+			overrides: map[string]http.HandlerFunc{"GET " + mockManagerURI + "/VirtualMedia": noMedia},
+			err:       ErrNoCDMedia,
+		},
+		{
+			name:      "no USB stick",
+			overrides: map[string]http.HandlerFunc{"GET " + mockManagerURI + "/VirtualMedia": noMedia},
+			configure: func() { Options.MediaType = mediaTypeUSBStick },
+			err:       ErrNoUSBMedia,
+		},
+		{
+			name:   "insert rejected",
+			isoURL: "/missing.iso",
+			err:    ErrInsertMedia,
+		},
+		{
+			name: "reset rejected",
+			overrides: map[string]http.HandlerFunc{"POST " + mockSystemURI + "/Actions/ComputerSystem.Reset": func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "reset not allowed", http.StatusBadRequest)
+			}},
+			err: ErrSystemReset,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withOptions(t)
+			Options.MediaType = mediaTypeCD
+			Options.WaitMode = waitModeNone
+			Options.BMCResetType = "On"
+			if tc.configure != nil {
+				tc.configure()
+			}
+			address := tc.address
+			if address == "" {
+				address = serveMockBMC(t, tc.overrides).URL + mockSystemURI
+			}
+			isoURL := "/test.iso"
+			if tc.isoURL != "" {
+				isoURL = tc.isoURL
+			}
+
+			err := testVirtualMedia(context.Background(), discardLog(), http.DefaultClient, bmcTarget{address: address}, isoServer.URL+isoURL, nil, nil)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// etagHandler sets an ETag on the requested file before calling next
+// http.FileServer uses it along with the file modification time to answer conditional requests with 304
+func etagHandler(fsys http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag, err := fileETag(fsys, path.Clean("/"+r.URL.Path)); err == nil && etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// fileETag returns the quoted ETag of name in fsys, or an empty string for directories
+// it is the sha256 in the sidecar checksum file of an image, which is written at build or upload so the image is
+// never hashed while a request waits, and is otherwise derived from the size and modification time of the file
+// a sidecar is only used while it has the modification time of the image, which it is given when written, so the
+// sidecar of an image being replaced is never taken for that of the other
+func fileETag(fsys http.FileSystem, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return "", err
+	}
+	if checksum, ok := sidecarChecksum(fsys, name, info.ModTime().UnixNano()); ok {
+		return fmt.Sprintf("%q", checksum), nil
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano()), nil
+}
+
+// sidecarChecksum returns the sha256 in the sidecar checksum file of name if it has the modification time modTime
+func sidecarChecksum(fsys http.FileSystem, name string, modTime int64) (string, bool) {
+	f, err := fsys.Open(checksumPath(name))
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.ModTime().UnixNano() != modTime {
+		return "", false
+	}
+	data, err := io.ReadAll(io.LimitReader(f, 1024))
+	if err != nil {
+		return "", false
+	}
+	if fields := strings.Fields(string(data)); len(fields) > 0 && len(fields[0]) == 64 {
+		return fields[0], true
+	}
+	return "", false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestETag(t *testing.T) {
+	dir := t.TempDir()
+	isoPath := filepath.Join(dir, "test.iso")
+	writeFakeISO(t, isoPath, 'a', 64*1024)
+	checksum, err := writeChecksumFile(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(etagHandler(http.Dir(dir), http.FileServer(http.Dir(dir))))
+	defer server.Close()
+
+	get := func(ifNoneMatch string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/test.iso", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	etag := get("").Header.Get("ETag")
+	if etag != `"`+checksum+`"` {
+		t.Fatalf("ETag is %s, expected the checksum %s", etag, checksum)
+	}
+	if resp := get(etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("request with the current ETag got %s, expected 304", resp.Status)
+	}
+
+	// replaced without its sidecar, as for a moment while an iso is replaced, the old checksum isn't used
+	writeFakeISO(t, isoPath, 'b', 64*1024)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(isoPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	replaced := get(etag)
+	if replaced.StatusCode != http.StatusOK {
+		t.Fatalf("request with the ETag of the replaced iso got %s, expected 200", replaced.Status)
+	}
+	if got := replaced.Header.Get("ETag"); got == "" || got == etag {
+		t.Fatalf("replaced iso has ETag %q", got)
+	}
+	if checksum, err = writeChecksumFile(isoPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("").Header.Get("ETag"); got != `"`+checksum+`"` {
+		t.Fatalf("replaced iso has ETag %s once its checksum is written, expected its checksum %s", got, checksum)
+	}
+}
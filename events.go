@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+)
+
+const (
+	redfishEventsPath = "/redfish-events/"
+	// how often the boot is still polled for while waiting on events, in case the BMC doesn't send the ones expected
+	eventFallbackInterval = time.Minute
+	// largest event body read
+	maxEventBody = 1 << 20
+)
+
+// subscriptionEventTypes are the event types subscribed to when the BMC requires a list, power and boot progress
+// changes are reported as one of these depending on the vendor
+var subscriptionEventTypes = map[string]bool{
+	"StatusChange":    true,
+	"ResourceUpdated": true,
+	"Alert":           true,
+}
+
+// redfishEvent is the part of a redfish Event record needed to tell what it is about
+type redfishEvent struct {
+	EventType         string `json:"EventType"`
+	MessageID         string `json:"MessageId"`
+	Message           string `json:"Message"`
+	Context           string `json:"Context"`
+	OriginOfCondition struct {
+		ODataID string `json:"@odata.id"`
+	} `json:"OriginOfCondition"`
+}
+
+// bootRelated returns true if e is about the system at systemURI or its power or boot
+func (e redfishEvent) bootRelated(systemURI string) bool {
+	origin := strings.TrimSuffix(e.OriginOfCondition.ODataID, "/")
+	if origin != "" && strings.HasPrefix(origin, strings.TrimSuffix(systemURI, "/")) {
+		return true
+	}
+	// registry prefix and version come first, e.g. ResourceEvent.1.0.ResourcePoweredOn
+	name := e.MessageID[strings.LastIndex(e.MessageID, ".")+1:]
+	return strings.Contains(name, "Power") || strings.Contains(name, "Boot")
+}
+
+// eventSubscription is an EventDestination created on a BMC for the system waiting on its events
+type eventSubscription struct {
+	// of the EventDestination on the BMC
+	uri       string
+	context   string
+	systemURI string
+	// signalled without blocking when a boot related event arrives
+	events chan struct{}
+}
+
+// redfishEvents receives events from BMCs subscribed to baseURL/redfish-events/token
+// each subscription gets its own context so events can be matched to the BMC target waiting on them
+type redfishEvents struct {
+	mu    sync.Mutex
+	token string
+	url   string
+	// subscriptions being waited on by context
+	subscriptions map[string]*eventSubscription
+}
+
+// newRedfishEvents returns a redfishEvents accepting events at baseURL/redfish-events/token
+func newRedfishEvents(baseURL, token string) (*redfishEvents, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("BASE_URL must be set to receive BMC events")
+	}
+	return &redfishEvents{
+		token:         token,
+		url:           strings.TrimSuffix(baseURL, "/") + redfishEventsPath + token,
+		subscriptions: make(map[string]*eventSubscription),
+	}, nil
+}
+
+// handler records events POSTed to the token path, the request path is expected to be relative to /redfish-events/
+// events for unknown subscriptions are accepted and dropped so the BMC doesn't retry them
+func (r *redfishEvents) handler(log *logrus.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(req.URL.Path, "/")), []byte(r.token)) != 1 {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body struct {
+			Context string         `json:"Context"`
+			Events  []redfishEvent `json:"Events"`
+		}
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxEventBody)).Decode(&body); err != nil {
+			http.Error(w, "invalid event", http.StatusBadRequest)
+			return
+		}
+		for _, e := range body.Events {
+			// older services only set the context on each event
+			if e.Context == "" {
+				e.Context = body.Context
+			}
+			log.Debugf("redfish event %s %s from %s for %q: %s", e.EventType, e.MessageID, req.RemoteAddr, e.OriginOfCondition.ODataID, e.Message)
+			r.deliver(e)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// deliver wakes the subscription e was sent for if it is boot related
+func (r *redfishEvents) deliver(e redfishEvent) {
+	r.mu.Lock()
+	sub, ok := r.subscriptions[e.Context]
+	r.mu.Unlock()
+	if !ok || !e.bootRelated(sub.systemURI) {
+		return
+	}
+	select {
+	case sub.events <- struct{}{}:
+	default:
+		// a wakeup is already pending
+	}
+}
+
+// subscribe creates an EventDestination on the BMC of client sending events for the system at systemURI here
+// subscriptions left behind by earlier runs, which send to the same BASE_URL, are deleted first
+func (r *redfishEvents) subscribe(ctx context.Context, log *logrus.Entry, client common.Client, systemURI string) (*eventSubscription, error) {
+	var root struct {
+		EventService common.Link `json:"EventService"`
+	}
+	if err := getJSON(client, common.DefaultServiceRoot, &root); err != nil {
+		return nil, err
+	}
+	if root.EventService == "" {
+		return nil, fmt.Errorf("BMC has no event service")
+	}
+	var service struct {
+		ServiceEnabled            *bool       `json:"ServiceEnabled"`
+		EventTypesForSubscription []string    `json:"EventTypesForSubscription"`
+		Subscriptions             common.Link `json:"Subscriptions"`
+	}
+	if err := getJSON(client, string(root.EventService), &service); err != nil {
+		return nil, err
+	}
+	if service.ServiceEnabled != nil && !*service.ServiceEnabled {
+		return nil, fmt.Errorf("event service is disabled")
+	}
+	if service.Subscriptions == "" {
+		return nil, fmt.Errorf("event service has no subscriptions collection")
+	}
+	r.deleteStale(ctx, log, client, string(service.Subscriptions))
+
+	sub := &eventSubscription{
+		context:   uuid.New().String(),
+		systemURI: systemURI,
+		events:    make(chan struct{}, 1),
+	}
+	request := struct {
+		Destination string   `json:"Destination"`
+		Protocol    string   `json:"Protocol"`
+		Context     string   `json:"Context"`
+		EventTypes  []string `json:"EventTypes,omitempty"`
+	}{
+		Destination: r.url,
+		Protocol:    "Redfish",
+		Context:     sub.context,
+	}
+	for _, eventType := range service.EventTypesForSubscription {
+		if subscriptionEventTypes[eventType] {
+			request.EventTypes = append(request.EventTypes, eventType)
+		}
+	}
+
+	// registered before creating so events sent straight away aren't dropped
+	r.mu.Lock()
+	r.subscriptions[sub.context] = sub
+	r.mu.Unlock()
+	err := retryBMCCall(ctx, log, "subscribe", func() error {
+		resp, err := client.Post(string(service.Subscriptions), request)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var created struct {
+			ODataID string `json:"@odata.id"`
+		}
+		// the body is optional, the Location header is enough
+		if err := json.NewDecoder(resp.Body).Decode(&created); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to decode subscription: %w", err)
+		}
+		sub.uri = resp.Header.Get("Location")
+		if sub.uri == "" {
+			sub.uri = created.ODataID
+		}
+		return nil
+	})
+	if err != nil {
+		r.remove(sub)
+		return nil, fmt.Errorf("failed to create event subscription: %w", err)
+	}
+	return sub, nil
+}
+
+// deleteStale deletes the subscriptions in the collection at collectionURI sending to this server under another token
+// failures are only logged, a stale subscription just sends events that get dropped
+func (r *redfishEvents) deleteStale(ctx context.Context, log *logrus.Entry, client common.Client, collectionURI string) {
+	var collection struct {
+		Members []common.Link `json:"Members"`
+	}
+	if err := getJSON(client, collectionURI, &collection); err != nil {
+		log.WithError(err).Warn("failed to list event subscriptions")
+		return
+	}
+	prefix := strings.TrimSuffix(r.url, r.token)
+	for _, member := range collection.Members {
+		var destination struct {
+			Destination string `json:"Destination"`
+		}
+		if err := getJSON(client, string(member), &destination); err != nil {
+			log.WithError(err).Warnf("failed to get event subscription %s", member)
+			continue
+		}
+		if !strings.HasPrefix(destination.Destination, prefix) || destination.Destination == r.url {
+			continue
+		}
+		log.Infof("deleting stale event subscription %s to %s", member, destination.Destination)
+		if err := deleteSubscription(ctx, log, client, string(member)); err != nil {
+			log.WithError(err).Warnf("failed to delete event subscription %s", member)
+		}
+	}
+}
+
+// unsubscribe stops waiting on sub and deletes it from the BMC of client
+func (r *redfishEvents) unsubscribe(ctx context.Context, log *logrus.Entry, client common.Client, sub *eventSubscription) error {
+	r.remove(sub)
+	if sub.uri == "" {
+		return fmt.Errorf("BMC did not return the location of event subscription %s", sub.context)
+	}
+	return deleteSubscription(ctx, log, client, sub.uri)
+}
+
+// remove stops delivering events to sub
+func (r *redfishEvents) remove(sub *eventSubscription) {
+	r.mu.Lock()
+	delete(r.subscriptions, sub.context)
+	r.mu.Unlock()
+}
+
+// deleteSubscription deletes the EventDestination at uri
+func deleteSubscription(ctx context.Context, log *logrus.Entry, client common.Client, uri string) error {
+	return retryBMCCall(ctx, log, "unsubscribe", func() error {
+		resp, err := client.Delete(uri)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	})
+}
+
+// waitForEvent blocks until events is signalled, d elapses, or ctx is done
+// a nil events only waits for d
+func waitForEvent(ctx context.Context, events <-chan struct{}, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-events:
+		return nil
+	case <-timer.C:
+		return nil
+	}
+}
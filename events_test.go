@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stmcginnis/gofish"
+)
+
+func TestRedfishEventsHandler(t *testing.T) {
+	events, err := newRedfishEvents("http://simple-iso.example.com/", "event-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &eventSubscription{context: "ctx-1", systemURI: "/redfish/v1/Systems/1", events: make(chan struct{}, 1)}
+	events.subscriptions[sub.context] = sub
+	handler := events.handler(discardLog().Logger)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		wakes  bool
+	}{
+		{name: "wrong token", method: http.MethodPost, path: "/other-token", body: `{}`, status: http.StatusNotFound},
+		{name: "not a post", method: http.MethodGet, path: "/event-token", status: http.StatusMethodNotAllowed},
+		{name: "invalid body", method: http.MethodPost, path: "/event-token", body: `{`, status: http.StatusBadRequest},
+		{name: "unrelated event", method: http.MethodPost, path: "/event-token", status: http.StatusNoContent,
+			body: `{"Events": [{"Context": "ctx-1", "MessageId": "Base.1.0.Success", "OriginOfCondition": {"@odata.id": "/redfish/v1/Managers/1"}}]}`},
+		{name: "unknown subscription", method: http.MethodPost, path: "/event-token", status: http.StatusNoContent,
+			body: `{"Events": [{"Context": "ctx-2", "MessageId": "ResourceEvent.1.0.ResourcePoweredOn"}]}`},
+		{name: "about the system", method: http.MethodPost, path: "/event-token", status: http.StatusNoContent, wakes: true,
+			body: `{"Events": [{"Context": "ctx-1", "OriginOfCondition": {"@odata.id": "/redfish/v1/Systems/1/"}}]}`},
+		// older services only set the context of the whole record
+		{name: "power message", method: http.MethodPost, path: "/event-token", status: http.StatusNoContent, wakes: true,
+			body: `{"Context": "ctx-1", "Events": [{"MessageId": "ResourceEvent.1.0.ResourcePoweredOn"}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+			if w.Code != tc.status {
+				t.Fatalf("got status %d, expected %d", w.Code, tc.status)
+			}
+			select {
+			case <-sub.events:
+				if !tc.wakes {
+					t.Fatal("subscription was woken")
+				}
+			default:
+				if tc.wakes {
+					t.Fatal("subscription was not woken")
+				}
+			}
+		})
+	}
+}
+
+// eventServiceBMC serves an event service whose subscriptions collection starts with subscriptions, keyed by uri
+// with their destinations, recording the subscriptions created and deleted
+type eventServiceBMC struct {
+	mu            sync.Mutex
+	subscriptions map[string]string
+	created       []map[string]interface{}
+	deleted       []string
+}
+
+func (b *eventServiceBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	const collection = "/redfish/v1/EventService/Subscriptions"
+	var resource interface{}
+	switch {
+	case r.Method == http.MethodGet && (r.URL.Path == "/redfish/v1/" || r.URL.Path == "/redfish/v1"):
+		resource = map[string]interface{}{"@odata.id": "/redfish/v1/", "EventService": map[string]string{"@odata.id": "/redfish/v1/EventService"}}
+	case r.Method == http.MethodGet && r.URL.Path == "/redfish/v1/EventService":
+		resource = map[string]interface{}{
+			"ServiceEnabled":            true,
+			"EventTypesForSubscription": []string{"StatusChange", "MetricReport", "Alert"},
+			"Subscriptions":             map[string]string{"@odata.id": collection},
+		}
+	case r.Method == http.MethodGet && r.URL.Path == collection:
+		var members []map[string]string
+		for uri := range b.subscriptions {
+			members = append(members, map[string]string{"@odata.id": uri})
+		}
+		resource = map[string]interface{}{"Members": members}
+	case r.Method == http.MethodGet && b.subscriptions[r.URL.Path] != "":
+		resource = map[string]string{"Destination": b.subscriptions[r.URL.Path]}
+	case r.Method == http.MethodPost && r.URL.Path == collection:
+		var request map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b.created = append(b.created, request)
+		uri := collection + "/created"
+		b.subscriptions[uri] = request["Destination"].(string)
+		w.Header().Set("Location", uri)
+		w.WriteHeader(http.StatusCreated)
+		return
+	case r.Method == http.MethodDelete && b.subscriptions[r.URL.Path] != "":
+		delete(b.subscriptions, r.URL.Path)
+		b.deleted = append(b.deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+func TestSubscribe(t *testing.T) {
+	events, err := newRedfishEvents("http://simple-iso.example.com", "event-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmc := &eventServiceBMC{subscriptions: map[string]string{
+		// left behind by an earlier run
+		"/redfish/v1/EventService/Subscriptions/stale": "http://simple-iso.example.com/redfish-events/old-token",
+		"/redfish/v1/EventService/Subscriptions/other": "http://monitoring.example.com/events",
+	}}
+	server := httptest.NewServer(bmc)
+	defer server.Close()
+	client, err := gofish.ConnectDefault(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub, err := events.subscribe(context.Background(), discardLog(), client, "/redfish/v1/Systems/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bmc.mu.Lock()
+	if len(bmc.created) != 1 {
+		t.Fatalf("expected 1 subscription to be created, got %d", len(bmc.created))
+	}
+	created := bmc.created[0]
+	if created["Destination"] != "http://simple-iso.example.com/redfish-events/event-token" || created["Context"] != sub.context {
+		t.Errorf("subscription was created with destination %v and context %v", created["Destination"], created["Context"])
+	}
+	if types, _ := json.Marshal(created["EventTypes"]); string(types) != `["StatusChange","Alert"]` {
+		t.Errorf("subscription was created for event types %s", types)
+	}
+	if strings.Join(bmc.deleted, ",") != "/redfish/v1/EventService/Subscriptions/stale" {
+		t.Errorf("expected only the stale subscription to be deleted, deleted %v", bmc.deleted)
+	}
+	bmc.mu.Unlock()
+
+	if err := events.unsubscribe(context.Background(), discardLog(), client, sub); err != nil {
+		t.Fatal(err)
+	}
+	bmc.mu.Lock()
+	defer bmc.mu.Unlock()
+	if _, ok := bmc.subscriptions[sub.uri]; ok || sub.uri == "" {
+		t.Errorf("subscription %q was not deleted", sub.uri)
+	}
+	if _, ok := events.subscriptions[sub.context]; ok {
+		t.Error("events are still delivered to the subscription")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isoExpiry records when each served iso should stop being available
+// the deadlines are saved to statePath, when set, so isos kept in the isos dir across a restart still expire
+type isoExpiry struct {
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	statePath string
+}
+
+// newISOExpiry returns an isoExpiry saving its deadlines to statePath and starting from those a previous run saved
+// there, an empty statePath keeps them in memory only
+func newISOExpiry(statePath string) (*isoExpiry, error) {
+	e := &isoExpiry{expires: make(map[string]time.Time), statePath: statePath}
+	if statePath == "" {
+		return e, nil
+	}
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read iso expiry state: %w", err)
+	}
+	if err := json.Unmarshal(data, &e.expires); err != nil {
+		return nil, fmt.Errorf("failed to decode iso expiry state %s: %w", statePath, err)
+	}
+	return e, nil
+}
+
+// track records that name expires ttl from now, a ttl of zero means the iso never expires
+func (e *isoExpiry) track(name string, ttl time.Duration) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ttl <= 0 {
+		if _, ok := e.expires[name]; !ok {
+			return nil
+		}
+		delete(e.expires, name)
+		return e.save()
+	}
+	e.expires[name] = time.Now().Add(ttl)
+	return e.save()
+}
+
+// save writes the deadlines to statePath, replacing it by a rename so it is never left half written
+// the caller must hold mu
+func (e *isoExpiry) save() error {
+	if e.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(e.expires)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(e.statePath), ".iso-expiry-")
+	if err != nil {
+		return fmt.Errorf("failed to save iso expiry state: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to save iso expiry state: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to save iso expiry state: %w", err)
+	}
+	if err := os.Rename(f.Name(), e.statePath); err != nil {
+		return fmt.Errorf("failed to save iso expiry state: %w", err)
+	}
+	return nil
+}
+
+// expired returns true if name has a recorded expiry in the past
+func (e *isoExpiry) expired(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	expiry, ok := e.expires[name]
+	return ok && time.Now().After(expiry)
+}
+
+// handler wraps next and responds with 410 Gone for expired isos and their checksum and signature files
+// next is expected to serve paths relative to the isos dir
+func (e *isoExpiry) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if e.expired(name) || e.expired(sidecarImage(name)) {
+			http.Error(w, "image has expired", http.StatusGone)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sweep removes expired isos from isosDir every interval, starting with those that expired while not running
+func (e *isoExpiry) sweep(log *logrus.Logger, isosDir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.remove(log, isosDir)
+		<-ticker.C
+	}
+}
+
+// remove deletes the expired isos from isosDir and forgets their deadlines
+func (e *isoExpiry) remove(log *logrus.Logger, isosDir string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	removed := false
+	for name, expiry := range e.expires {
+		if time.Now().Before(expiry) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(isosDir, name)); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).Errorf("failed to remove expired iso %s", name)
+			continue
+		}
+		if err := removeSidecarFiles(filepath.Join(isosDir, name)); err != nil {
+			log.WithError(err).Errorf("failed to remove the checksum or signature of expired iso %s", name)
+		}
+		log.Infof("removed expired iso %s", name)
+		delete(e.expires, name)
+		removed = true
+	}
+	if !removed {
+		return
+	}
+	if err := e.save(); err != nil {
+		log.WithError(err).Error("failed to save the expiry of the remaining isos")
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestISOExpiryOutlivesRestart(t *testing.T) {
+	dataDir, isosDir := t.TempDir(), t.TempDir()
+	statePath := filepath.Join(dataDir, expiryStateFile)
+	for _, name := range []string{"short.iso", "long.iso", "forever.iso"} {
+		if err := os.WriteFile(filepath.Join(isosDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expiry, err := newISOExpiry(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ttl := range map[string]time.Duration{"short.iso": 50 * time.Millisecond, "long.iso": time.Hour, "forever.iso": 0} {
+		if err := expiry.track(name, ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// a new run starts from the saved deadlines
+	restarted, err := newISOExpiry(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expired := range map[string]bool{"short.iso": true, "long.iso": false, "forever.iso": false} {
+		if restarted.expired(name) != expired {
+			t.Errorf("expected %s expired to be %t after a restart", name, expired)
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	restarted.remove(logger, isosDir)
+	if _, err := os.Stat(filepath.Join(isosDir, "short.iso")); !os.IsNotExist(err) {
+		t.Fatalf("expired iso was not removed: %v", err)
+	}
+	for _, name := range []string{"long.iso", "forever.iso"} {
+		if _, err := os.Stat(filepath.Join(isosDir, name)); err != nil {
+			t.Fatalf("%s was removed: %v", name, err)
+		}
+	}
+
+	// the removal is saved too, and an iso tracked without a ttl is forgotten
+	if err := restarted.track("long.iso", 0); err != nil {
+		t.Fatal(err)
+	}
+	again, err := newISOExpiry(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.expires) != 0 {
+		t.Fatalf("expected no saved deadlines, got %v", again.expires)
+	}
+}
+
+func TestISOExpiryInvalidState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), expiryStateFile)
+	if err := os.WriteFile(statePath, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newISOExpiry(statePath); err == nil {
+		t.Fatal("expected an error loading an invalid state file")
+	}
+}
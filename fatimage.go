@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+)
+
+const (
+	// FAT type is decided by cluster count alone, with diskfs's 512 byte clusters an image this size has the
+	// 65525 clusters firmware needs to read it as the FAT32 it is
+	minFATImageSize = 34 * 1024 * 1024
+	fatSectorSize   = 512
+	// longest FAT volume label
+	maxFATLabelLength = 11
+)
+
+// fatImageSize returns the size in bytes of a FAT32 image with room for the tree at src
+func fatImageSize(src string) (int64, error) {
+	// every file and directory takes at least a sector, a quarter more covers directory entries and the FATs
+	var size int64
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += (info.Size()/fatSectorSize + 1) * fatSectorSize
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	size += size / 4
+	if size < minFATImageSize {
+		size = minFATImageSize
+	}
+	return (size + fatSectorSize - 1) / fatSectorSize * fatSectorSize, nil
+}
+
+// writeFATImage creates a FAT32 image of size bytes labelled label at imagePath holding the tree at src under dir
+func writeFATImage(imagePath string, size int64, label, src, dir string) error {
+	f, err := os.OpenFile(imagePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	fat, err := fat32.Create(f, size, 0, fatSectorSize, label)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		dest := path.Join("/", dir, filepath.ToSlash(rel))
+		if d.IsDir() {
+			return fat.Mkdir(dest)
+		}
+		if !d.Type().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", dest)
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := fat.OpenFile(dest, os.O_RDWR|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fatLabel returns label as a FAT volume label, upper case and cut to the 11 characters FAT allows
+func fatLabel(label string) string {
+	label = strings.ToUpper(label)
+	if len(label) > maxFATLabelLength {
+		label = label[:maxFATLabelLength]
+	}
+	return label
+}
+
+// fatHeaderSize is the number of bytes from the start of a FAT image needed by checkFATHeader
+const fatHeaderSize = fatSectorSize
+
+// checkFATHeader returns an error if r doesn't start with a FAT boot sector
+func checkFATHeader(r io.ReaderAt) error {
+	header := make([]byte, fatHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("file is too small to be a FAT image")
+		}
+		return err
+	}
+	if header[510] != 0x55 || header[511] != 0xaa {
+		return fmt.Errorf("missing boot sector signature")
+	}
+	// the file system type is at 82 for FAT32 and at 54 for FAT12 and FAT16
+	if !strings.HasPrefix(string(header[82:]), "FAT") && !strings.HasPrefix(string(header[54:]), "FAT") {
+		return fmt.Errorf("missing FAT file system type")
+	}
+	return nil
+}
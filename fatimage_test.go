@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+)
+
+func TestWriteFATImage(t *testing.T) {
+	src := t.TempDir()
+	// larger than a cluster so file contents span several
+	large := strings.Repeat("0123456789abcdef", 4096)
+	files := map[string]string{
+		"BOOT/BOOTX64.EFI": large,
+		"BOOT/grub.cfg":    "set timeout=1",
+		"empty":            "",
+	}
+	writeTree(t, src, files)
+	size, err := fatImageSize(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < minFATImageSize || size%fatSectorSize != 0 {
+		t.Fatalf("image size %d is not a whole number of sectors of at least %d", size, minFATImageSize)
+	}
+
+	imagePath := filepath.Join(t.TempDir(), "efiboot.img")
+	if err := writeFATImage(imagePath, size, fatLabel("efiboot-volume"), src, "EFI"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := checkFATHeader(f); err != nil {
+		t.Fatal(err)
+	}
+	fat, err := fat32.Read(f, size, 0, fatSectorSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if label := strings.TrimSpace(fat.Label()); label != "EFIBOOT-VOL" {
+		t.Errorf("image has label %q, expected EFIBOOT-VOL", label)
+	}
+	for name, content := range files {
+		file, err := fat.OpenFile("/EFI/"+name, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(data) != content {
+			t.Errorf("%s has %d bytes, expected %d", name, len(data), len(content))
+		}
+	}
+}
+
+func TestCheckFATHeader(t *testing.T) {
+	if err := checkFATHeader(bytes.NewReader(make([]byte, 100))); err == nil || !strings.Contains(err.Error(), "too small") {
+		t.Errorf("expected a short file to be rejected as too small, got %v", err)
+	}
+	if err := checkFATHeader(bytes.NewReader(make([]byte, fatHeaderSize))); err == nil {
+		t.Error("expected a header without a boot sector signature to be rejected")
+	}
+}
@@ -4,16 +4,18 @@ go 1.19
 
 require (
 	github.com/diskfs/go-diskfs v1.3.0
+	github.com/google/uuid v1.1.1
 	github.com/kelseyhightower/envconfig v1.4.0
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stmcginnis/gofish v0.14.0
+	sigs.k8s.io/yaml v1.3.0
 )
 
 require (
-	github.com/google/uuid v1.1.1 // indirect
 	github.com/pierrec/lz4 v2.3.0+incompatible // indirect
 	github.com/pkg/xattr v0.4.1 // indirect
 	github.com/ulikunitz/xz v0.5.10 // indirect
 	golang.org/x/sys v0.0.0-20210616094352-59db8d763f22 // indirect
 	gopkg.in/djherbis/times.v1 v1.2.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
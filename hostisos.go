@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hostISOName returns the name of the own iso of the host at position i of the BMC config, after its hostname if set
+func hostISOName(i int, hostname string) string {
+	if hostname == "" {
+		hostname = strconv.Itoa(i)
+	}
+	return strings.TrimSuffix(testISOName, ".iso") + "-" + hostname + ".iso"
+}
+
+// hostISODefinitions returns an iso for each of targets, built like test but rendered with its template vars
+// overridden by the BMCAddress and Hostname of the host and its own template vars
+// the network config of a host is embedded into its iso, and its path inside the iso is the NetworkConfig template var
+// the isoURL of each target is set to the URL of its iso under baseURL, names already in taken are an error
+func hostISODefinitions(targets []bmcTarget, test isoDefinition, baseURL string, taken []isoDefinition) ([]isoDefinition, error) {
+	names := map[string]bool{testISOName: true, testUSBImageName: true}
+	for _, def := range taken {
+		names[def.name] = true
+	}
+	definitions := make([]isoDefinition, 0, len(targets))
+	for i := range targets {
+		target := &targets[i]
+		name := hostISOName(i, target.hostname)
+		if err := validISOName(name); err != nil {
+			return nil, fmt.Errorf("BMC %s: %w", target.address, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("BMC %s: iso name %s is already in use", target.address, name)
+		}
+		names[name] = true
+
+		merged := make(map[string]string, len(test.templateVars)+len(target.templateVars)+2)
+		for k, v := range test.templateVars {
+			merged[k] = v
+		}
+		merged["BMCAddress"] = target.address
+		if target.hostname != "" {
+			merged["Hostname"] = target.hostname
+		}
+		if target.networkConfig != "" {
+			isoPath, err := networkConfigISOPath(target.networkConfig)
+			if err != nil {
+				return nil, fmt.Errorf("BMC %s: %w", target.address, err)
+			}
+			merged["NetworkConfig"] = isoPath
+		}
+		for k, v := range target.templateVars {
+			merged[k] = v
+		}
+
+		isoURL, err := url.JoinPath(baseURL, "images", name)
+		if err != nil {
+			return nil, err
+		}
+		target.isoURL = isoURL
+		def := test
+		def.name, def.templateVars, def.networkConfig = name, merged, target.networkConfig
+		definitions = append(definitions, def)
+	}
+	return definitions, nil
+}
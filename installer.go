@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// installerConfig describes the trigger file an automated installer looks for in the iso
+type installerConfig struct {
+	// path of the file relative to the iso root
+	path     string
+	required []string
+	template string
+}
+
+var installerConfigs = map[string]installerConfig{
+	"kickstart": {
+		path:     "ks.cfg",
+		required: []string{"url", "rootpw"},
+		template: `text
+url --url={{ index . "url" }}
+rootpw --iscrypted {{ index . "rootpw" }}
+{{- with index . "timezone" }}
+timezone {{ . }} --utc
+{{- end }}
+{{- range lines (index . "sshkey") }}
+sshkey --username=root "{{ . }}"
+{{- end }}
+zerombr
+clearpart --all --initlabel
+autopart
+reboot
+`,
+	},
+	"coreos-installer": {
+		path:     "coreos-installer/config.yaml",
+		required: []string{"dest-device", "ignition-url"},
+		template: `dest-device: {{ index . "dest-device" }}
+ignition-url: {{ index . "ignition-url" }}
+{{- with index . "ignition-hash" }}
+ignition-hash: {{ . }}
+{{- end }}
+{{- with index . "image-url" }}
+image-url: {{ . }}
+{{- end }}
+`,
+	},
+}
+
+// installerTemplateFuncs are available to installer templates, lines splits a parameter holding several values
+var installerTemplateFuncs = template.FuncMap{
+	"lines": splitLines,
+}
+
+// splitLines returns the non-empty lines of s
+func splitLines(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == '\n' })
+}
+
+// installerParams is decoded from comma separated key:value pairs split on the first colon
+// so values may contain URLs
+type installerParams map[string]string
+
+func (p *installerParams) Decode(value string) error {
+	params := installerParams{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid installer parameter %q, must be key:value", pair)
+		}
+		params[kv[0]] = kv[1]
+	}
+	*p = params
+	return nil
+}
+
+// writeInstallerConfig renders the trigger file for installerType with params into workDir at its conventional path
+// sshKeys are authorized for root alongside the sshkey parameter by installers that support it
+func writeInstallerConfig(workDir, installerType string, params map[string]string, sshKeys []string) error {
+	config, ok := installerConfigs[installerType]
+	if !ok {
+		types := make([]string, 0, len(installerConfigs))
+		for t := range installerConfigs {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return fmt.Errorf("unsupported installer type %q, must be one of %s", installerType, strings.Join(types, ", "))
+	}
+
+	var missing []string
+	for _, key := range config.required {
+		if params[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("installer type %s requires parameters: %s", installerType, strings.Join(missing, ", "))
+	}
+
+	if len(sshKeys) > 0 {
+		merged := make(map[string]string, len(params)+1)
+		for k, v := range params {
+			merged[k] = v
+		}
+		merged["sshkey"] = strings.Join(append(splitLines(params["sshkey"]), sshKeys...), "\n")
+		params = merged
+	}
+
+	tmpl, err := template.New(installerType).Funcs(installerTemplateFuncs).Parse(config.template)
+	if err != nil {
+		return err
+	}
+	dest := filepath.Join(workDir, filepath.FromSlash(config.path))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := tmpl.Execute(f, params); err != nil {
+		return err
+	}
+	return f.Close()
+}
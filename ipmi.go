@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ipmiBootFromCD sets the host behind target to boot once from CD and power cycles it over IPMI using ipmitool
+// IPMI has no standard way to attach media so the iso must already be attached to the BMC, for example
+// through MEDIA_URL_OVERRIDE on a share the BMC mounts or the BMC's own interface
+func ipmiBootFromCD(ctx context.Context, log *logrus.Entry, target bmcTarget) error {
+	host, err := ipmiHost(log, target)
+	if err != nil {
+		return err
+	}
+
+	_, err = ipmitool(ctx, host, target, "chassis", "bootdev", "cdrom")
+	audit.record(auditRecord{BMC: target.address, Action: auditBootOverride, Resource: "ipmi chassis bootdev", BootOverride: "cdrom"}, err)
+	if err != nil {
+		return wrapError(ErrSystemReset, err)
+	}
+	status, err := ipmitool(ctx, host, target, "chassis", "power", "status")
+	if err != nil {
+		return wrapError(ErrSystemReset, err)
+	}
+	action := "cycle"
+	if strings.Contains(status, "off") {
+		action = "on"
+	}
+	_, err = ipmitool(ctx, host, target, "chassis", "power", action)
+	audit.record(auditRecord{BMC: target.address, Action: auditReset, Resource: "ipmi chassis power", ResetType: action}, err)
+	if err != nil {
+		return wrapError(ErrSystemReset, err)
+	}
+	log.Infof("set boot device to cdrom and powered %s the host over IPMI", action)
+	return nil
+}
+
+// ipmiHost returns the host of the BMC address of target
+func ipmiHost(log *logrus.Entry, target bmcTarget) (string, error) {
+	bmcURL, err := url.Parse(target.address)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse BMC Address %s: %w", target.address, err)
+	}
+	host := bmcURL.Hostname()
+	if bmcURL.Port() != "" && bmcURL.Port() != "443" && bmcURL.Port() != "80" {
+		log.Warnf("ignoring port %s of the BMC address, IPMI uses %s", bmcURL.Port(), net.JoinHostPort(host, "623"))
+	}
+	return host, nil
+}
+
+// ipmitoolCommand returns an ipmitool command against host with the credentials of target
+// the password is passed through the environment rather than the command line
+func ipmitoolCommand(ctx context.Context, host string, target bmcTarget, args ...string) (*exec.Cmd, error) {
+	user, password, err := target.credentials.get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get credentials for %s: %w", target.address, err)
+	}
+	cmd := exec.CommandContext(ctx, "ipmitool", append([]string{"-I", "lanplus", "-H", host, "-U", user, "-E"}, args...)...)
+	cmd.Env = append(os.Environ(), "IPMI_PASSWORD="+password)
+	return cmd, nil
+}
+
+// ipmitool runs ipmitool against host with the credentials of target and returns its output
+func ipmitool(ctx context.Context, host string, target bmcTarget, args ...string) (string, error) {
+	cmd, err := ipmitoolCommand(ctx, host, target, args...)
+	if err != nil {
+		return "", err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", fmt.Errorf("ipmitool %s failed: %w", strings.Join(args, " "), err)
+	}
+	return strings.ToLower(string(out)), nil
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/disk"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/sirupsen/logrus"
+)
+
+// createMu serializes iso creation as diskfs changes the process working directory while finalizing, paths used
+// by the rest of the process meanwhile must be absolute, see absOptionPaths
+var createMu sync.Mutex
+
+// testISOBuilder (re)builds the test iso from its configured source
+type testISOBuilder struct {
+	mu      sync.Mutex
+	log     *logrus.Logger
+	dataDir string
+	source  string
+	// hex sha256 a remote source must have, unchecked when empty
+	sourceSHA256 string
+	// directory of the source packaged into the iso, all of it when empty
+	sourcePath string
+	// credentials for the registry of an OCI image source
+	registryUser     string
+	registryPassword string
+	// namespace of the ConfigMaps and Secrets of kube sources, the pod's namespace when empty
+	kubeNamespace string
+	baseISO       string
+	templateVars  map[string]string
+	// template vars read from Vault on every build, overriding the others, when set
+	vault *vaultClient
+	// signs the built isos when set
+	signer *isoSigner
+	// path inside the iso for the content manifest, empty to omit it
+	manifestPath   string
+	manifestFormat string
+	isoPath        string
+	// FAT image of the iso contents for USB stick virtual media, built alongside the iso when set
+	usbImagePath string
+	ttl          time.Duration
+	expiry       *isoExpiry
+	boot         bootImages
+	format       isoFormat
+	// installer to write an automated install trigger file for, empty to write none
+	installerType   string
+	installerParams installerParams
+	// appended to the kernel command lines of the bootloader configs when set
+	kernelArgs []string
+	// SSH public keys written to the authorized_keys file of the iso and into the seed, installer, or Ignition
+	// config when set
+	sshKeys []string
+	// writes the phone home script into the iso when set
+	phoneHome   *phoneHome
+	volumeLabel string
+	// written into the iso when set
+	seed isoSeed
+	// Ignition config embedded into baseISO, a CoreOS live iso, instead of building the iso when set
+	ignitionFile string
+	// further isos built with the same settings from their own source next to the test iso
+	isos []isoDefinition
+	// names of the isos committed by the last build
+	served []string
+	// resource version of the objects of kube sources the last build read
+	kubeVersions map[kubeObject]string
+}
+
+// build creates the test iso and the configured isos, records their expiry, and returns the test iso's sha256 checksum
+// isos are built in a staging dir and only replace the served ones once all of them are built and verified
+func (b *testISOBuilder) build() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	staging, err := newISOStaging(filepath.Dir(b.isoPath), b.signer)
+	if err != nil {
+		return "", err
+	}
+	defer staging.discard()
+
+	var usbPath string
+	if b.usbImagePath != "" {
+		usbPath = staging.path(filepath.Base(b.usbImagePath))
+	}
+	test := isoDefinition{
+		name:         filepath.Base(b.isoPath),
+		label:        b.volumeLabel,
+		source:       b.source,
+		sourceSHA256: b.sourceSHA256,
+		sourcePath:   b.sourcePath,
+		templateVars: b.templateVars,
+	}
+	var secrets map[string]string
+	if b.vault != nil {
+		if secrets, err = b.vault.templateVars(); err != nil {
+			return "", err
+		}
+	}
+	test.templateVars = withSecrets(test.templateVars, secrets)
+	sources := &remoteSources{
+		dataDir:          b.dataDir,
+		registryUser:     b.registryUser,
+		registryPassword: b.registryPassword,
+		kubeNamespace:    b.kubeNamespace,
+	}
+	defer sources.remove()
+	if err := b.createTestISO(test, sources, staging.path(test.name), usbPath); err != nil {
+		return "", err
+	}
+	for _, def := range b.isos {
+		def.templateVars = withSecrets(def.templateVars, secrets)
+		if err := b.createTestISO(def, sources, staging.path(def.name), ""); err != nil {
+			return "", fmt.Errorf("failed to build iso %s: %w", def.name, err)
+		}
+	}
+	if err := staging.commit(b.served); err != nil {
+		return "", err
+	}
+	b.served = staging.names
+	b.kubeVersions = sources.kubeVersions
+	b.log.Infof("Test iso created at %s", b.isoPath)
+	for _, def := range b.isos {
+		b.log.Infof("Iso %s created with label %q", def.name, def.label)
+		if err := b.expiry.track(def.name, b.ttl); err != nil {
+			return "", err
+		}
+	}
+
+	if err := b.expiry.track(filepath.Base(b.isoPath), b.ttl); err != nil {
+		return "", err
+	}
+	if b.usbImagePath != "" {
+		b.log.Infof("Test USB image created at %s", b.usbImagePath)
+		if err := b.expiry.track(filepath.Base(b.usbImagePath), b.ttl); err != nil {
+			return "", err
+		}
+	}
+	return imageChecksum(b.isoPath)
+}
+
+// createTestISO builds the iso of def at outPath, and a FAT image of the same contents at usbPath if it is set
+// with an Ignition config baseISO is copied with the config embedded instead
+func (b *testISOBuilder) createTestISO(def isoDefinition, sources *remoteSources, outPath, usbPath string) error {
+	if b.ignitionFile != "" {
+		return embedIgnition(b.baseISO, b.ignitionFile, outPath, b.sshKeys)
+	}
+
+	isoWorkDir, err := os.MkdirTemp(b.dataDir, "test-config")
+	if err != nil {
+		return fmt.Errorf("failed to create iso work dir: %w", err)
+	}
+	// finalizing removes the work dir, this only cleans up after failures
+	defer os.RemoveAll(isoWorkDir)
+
+	// the source and generated files go on top of the contents of the base iso
+	if b.baseISO != "" {
+		if err := extractISO(b.baseISO, isoWorkDir); err != nil {
+			return err
+		}
+	}
+	source, err := sources.local(def.source, def.sourceSHA256)
+	if err != nil {
+		return err
+	}
+	if source != "" {
+		err = copySource(source, def.sourcePath, b.dataDir, isoWorkDir, def.templateVars)
+	} else if b.seed == nil {
+		err = createInputData(isoWorkDir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write input data: %w", err)
+	}
+	if b.seed != nil {
+		if err := b.seed.write(isoWorkDir); err != nil {
+			return fmt.Errorf("failed to write %s seed: %w", b.seed.volumeLabel(), err)
+		}
+	}
+	if def.networkConfig != "" {
+		if err := writeNetworkConfig(isoWorkDir, def.networkConfig); err != nil {
+			return fmt.Errorf("failed to write network config: %w", err)
+		}
+	}
+	if len(b.sshKeys) > 0 {
+		if err := writeSSHAuthorizedKeys(isoWorkDir, b.sshKeys); err != nil {
+			return fmt.Errorf("failed to write SSH authorized keys: %w", err)
+		}
+	}
+	if b.phoneHome != nil {
+		if err := b.phoneHome.writeFiles(isoWorkDir); err != nil {
+			return fmt.Errorf("failed to write phone home script: %w", err)
+		}
+	}
+	if b.installerType != "" {
+		if err := writeInstallerConfig(isoWorkDir, b.installerType, b.installerParams, b.sshKeys); err != nil {
+			return fmt.Errorf("failed to write installer config: %w", err)
+		}
+	}
+	if len(b.kernelArgs) > 0 {
+		if err := appendKernelArgs(isoWorkDir, b.kernelArgs); err != nil {
+			return err
+		}
+	}
+	if b.manifestPath != "" {
+		if err := writeISOManifest(isoWorkDir, b.manifestPath, b.manifestFormat, def.label); err != nil {
+			return fmt.Errorf("failed to write iso manifest: %w", err)
+		}
+	}
+	// before the iso as finalizing it removes the work dir
+	if usbPath != "" {
+		if err := createUSBImage(usbPath, isoWorkDir, def.label); err != nil {
+			return err
+		}
+	}
+	if err := create(outPath, isoWorkDir, def.label, b.boot, b.format); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createInputData writes a test file in dir to be packaged into an iso that has neither a source nor a seed
+// in the future more meaningful data should be included here
+func createInputData(dir string) error {
+	return os.WriteFile(filepath.Join(dir, "config"), []byte("config-data"), 0644)
+}
+
+// create builds an iso file at outPath with the given volumeLabel using the contents of the working directory
+// The iso is written to a temporary path next to outPath and renamed into place once finalized
+// so a partially written image is never visible at outPath, even if one already exists there
+// the iso is made bootable with any images set in boot and written as format says, and is read back to check that
+// it holds the contents of workDir before it is renamed into place, errors wrap ErrISOBuild
+func create(outPath string, workDir string, volumeLabel string, boot bootImages, format isoFormat) error {
+	if err := createISO(outPath, workDir, volumeLabel, boot, format); err != nil {
+		return wrapError(ErrISOBuild, err)
+	}
+	return nil
+}
+
+func createISO(outPath string, workDir string, volumeLabel string, boot bootImages, format isoFormat) error {
+	if err := validateISOContent(workDir, format); err != nil {
+		return err
+	}
+
+	createMu.Lock()
+	defer createMu.Unlock()
+
+	// diskfs refuses to create over an existing file, so build in a fresh
+	// directory on the same filesystem to keep the final rename atomic
+	tmpDir, err := os.MkdirTemp(filepath.Dir(outPath), fmt.Sprintf(".%s-", filepath.Base(outPath)))
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir for iso: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(outPath))
+	// before reading the tree for Joliet as it may add a generated EFI boot image to workDir
+	elTorito, err := boot.elTorito(workDir)
+	if err != nil {
+		return err
+	}
+	// the work dir is emptied once the iso is finalized
+	var efiImage os.FileInfo
+	if bootFile := efiBootFile(elTorito); bootFile != "" {
+		if efiImage, err = os.Stat(filepath.Join(workDir, filepath.FromSlash(bootFile))); err != nil {
+			return err
+		}
+	}
+	var jolietRoot *jolietEntry
+	if format.joliet {
+		if jolietRoot, err = jolietTree(workDir); err != nil {
+			return fmt.Errorf("failed to read iso contents for Joliet: %w", err)
+		}
+	}
+	var biosImage string
+	if boot.bios != "" {
+		biosImage = path.Clean("/" + boot.bios)
+	}
+	content, err := isoContentSnapshot(workDir, biosImage)
+	if err != nil {
+		return fmt.Errorf("failed to read iso contents: %w", err)
+	}
+	if err := finalizeISO(tmpPath, workDir, volumeLabel, elTorito, format); err != nil {
+		return err
+	}
+	if format.joliet {
+		if err := addJoliet(tmpPath, jolietRoot, volumeLabel, format.rockRidge); err != nil {
+			return fmt.Errorf("failed to add Joliet extensions: %w", err)
+		}
+	}
+	if efiImage != nil {
+		if err := writeHybridMBR(tmpPath, efiImage.Size()); err != nil {
+			return fmt.Errorf("failed to write partition table for USB boot: %w", err)
+		}
+	}
+	if err := verifyISOContent(tmpPath, content, format.rockRidge); err != nil {
+		return fmt.Errorf("iso verification failed: %w", err)
+	}
+
+	return os.Rename(tmpPath, outPath)
+}
+
+// finalizeISO writes a complete iso to isoPath which must not already exist, bootable if elTorito is set
+func finalizeISO(isoPath string, workDir string, volumeLabel string, elTorito *iso9660.ElTorito, format isoFormat) error {
+	// Use the minimum iso size that will satisfy diskfs validations here.
+	// This value doesn't determine the final image size, but is used
+	// to truncate the initial file. This value would be relevant if
+	// we were writing to a particular partition on a device, but we are
+	// not so the minimum iso size will work for us here
+	minISOSize := 38 * 1024
+	d, err := diskfs.Create(isoPath, int64(minISOSize), diskfs.Raw, format.sectorSize)
+	if err != nil {
+		return err
+	}
+	defer d.File.Close()
+
+	// sectorSize only sets the sector size diskfs uses for the image file,
+	// the iso9660 logical block size stays 2048 regardless
+	d.LogicalBlocksize = 2048
+	fspec := disk.FilesystemSpec{
+		Partition:   0,
+		FSType:      filesystem.TypeISO9660,
+		VolumeLabel: volumeLabel,
+		WorkDir:     workDir,
+	}
+	fs, err := d.CreateFilesystem(fspec)
+	if err != nil {
+		return err
+	}
+
+	iso, ok := fs.(*iso9660.FileSystem)
+	if !ok {
+		return fmt.Errorf("not an iso9660 filesystem")
+	}
+
+	options := iso9660.FinalizeOptions{
+		RockRidge:        format.rockRidge,
+		DeepDirectories:  format.deepDirectories,
+		VolumeIdentifier: volumeLabel,
+		ElTorito:         elTorito,
+	}
+
+	// diskfs changes the working directory of the process to workDir while finalizing and leaves it there on error
+	cwd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %w", err)
+	}
+	err = iso.Finalize(options)
+	if chdirErr := os.Chdir(cwd); chdirErr != nil && err == nil {
+		err = fmt.Errorf("failed to restore working directory: %w", chdirErr)
+	}
+	return err
+}
+
+// isoSectorSize returns the diskfs sector size for size in bytes, zero selects the diskfs default
+func isoSectorSize(size int) (diskfs.SectorSize, error) {
+	switch size {
+	case 0:
+		return diskfs.SectorSizeDefault, nil
+	case 512:
+		return diskfs.SectorSize512, nil
+	case 4096:
+		return diskfs.SectorSize4k, nil
+	}
+	return 0, fmt.Errorf("unsupported sector size %d, must be 512 or 4096", size)
+}
+
+// fileSHA256 returns the hex encoded sha256 checksum of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// writeTree writes files, keyed by slash separated path, under dir
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openISO returns the filesystem of the iso at path, closed when the test is over
+func openISO(t *testing.T, path string) filesystem.FileSystem {
+	t.Helper()
+	d, err := diskfs.Open(path, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.File.Close() })
+	d.LogicalBlocksize = isoBlockSize
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// readISOFile returns the contents of the file at p in fs
+func readISOFile(t *testing.T, fs filesystem.FileSystem, p string) string {
+	t.Helper()
+	f, err := fs.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", p, err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", p, err)
+	}
+	return string(data)
+}
+
+var rockRidgeFormat = isoFormat{sectorSize: diskfs.SectorSizeDefault, rockRidge: true}
+
+func TestCreateReplacesISOAtomically(t *testing.T) {
+	isosDir := t.TempDir()
+	outPath := filepath.Join(isosDir, "test.iso")
+	if err := os.WriteFile(outPath, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer previous.Close()
+
+	workDir := t.TempDir()
+	writeTree(t, workDir, map[string]string{"config": "config-data"})
+	if err := create(outPath, workDir, "test", bootImages{}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader of the previous iso keeps reading it whole
+	data, err := io.ReadAll(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "previous" {
+		t.Fatalf("previous iso changed under its reader to %q", data)
+	}
+	if got := readISOFile(t, openISO(t, outPath), "/config"); got != "config-data" {
+		t.Fatalf("expected config-data, got %q", got)
+	}
+	entries, err := os.ReadDir(isosDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the iso to be left in the isos dir, got %d entries", len(entries))
+	}
+}
+
+func TestCreateFailureLeavesNoPartialISO(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		files  map[string]string
+		boot   bootImages
+		format isoFormat
+	}{
+		{
+			name: "invalid content",
+			// without Rock Ridge the two names can't both be written
+			files:  map[string]string{"a-b": "1", "a_b": "2"},
+			format: isoFormat{sectorSize: diskfs.SectorSizeDefault},
+		},
+		{
+			name:   "missing boot image",
+			files:  map[string]string{"config": "config-data"},
+			boot:   bootImages{bios: "isolinux/isolinux.bin"},
+			format: rockRidgeFormat,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			isosDir := t.TempDir()
+			outPath := filepath.Join(isosDir, "test.iso")
+			if err := os.WriteFile(outPath, []byte("previous"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			workDir := t.TempDir()
+			writeTree(t, workDir, tc.files)
+			err := create(outPath, workDir, "test", tc.boot, tc.format)
+			if !errors.Is(err, ErrISOBuild) {
+				t.Fatalf("expected %v, got %v", ErrISOBuild, err)
+			}
+
+			data, err := os.ReadFile(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "previous" {
+				t.Fatalf("failed build replaced the previous iso")
+			}
+			entries, err := os.ReadDir(isosDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() != "test.iso" {
+					t.Errorf("failed build left %s behind", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestCreateSectorSizes(t *testing.T) {
+	for _, size := range []int{0, 512, 4096} {
+		sectorSize, err := isoSectorSize(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		workDir := t.TempDir()
+		writeTree(t, workDir, map[string]string{"config": "config-data"})
+		outPath := filepath.Join(t.TempDir(), "test.iso")
+		if err := create(outPath, workDir, "test", bootImages{}, isoFormat{sectorSize: sectorSize, rockRidge: true}); err != nil {
+			t.Fatalf("sector size %d: %v", size, err)
+		}
+		if got := readISOFile(t, openISO(t, outPath), "/config"); got != "config-data" {
+			t.Fatalf("sector size %d: expected config-data, got %q", size, got)
+		}
+	}
+	if _, err := isoSectorSize(1024); err == nil {
+		t.Fatal("expected sector size 1024 to be rejected")
+	}
+}
+
+func TestValidateISOContent(t *testing.T) {
+	noRockRidge := isoFormat{sectorSize: diskfs.SectorSizeDefault}
+	for _, tc := range []struct {
+		name   string
+		files  map[string]string
+		format isoFormat
+		err    string
+	}{
+		{
+			name:   "same ISO9660 name without Rock Ridge",
+			files:  map[string]string{"a-b.txt": "", "a_b.txt": ""},
+			format: noRockRidge,
+			err:    "same ISO9660 name",
+		},
+		{
+			name:   "same ISO9660 name with Rock Ridge",
+			files:  map[string]string{"a-b.txt": "", "a_b.txt": "", "A-B.txt": ""},
+			format: rockRidgeFormat,
+		},
+		{
+			name:   "name too long with Rock Ridge",
+			files:  map[string]string{strings.Repeat("a", 29): ""},
+			format: rockRidgeFormat,
+			err:    "too long",
+		},
+		{
+			name:   "longest name",
+			files:  map[string]string{strings.Repeat("a", 28): ""},
+			format: noRockRidge,
+		},
+		{
+			name:   "hidden name",
+			files:  map[string]string{".hidden": ""},
+			format: rockRidgeFormat,
+			err:    "no characters usable",
+		},
+		{
+			name:   "too deep without Rock Ridge",
+			files:  map[string]string{"1/2/3/4/5/6/7/8/file": ""},
+			format: noRockRidge,
+			err:    "nested deeper",
+		},
+		{
+			name:   "deepest without Rock Ridge",
+			files:  map[string]string{"1/2/3/4/5/6/7/file": ""},
+			format: noRockRidge,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			workDir := t.TempDir()
+			writeTree(t, workDir, tc.files)
+			err := validateISOContent(workDir, tc.format)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestCreateKeepsNamesSharingAnISO9660NameWithRockRidge(t *testing.T) {
+	workDir := t.TempDir()
+	files := map[string]string{"a-b.txt": "dash", "a_b.txt": "underscore", "A-B.txt": "upper", "dir-x/f": "1", "dir_x/f": "2"}
+	writeTree(t, workDir, files)
+	outPath := filepath.Join(t.TempDir(), "test.iso")
+	if err := create(outPath, workDir, "test", bootImages{}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+	fs := openISO(t, outPath)
+	for name, content := range files {
+		if got := readISOFile(t, fs, "/"+name); got != content {
+			t.Errorf("%s has %q, expected %q", name, got, content)
+		}
+	}
+}
+
+func TestCreateBIOSBootable(t *testing.T) {
+	workDir := t.TempDir()
+	// the boot info table is filled into bytes 8 to 64 of the loader, which verification must allow for
+	loader := strings.Repeat("isolinux", 1024)
+	writeTree(t, workDir, map[string]string{"isolinux/isolinux.bin": loader, "config": "config-data"})
+	outPath := filepath.Join(t.TempDir(), "test.iso")
+	if err := create(outPath, workDir, "test", bootImages{bios: "isolinux/isolinux.bin"}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+	got := readISOFile(t, openISO(t, outPath), "/isolinux/isolinux.bin")
+	if got[:bootInfoTableStart] != loader[:bootInfoTableStart] || got[bootInfoTableEnd:] != loader[bootInfoTableEnd:] {
+		t.Fatal("loader changed outside its boot info table")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// isoConfig is the contents of ISO_CONFIG_FILE
+type isoConfig struct {
+	ISOs []isoConfigEntry `json:"isos"`
+}
+
+// isoConfigEntry is an iso built and served alongside the test iso
+type isoConfigEntry struct {
+	// file name the iso is served as under /images/, must end in .iso
+	Name string `json:"name"`
+	// volume label, defaults to Name without its extension
+	Label string `json:"label"`
+	// directory, tarball, or zip packaged into the iso, relative paths are from the directory of the config file
+	// an http or https URL of a tarball, zip, or git archive is downloaded, and an oci:// image reference extracted
+	// a single test file is written when unset
+	Source string `json:"source"`
+	// hex sha256 the download of a URL Source must have
+	SourceSHA256 string `json:"sourceSHA256"`
+	// directory of Source packaged into the iso, all of it when unset
+	SourcePath string `json:"sourcePath"`
+	// values *.tmpl files of Source are rendered with, on top of those the test iso is rendered with
+	TemplateVars map[string]string `json:"templateVars"`
+}
+
+// isoDefinition is the name, label, and content of an iso the builder creates
+type isoDefinition struct {
+	name   string
+	label  string
+	source string
+	// hex sha256 a remote source must have, unchecked when empty
+	sourceSHA256 string
+	// directory of the source packaged into the iso, all of it when empty
+	sourcePath   string
+	templateVars map[string]string
+	// nmstate file or NetworkManager keyfile dir written into the iso, see writeNetworkConfig
+	networkConfig string
+}
+
+// loadISODefinitions reads the isos listed in the YAML or JSON file at path
+// the template vars of each are merged over vars, names must be unique and not taken by the test images
+func loadISODefinitions(path string, vars map[string]string) ([]isoDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read iso config %s: %w", path, err)
+	}
+	var config isoConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse iso config %s: %w", path, err)
+	}
+
+	names := map[string]bool{testISOName: true, testUSBImageName: true}
+	definitions := make([]isoDefinition, 0, len(config.ISOs))
+	for i, entry := range config.ISOs {
+		if err := validISOName(entry.Name); err != nil {
+			return nil, fmt.Errorf("iso %d in %s: %w", i, path, err)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("iso %d in %s: name %s is already in use", i, path, entry.Name)
+		}
+		names[entry.Name] = true
+		label := entry.Label
+		if label == "" {
+			label = defaultVolumeLabel(entry.Name)
+		}
+		if len(label) > maxVolumeLabelLength {
+			return nil, fmt.Errorf("iso %d in %s: volume label %q is longer than %d characters", i, path, label, maxVolumeLabelLength)
+		}
+		merged := make(map[string]string, len(vars)+len(entry.TemplateVars))
+		for k, v := range vars {
+			merged[k] = v
+		}
+		for k, v := range entry.TemplateVars {
+			merged[k] = v
+		}
+		if entry.SourceSHA256 != "" && !isHTTPSource(entry.Source) {
+			return nil, fmt.Errorf("iso %d in %s: sourceSHA256 is only supported with an http or https source", i, path)
+		}
+		source := entry.Source
+		if !isRemoteSource(source) {
+			source = configRelative(path, source)
+		}
+		definitions = append(definitions, isoDefinition{
+			name:         entry.Name,
+			label:        label,
+			source:       source,
+			sourceSHA256: entry.SourceSHA256,
+			sourcePath:   entry.SourcePath,
+			templateVars: merged,
+		})
+	}
+	return definitions, nil
+}
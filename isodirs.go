@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mergedDirs is an http.FileSystem serving the contents of several directories as one namespace
+// when a name exists in more than one directory the one listed first is served
+// names starting with a dot are neither served nor listed, they are the temp files and staging dirs images are
+// written to before being renamed into place
+type mergedDirs []string
+
+func (m mergedDirs) Open(name string) (http.File, error) {
+	if hiddenPath(name) {
+		return nil, os.ErrNotExist
+	}
+	var firstErr error
+	for _, dir := range m {
+		f, err := http.Dir(dir).Open(name)
+		if err == nil {
+			if name == "/" {
+				return &mergedRoot{File: f, dirs: m}, nil
+			}
+			return visibleFile{File: f}, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = os.ErrNotExist
+	}
+	return nil, firstErr
+}
+
+// hiddenPath returns true if any element of name starts with a dot
+func hiddenPath(name string) bool {
+	for _, elem := range strings.Split(path.Clean("/"+name), "/") {
+		if strings.HasPrefix(elem, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleFile lists the entries of a directory that aren't hidden
+type visibleFile struct {
+	http.File
+}
+
+func (f visibleFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	visible := infos[:0]
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Name(), ".") {
+			visible = append(visible, info)
+		}
+	}
+	return visible, err
+}
+
+// mergedRoot lists the top level entries of all dirs, skipping hidden names and names shadowed by an earlier dir
+type mergedRoot struct {
+	http.File
+	dirs []string
+}
+
+func (r *mergedRoot) Readdir(count int) ([]fs.FileInfo, error) {
+	seen := make(map[string]bool)
+	var infos []fs.FileInfo
+	for _, dir := range r.dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if seen[e.Name()] || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			seen[e.Name()] = true
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+// logISODirCollisions warns about files present in more than one of dirs and which copy is served
+func logISODirCollisions(log *logrus.Logger, dirs []string) {
+	servedFrom := make(map[string]string)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				// not served, see mergedDirs
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			if first, ok := servedFrom[rel]; ok {
+				log.Warnf("%s exists in both %s and %s, serving the copy from %s", rel, first, dir, first)
+				return nil
+			}
+			servedFrom[rel] = dir
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Errorf("failed to scan iso dir %s", dir)
+		}
+	}
+}
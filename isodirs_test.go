@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMergedDirsHidesTempEntries(t *testing.T) {
+	first, second := t.TempDir(), t.TempDir()
+	for _, name := range []string{
+		"a.iso",
+		".staging-1/a.iso",
+		".a.iso-2/a.iso",
+		".upload-3",
+		".checksum-4",
+		".signature-5",
+		"sub/b.iso",
+		"sub/.upload-6",
+	} {
+		path := filepath.Join(first, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(second, ".upload-7"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(mergedDirs{first, second}))
+	defer server.Close()
+
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	for _, path := range []string{
+		"/.staging-1/a.iso",
+		"/.staging-1/",
+		"/.a.iso-2/a.iso",
+		"/.upload-3",
+		"/.checksum-4",
+		"/.signature-5",
+		"/sub/.upload-6",
+		"/.upload-7",
+		"/sub/../.upload-3",
+	} {
+		if status, _ := get(path); status != http.StatusNotFound {
+			t.Errorf("GET %s returned %d, expected %d", path, status, http.StatusNotFound)
+		}
+	}
+	for _, path := range []string{"/a.iso", "/sub/b.iso"} {
+		if status, _ := get(path); status != http.StatusOK {
+			t.Errorf("GET %s returned %d, expected %d", path, status, http.StatusOK)
+		}
+	}
+	for _, dir := range []string{"/", "/sub/"} {
+		status, listing := get(dir)
+		if status != http.StatusOK {
+			t.Fatalf("GET %s returned %d", dir, status)
+		}
+		if strings.Contains(listing, `href=".`) {
+			t.Errorf("listing of %s includes hidden entries:\n%s", dir, listing)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+const (
+	// bytes of the master boot record at the start of the iso9660 system area
+	mbrSize = 512
+	// offset of the first of the four partition entries of a master boot record
+	mbrPartitionTable = 446
+	mbrPartitionSize  = 16
+	// partitions are addressed in 512 byte sectors, the logical sector size of USB sticks, whatever SECTOR_SIZE is
+	mbrSectorSize = 512
+	// partition type of an EFI system partition
+	mbrTypeEFI = 0xef
+)
+
+// writeHybridMBR writes a master boot record to the system area of the iso at isoPath with the EFI boot image of its
+// boot catalog, of efiSize bytes, as an EFI system partition, so UEFI firmware boots the iso written to a USB stick
+// as it boots it as a CD
+// only the partition table is written, no BIOS boot code, so BIOS firmware still only boots the iso as a CD
+func writeHybridMBR(isoPath string, efiSize int64) error {
+	f, err := os.OpenFile(isoPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	images, err := elToritoImages(f)
+	if err != nil {
+		return fmt.Errorf("failed to read boot catalog: %w", err)
+	}
+	location, ok := images[elToritoPlatformEFI]
+	if !ok {
+		return fmt.Errorf("boot catalog has no EFI boot image")
+	}
+
+	start := int64(location) * isoBlockSize / mbrSectorSize
+	sectors := (efiSize + mbrSectorSize - 1) / mbrSectorSize
+	if start+sectors > 0xffffffff {
+		return fmt.Errorf("EFI boot image at sector %d is beyond what a master boot record can address", start)
+	}
+
+	mbr := make([]byte, mbrSize)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return err
+	}
+	for _, b := range mbr {
+		if b != 0 {
+			return fmt.Errorf("system area of the iso is already in use")
+		}
+	}
+	entry := mbr[mbrPartitionTable : mbrPartitionTable+mbrPartitionSize]
+	// not active, with CHS addresses beyond what they can express so only the LBA ones are used
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = mbrTypeEFI
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(start))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(sectors))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/diskfs/go-diskfs"
+)
+
+func TestCreateHybridMBR(t *testing.T) {
+	efi := bytes.Repeat([]byte("efi-boot"), 700)
+	for _, tc := range []struct {
+		sectorSize diskfs.SectorSize
+		joliet     bool
+	}{
+		{sectorSize: diskfs.SectorSizeDefault},
+		{sectorSize: diskfs.SectorSize512, joliet: true},
+		// partitions stay in 512 byte sectors as a 2048 byte iso block may not start a 4096 byte one
+		{sectorSize: diskfs.SectorSize4k},
+	} {
+		t.Run(fmt.Sprintf("sector size %d joliet %t", tc.sectorSize, tc.joliet), func(t *testing.T) {
+			workDir := t.TempDir()
+			writeTree(t, workDir, map[string]string{"EFI/efiboot.img": string(efi), "config": "config-data"})
+			outPath := filepath.Join(t.TempDir(), "test.iso")
+			format := isoFormat{sectorSize: tc.sectorSize, rockRidge: true, joliet: tc.joliet}
+			if err := create(outPath, workDir, "test", bootImages{efi: "EFI/efiboot.img"}, format); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(outPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data[510] != 0x55 || data[511] != 0xaa {
+				t.Fatalf("iso has no master boot record signature: %x", data[510:512])
+			}
+			entry := data[mbrPartitionTable : mbrPartitionTable+mbrPartitionSize]
+			if entry[4] != mbrTypeEFI {
+				t.Fatalf("first partition has type %#x, expected an EFI system partition", entry[4])
+			}
+			start := int64(binary.LittleEndian.Uint32(entry[8:12])) * mbrSectorSize
+			size := int64(binary.LittleEndian.Uint32(entry[12:16])) * mbrSectorSize
+			if size < int64(len(efi)) || size >= int64(len(efi))+mbrSectorSize {
+				t.Fatalf("partition is %d bytes, expected the %d of the EFI image rounded up to a sector", size, len(efi))
+			}
+			if !bytes.Equal(data[start:start+int64(len(efi))], efi) {
+				t.Fatal("EFI system partition doesn't hold the EFI boot image")
+			}
+			for i := 1; i < 4; i++ {
+				if other := data[mbrPartitionTable+i*mbrPartitionSize : mbrPartitionTable+(i+1)*mbrPartitionSize]; !bytes.Equal(other, make([]byte, mbrPartitionSize)) {
+					t.Errorf("partition %d is set: %x", i+1, other)
+				}
+			}
+
+			// the iso9660 filesystem is still found behind the partition table
+			if got := readISOFile(t, openISO(t, outPath), "/config"); got != "config-data" {
+				t.Fatalf("iso has %q for /config", got)
+			}
+		})
+	}
+}
+
+func TestCreateWithoutEFIHasNoMBR(t *testing.T) {
+	workDir := t.TempDir()
+	writeTree(t, workDir, map[string]string{"isolinux/isolinux.bin": string(bytes.Repeat([]byte("isolinux"), 256))})
+	outPath := filepath.Join(t.TempDir(), "test.iso")
+	if err := create(outPath, workDir, "test", bootImages{bios: "isolinux/isolinux.bin"}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mbr := make([]byte, mbrSize)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mbr, make([]byte, mbrSize)) {
+		t.Fatal("iso without an EFI boot image has a master boot record")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/diskfs/go-diskfs"
+)
+
+const (
+	// longest ISO9660 name diskfs writes, not counting the separator of the extension of a file
+	maxISONameLength = 30
+	// deepest directory level ISO9660 allows, the root is level 1
+	maxISODirDepth = 8
+)
+
+// isoFormat is how the filesystem of an iso is written
+type isoFormat struct {
+	// sector size of the image file, the iso9660 block size stays 2048 regardless
+	sectorSize diskfs.SectorSize
+	// Rock Ridge extensions keep names, permissions, and links as they are in the work dir
+	rockRidge bool
+	// allows directories deeper than 8 levels rather than having Rock Ridge relocate them
+	deepDirectories bool
+	// adds a Joliet tree for tools that read long names the Windows way
+	joliet bool
+}
+
+var invalidISONameCharacters = regexp.MustCompile("[^A-Z0-9_]")
+
+// isoName returns the ISO9660 name diskfs gives a file or directory called name, directories have no extension
+func isoName(name string, isDir bool) string {
+	parts := strings.SplitN(name, ".", 2)
+	short := invalidISONameCharacters.ReplaceAllString(strings.ToUpper(parts[0]), "_")
+	if isDir || len(parts) == 1 {
+		return short
+	}
+	return short + "." + invalidISONameCharacters.ReplaceAllString(strings.ToUpper(parts[1]), "_")
+}
+
+// validateISOContent checks that the tree in workDir can be written as an iso with format, so content that can't
+// be represented fails with the path at fault rather than deep inside diskfs
+// diskfs derives an ISO9660 name from every name, even with Rock Ridge recording the original, and those names are
+// limited to 30 characters, without Rock Ridge they are the only names so they must also be unique within their
+// directory, as must the Joliet names with Joliet
+func validateISOContent(workDir string, format isoFormat) error {
+	return validateISODir(workDir, "/", 1, format)
+}
+
+// validateISODir checks the entries of dir at depth, the root being at depth 1
+func validateISODir(workDir, dir string, depth int, format isoFormat) error {
+	entries, err := os.ReadDir(filepath.Join(workDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string, len(entries))
+	joliet := make(jolietIDs, len(entries))
+	for _, e := range entries {
+		p := path.Join(dir, e.Name())
+		name := isoName(e.Name(), e.IsDir())
+		short := strings.SplitN(name, ".", 2)[0]
+		maxLength := maxISONameLength
+		if !e.IsDir() {
+			// the ;1 version diskfs appends to file names counts too
+			maxLength -= 2
+		}
+		switch {
+		case short == "":
+			return fmt.Errorf("%s has no characters usable in an ISO9660 name, it must not start with a '.'", p)
+		case len(strings.Replace(name, ".", "", 1)) > maxLength:
+			return fmt.Errorf("%s is too long, its ISO9660 name %s must be at most %d characters", p, name, maxLength)
+		case e.Type()&os.ModeSymlink != 0 && !format.rockRidge:
+			return fmt.Errorf("%s is a symlink, which only Rock Ridge can represent", p)
+		case !e.IsDir() && e.Type()&os.ModeSymlink == 0 && !e.Type().IsRegular():
+			return fmt.Errorf("%s is not a regular file, directory, or symlink", p)
+		}
+		if other, ok := names[name]; ok && !format.rockRidge {
+			return fmt.Errorf("%s and %s have the same ISO9660 name %s, enable Rock Ridge to keep both", path.Join(dir, other), p, name)
+		}
+		names[name] = e.Name()
+		if format.joliet {
+			if err := joliet.add(dir, e.Name()); err != nil {
+				return err
+			}
+		}
+
+		if !e.IsDir() {
+			continue
+		}
+		// Rock Ridge moves deeper directories up and links them in place
+		if depth+1 > maxISODirDepth && !format.rockRidge && !format.deepDirectories {
+			return fmt.Errorf("%s is nested deeper than the %d levels ISO9660 allows, enable Rock Ridge or deep directories", p, maxISODirDepth)
+		}
+		if err := validateISODir(workDir, p, depth+1, format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jolietIDs are the names of the entries of a directory by their Joliet identifier
+type jolietIDs map[string]string
+
+// add records name of an entry of dir, or returns an error if another entry has the same Joliet identifier once
+// both are cut to the length Joliet allows, which readers would see as a corrupt directory
+func (ids jolietIDs) add(dir, name string) error {
+	id := string(jolietName(name))
+	if other, ok := ids[id]; ok {
+		return fmt.Errorf("%s and %s have the same Joliet name once cut to %d characters", path.Join(dir, other), path.Join(dir, name), maxJolietNameLength)
+	}
+	ids[id] = name
+	return nil
+}
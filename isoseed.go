@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+const (
+	// isoModeTest builds the test iso from SOURCE, or a single test file
+	isoModeTest = "test"
+	// isoModeNoCloud builds a cloud-init NoCloud seed iso
+	isoModeNoCloud = "nocloud"
+	// isoModeConfigDrive builds an OpenStack config drive iso
+	isoModeConfigDrive = "configdrive"
+)
+
+// isoSeed is instance configuration in the layout a guest looks for, written on top of the rest of the iso content
+type isoSeed interface {
+	// write writes the seed into workDir
+	write(workDir string) error
+	// volumeLabel returns the label the guest finds the iso by
+	volumeLabel() string
+}
+
+// validateISOMode returns an error if mode is not one of the supported iso modes
+func validateISOMode(mode string) error {
+	switch mode {
+	case isoModeTest, isoModeNoCloud, isoModeConfigDrive, isoModeCoreOS:
+		return nil
+	}
+	return fmt.Errorf("unsupported iso mode %q", mode)
+}
+
+// loadISOSeed returns the seed for mode read from the files in Options, nil for the modes without one
+// sshKeys are added to the public keys of the seed's metadata
+func loadISOSeed(mode string, sshKeys []string) (isoSeed, error) {
+	switch mode {
+	case isoModeNoCloud:
+		seed, err := loadNoCloudSeed(Options.NoCloudUserDataFile, Options.NoCloudMetaDataFile, Options.NoCloudNetworkConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		seed.SSHAuthorizedKeys = sshKeys
+		return seed, nil
+	case isoModeConfigDrive:
+		seed, err := loadConfigDriveSeed(Options.ConfigDriveUserDataFile, Options.ConfigDriveMetaDataFile, Options.ConfigDriveNetworkDataFile)
+		if err != nil {
+			return nil, err
+		}
+		seed.SSHAuthorizedKeys = sshKeys
+		return seed, nil
+	}
+	return nil, validateISOMode(mode)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isoStore manages isos in the served isos directory on behalf of the API
+type isoStore struct {
+	mu        sync.Mutex
+	dataDir   string
+	isosDir   string
+	baseURL   string
+	expiry    *isoExpiry
+	downloads *downloadTracker
+	format    isoFormat
+	// default time an iso created through the API is served for, zero to keep it until deleted
+	ttl time.Duration
+	// signs the isos created through the API when set, uploaded ones are not signed
+	signer *isoSigner
+}
+
+// maxVolumeLabelLength is the size of the iso9660 volume identifier field
+const maxVolumeLabelLength = 32
+
+// isoFile is a file to write into a new iso
+type isoFile struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// "base64" if Content is base64 encoded, otherwise it is used as is
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// validISOName returns an error if name can't be used as the file name of a served iso
+func validISOName(name string) error {
+	if name == "" || path.Base(name) != name || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid iso name %q", name)
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".iso") {
+		return fmt.Errorf("iso name %q must end in .iso", name)
+	}
+	return nil
+}
+
+// defaultVolumeLabel returns the label of an iso called name that wasn't given one, name without its extension
+// truncated to fit
+func defaultVolumeLabel(name string) string {
+	label := strings.TrimSuffix(name, filepath.Ext(name))
+	if len(label) > maxVolumeLabelLength {
+		label = label[:maxVolumeLabelLength]
+	}
+	return label
+}
+
+// path returns the location of the iso called name
+func (s *isoStore) path(name string) string {
+	return filepath.Join(s.isosDir, name)
+}
+
+// url returns the download URL of the iso called name
+func (s *isoStore) url(name string) (string, error) {
+	return url.JoinPath(s.baseURL, "images", name)
+}
+
+// create builds the iso called name from files with volumeLabel and serves it for ttl, or the store default if zero
+// seed is written on top of files when set, the iso is bootable from the images in boot if any are set
+// the label defaults to name without its extension truncated to fit, an existing iso with the same name is an error
+func (s *isoStore) create(name, volumeLabel string, files []isoFile, seed isoSeed, boot bootImages, ttl time.Duration) error {
+	return s.build(name, volumeLabel, boot, ttl, func(workDir string) error {
+		for _, f := range files {
+			if err := writeISOFileContent(workDir, f); err != nil {
+				return err
+			}
+		}
+		if seed != nil {
+			if err := seed.write(workDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// createFromArchive builds the iso called name from the contents of the tar, tar.gz, or zip archive read from r
+// the archive is saved before the store is locked so a slow upload doesn't hold up other requests
+// otherwise the same as create
+func (s *isoStore) createFromArchive(name, volumeLabel string, r io.Reader, boot bootImages, ttl time.Duration) error {
+	if err := validISOName(name); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.dataDir, "api-archive-")
+	if err != nil {
+		return wrapError(ErrISOBuild, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return wrapError(ErrISOBuild, err)
+	}
+	typ, err := detectSourceType(f.Name())
+	if err != nil || typ == sourceDir {
+		return fmt.Errorf("upload is not a tar, tar.gz, or zip archive")
+	}
+
+	return s.build(name, volumeLabel, boot, ttl, func(workDir string) error {
+		if err := extractArchive(f.Name(), typ, workDir); err != nil {
+			return fmt.Errorf("failed to extract archive: %w", err)
+		}
+		return nil
+	})
+}
+
+// build creates the iso called name from a work dir populated by write, errors of write are the caller's fault
+// rather than failed builds
+func (s *isoStore) build(name, volumeLabel string, boot bootImages, ttl time.Duration, write func(workDir string) error) error {
+	if err := validISOName(name); err != nil {
+		return err
+	}
+	if volumeLabel == "" {
+		volumeLabel = defaultVolumeLabel(name)
+	}
+	if len(volumeLabel) > maxVolumeLabelLength {
+		return fmt.Errorf("volume label %q is longer than %d characters", volumeLabel, maxVolumeLabelLength)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(s.path(name)); err == nil {
+		return fmt.Errorf("%w: %s", os.ErrExist, name)
+	}
+
+	workDir, err := os.MkdirTemp(s.dataDir, "api-iso")
+	if err != nil {
+		return fmt.Errorf("failed to create iso work dir: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	if err := write(workDir); err != nil {
+		return err
+	}
+	// files that can't be written as an iso or a boot image missing from them are a bad request rather than a failed build
+	if err := validateISOContent(workDir, s.format); err != nil {
+		return err
+	}
+	if _, err := boot.elTorito(workDir); err != nil {
+		return err
+	}
+	if err := create(s.path(name), workDir, volumeLabel, boot, s.format); err != nil {
+		return err
+	}
+	if _, err := writeChecksumFile(s.path(name)); err != nil {
+		os.Remove(s.path(name))
+		return wrapError(ErrISOBuild, fmt.Errorf("failed to write checksum of %s: %w", name, err))
+	}
+	if s.signer != nil {
+		if err := s.signer.sign(s.path(name)); err != nil {
+			removeSidecarFiles(s.path(name))
+			os.Remove(s.path(name))
+			return wrapError(ErrISOBuild, fmt.Errorf("failed to sign %s: %w", name, err))
+		}
+	}
+
+	if ttl == 0 {
+		ttl = s.ttl
+	}
+	return s.expiry.track(name, ttl)
+}
+
+// writeISOFileContent decodes f and writes it into workDir
+func writeISOFileContent(workDir string, f isoFile) error {
+	var content []byte
+	switch f.Encoding {
+	case "":
+		content = []byte(f.Content)
+	case "base64":
+		var err error
+		content, err = base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return fmt.Errorf("invalid base64 content for %s: %w", f.Path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported encoding %q for %s", f.Encoding, f.Path)
+	}
+
+	dest, err := securePath(workDir, strings.TrimPrefix(f.Path, "/"))
+	if err != nil {
+		return err
+	}
+	if dest == workDir {
+		return fmt.Errorf("invalid file path %q", f.Path)
+	}
+	return writeArchiveFile(bytes.NewReader(content), dest, 0644)
+}
+
+// upload writes the iso read from r to name, replacing any existing iso with that name
+// the iso is written to a temporary file first so a partial upload is never served
+// returns the sha256 checksum of the iso and whether it replaced an existing one
+func (s *isoStore) upload(name string, r io.Reader) (string, bool, error) {
+	if err := validISOName(name); err != nil {
+		return "", false, err
+	}
+
+	f, err := os.CreateTemp(s.isosDir, ".upload-")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(f, io.TeeReader(r, h)); err != nil {
+		return "", false, err
+	}
+	if err := f.Close(); err != nil {
+		return "", false, err
+	}
+	if err := verifyISO(f.Name()); err != nil {
+		return "", false, fmt.Errorf("uploaded file is not an iso: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return "", false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = os.Stat(s.path(name))
+	replaced := err == nil
+	if err := os.Rename(f.Name(), s.path(name)); err != nil {
+		return "", false, err
+	}
+	// the signature of a replaced iso would no longer match
+	if err := os.Remove(s.path(name) + signatureSuffix); err != nil && !os.IsNotExist(err) {
+		return "", false, err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if err := writeChecksum(s.path(name), checksum); err != nil {
+		removeSidecarFiles(s.path(name))
+		return "", false, fmt.Errorf("failed to write checksum of %s: %w", name, err)
+	}
+	if err := s.expiry.track(name, s.ttl); err != nil {
+		return "", false, err
+	}
+	return checksum, replaced, nil
+}
+
+// errISOInUse is returned when deleting an iso that is being downloaded
+var errISOInUse = errors.New("iso is being downloaded")
+
+// delete removes the iso called name unless it is being downloaded
+func (s *isoStore) delete(name string) error {
+	if err := validISOName(name); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	idle := s.downloads.ifIdle(name, func() {
+		if err = os.Remove(s.path(name)); err == nil {
+			err = removeSidecarFiles(s.path(name))
+		}
+	})
+	if !idle {
+		return errISOInUse
+	}
+	if err != nil {
+		return err
+	}
+	return s.expiry.track(name, 0)
+}
+
+// isoInfo describes an iso in the isos directory
+type isoInfo struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// URL of the sidecar checksum file, which sha256sum -c can verify a download with
+	ChecksumURL string `json:"checksumUrl"`
+	// URL of the detached GPG signature, empty if the iso isn't signed
+	SignatureURL string `json:"signatureUrl,omitempty"`
+	// modification time of the file, which is when it was created or last replaced
+	Created time.Time `json:"created"`
+	URL     string    `json:"url"`
+}
+
+// list returns every iso in the isos directory sorted by name
+func (s *isoStore) list() ([]isoInfo, error) {
+	entries, err := os.ReadDir(s.isosDir)
+	if err != nil {
+		return nil, err
+	}
+
+	isos := []isoInfo{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || validISOName(e.Name()) != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			// removed since the directory was read
+			continue
+		}
+		checksum, err := imageChecksum(s.path(e.Name()))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		isoURL, err := s.url(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		var signatureURL string
+		if _, err := os.Stat(s.path(e.Name()) + signatureSuffix); err == nil {
+			signatureURL = isoURL + signatureSuffix
+		}
+		isos = append(isos, isoInfo{
+			Name:         e.Name(),
+			Size:         info.Size(),
+			SHA256:       checksum,
+			ChecksumURL:  isoURL + checksumSuffix,
+			SignatureURL: signatureURL,
+			Created:      info.ModTime().UTC(),
+			URL:          isoURL,
+		})
+	}
+	return isos, nil
+}
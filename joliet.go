@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+const (
+	// escape sequence of a supplementary volume descriptor for Joliet UCS-2 level 3
+	jolietEscape = "%/E"
+	// longest Joliet name in UCS-2 characters
+	maxJolietNameLength = 64
+	// longest volume identifier in UCS-2 characters
+	maxJolietLabelLength = 16
+	dirRecordFlagDir     = 0x02
+)
+
+// jolietEntry is a file or directory of the Joliet tree, files point at the extents of the primary tree
+type jolietEntry struct {
+	// UCS-2 big endian
+	name []byte
+	// in the primary tree, with Rock Ridge and ISO9660 names
+	path     string
+	isoPath  string
+	dir      bool
+	location uint32
+	size     uint32
+	parent   *jolietEntry
+	children []*jolietEntry
+	// 1-based position in the path table, directories only
+	index int
+}
+
+// addJoliet adds a Joliet supplementary volume descriptor and the directory tree root to the iso at isoPath, so tools
+// reading Joliet rather than Rock Ridge, as Windows does, see the names as they were in the work dir
+// diskfs can't write Joliet and starts the data straight after the volume descriptors, so everything after them is
+// moved up a sector to make room for the extra descriptor before the Joliet tree is appended to the image
+func addJoliet(isoPath string, root *jolietEntry, volumeLabel string, rockRidge bool) error {
+	if err := locateJolietTree(isoPath, root, rockRidge); err != nil {
+		return fmt.Errorf("failed to read iso for Joliet: %w", err)
+	}
+
+	f, err := os.OpenFile(isoPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pvdSector, terminator, err := findVolumeDescriptors(f)
+	if err != nil {
+		return err
+	}
+	if err := insertSector(f, terminator+1); err != nil {
+		return fmt.Errorf("failed to make room for the Joliet volume descriptor: %w", err)
+	}
+	if err := shiftLocations(f, pvdSector, terminator, terminator+1); err != nil {
+		return fmt.Errorf("failed to update locations in iso: %w", err)
+	}
+	shiftJolietFiles(root, terminator+1)
+
+	pvd := make([]byte, isoBlockSize)
+	if _, err := f.ReadAt(pvd, int64(pvdSector)*isoBlockSize); err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := uint32((info.Size() + isoBlockSize - 1) / isoBlockSize)
+	if space := binary.LittleEndian.Uint32(pvd[80:84]); space > end {
+		end = space
+	}
+
+	// the Joliet directories in path table order, followed by its path tables
+	dirs := jolietDirs(root)
+	location := end
+	for _, dir := range dirs {
+		dir.location = location
+		dir.size = jolietDirSize(dir)
+		location += blocksFor(dir.size)
+	}
+	pathTableL, pathTableM := jolietPathTables(dirs)
+	pathTableLLocation := location
+	location += blocksFor(uint32(len(pathTableL)))
+	pathTableMLocation := location
+	location += blocksFor(uint32(len(pathTableM)))
+	total := location
+
+	for _, dir := range dirs {
+		if _, err := f.WriteAt(jolietDirBytes(dir), int64(dir.location)*isoBlockSize); err != nil {
+			return err
+		}
+	}
+	if _, err := f.WriteAt(pathTableL, int64(pathTableLLocation)*isoBlockSize); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(pathTableM, int64(pathTableMLocation)*isoBlockSize); err != nil {
+		return err
+	}
+
+	svd := make([]byte, isoBlockSize)
+	copy(svd, pvd)
+	svd[0] = 2
+	fillUCS2Spaces(svd[8:40])
+	label := utf16.Encode([]rune(volumeLabel))
+	if len(label) > maxJolietLabelLength {
+		label = label[:maxJolietLabelLength]
+	}
+	fillUCS2Spaces(svd[40:72])
+	copy(svd[40:72], ucs2Bytes(label))
+	copy(svd[88:120], make([]byte, 32))
+	copy(svd[88:], jolietEscape)
+	putBothEndian32(svd[132:140], uint32(len(pathTableL)))
+	binary.LittleEndian.PutUint32(svd[140:144], pathTableLLocation)
+	binary.LittleEndian.PutUint32(svd[144:148], 0)
+	binary.BigEndian.PutUint32(svd[148:152], pathTableMLocation)
+	binary.BigEndian.PutUint32(svd[152:156], 0)
+	copy(svd[156:190], dirRecord([]byte{0}, root.location, root.size, dirRecordFlagDir))
+	// volume set, publisher, preparer, and application identifiers are UCS-2 too, the file identifiers are left empty
+	fillUCS2Spaces(svd[190:702])
+	copy(svd[702:813], make([]byte, 813-702))
+
+	putBothEndian32(pvd[80:88], total)
+	putBothEndian32(svd[80:88], total)
+	term := make([]byte, isoBlockSize)
+	term[0] = 0xff
+	copy(term[1:6], "CD001")
+	term[6] = 1
+	for _, vd := range []struct {
+		sector uint32
+		data   []byte
+	}{
+		{pvdSector, pvd},
+		{terminator, svd},
+		{terminator + 1, term},
+	} {
+		if _, err := f.WriteAt(vd.data, int64(vd.sector)*isoBlockSize); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(int64(total) * isoBlockSize); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// jolietTree returns the tree of workDir, read before finalizing as that removes workDir
+func jolietTree(workDir string) (*jolietEntry, error) {
+	root := &jolietEntry{dir: true, path: "/", isoPath: "/"}
+	root.parent = root
+	if err := jolietTreeDir(workDir, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// jolietTreeDir adds the entries of dir in workDir
+func jolietTreeDir(workDir string, dir *jolietEntry) error {
+	entries, err := os.ReadDir(filepath.Join(workDir, filepath.FromSlash(dir.path)))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		entry := &jolietEntry{
+			name:    jolietName(e.Name()),
+			path:    path.Join(dir.path, e.Name()),
+			isoPath: path.Join(dir.isoPath, isoName(e.Name(), e.IsDir())),
+			parent:  dir,
+		}
+		if e.IsDir() {
+			entry.dir = true
+			if err := jolietTreeDir(workDir, entry); err != nil {
+				return err
+			}
+		} else if !e.Type().IsRegular() {
+			// only the Rock Ridge tree can represent links and special files
+			continue
+		}
+		dir.children = append(dir.children, entry)
+	}
+	// directory records must be sorted by identifier
+	sort.Slice(dir.children, func(i, j int) bool {
+		return bytes.Compare(dir.children[i].name, dir.children[j].name) < 0
+	})
+	return nil
+}
+
+// locateJolietFiles sets the extents of the files under dir to the ones they have in fs, found by their Rock Ridge
+// names if it has them
+func locateJolietFiles(fs filesystem.FileSystem, dir *jolietEntry, rockRidge bool) error {
+	for _, entry := range dir.children {
+		if entry.dir {
+			if err := locateJolietFiles(fs, entry, rockRidge); err != nil {
+				return err
+			}
+			continue
+		}
+		p := entry.isoPath
+		if rockRidge {
+			p = entry.path
+		}
+		f, err := fs.OpenFile(p, os.O_RDONLY)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", p, err)
+		}
+		file, ok := f.(*iso9660.File)
+		if !ok {
+			return fmt.Errorf("unexpected file type for %s", p)
+		}
+		entry.location = file.Location()
+		entry.size = uint32(file.Size())
+	}
+	return nil
+}
+
+// locateJolietTree sets the extents of the files of root to the ones they have in the iso at isoPath
+func locateJolietTree(isoPath string, root *jolietEntry, rockRidge bool) error {
+	d, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer d.File.Close()
+
+	d.LogicalBlocksize = isoBlockSize
+	fs, err := d.GetFilesystem(0)
+	if err != nil {
+		return err
+	}
+	return locateJolietFiles(fs, root, rockRidge)
+}
+
+// jolietName returns name as the UCS-2 big endian Joliet identifier, truncated to the longest Joliet allows
+func jolietName(name string) []byte {
+	encoded := utf16.Encode([]rune(name))
+	if len(encoded) > maxJolietNameLength {
+		encoded = encoded[:maxJolietNameLength]
+	}
+	return ucs2Bytes(encoded)
+}
+
+// findVolumeDescriptors returns the sectors of the primary volume descriptor and the set terminator in r
+func findVolumeDescriptors(r *os.File) (uint32, uint32, error) {
+	var pvd uint32
+	sector := make([]byte, isoBlockSize)
+	for i := uint32(firstVolumeDescriptor); i < firstVolumeDescriptor+maxVolumeDescriptors; i++ {
+		if _, err := r.ReadAt(sector, int64(i)*isoBlockSize); err != nil {
+			return 0, 0, err
+		}
+		if string(sector[1:6]) != "CD001" {
+			break
+		}
+		switch sector[0] {
+		case 1:
+			pvd = i
+		case 0xff:
+			if pvd == 0 {
+				return 0, 0, fmt.Errorf("iso has no primary volume descriptor")
+			}
+			return pvd, i, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("iso has no volume descriptor set terminator")
+}
+
+// insertSector moves everything in f from sector on up a sector and zeroes sector
+func insertSector(f *os.File, sector uint32) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	start := int64(sector) * isoBlockSize
+	buf := make([]byte, 1<<20)
+	// from the end so nothing is overwritten before it is moved
+	for end := info.Size(); end > start; {
+		n := int64(len(buf))
+		if end-start < n {
+			n = end - start
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], end-n+isoBlockSize); err != nil {
+			return err
+		}
+		end -= n
+	}
+	_, err = f.WriteAt(make([]byte, isoBlockSize), start)
+	return err
+}
+
+// locationShift moves the references to sectors from sector on up one, after insertSector
+type locationShift struct {
+	f      *os.File
+	sector uint32
+	// continuation areas already updated, by block and offset
+	areas map[[2]uint32]bool
+}
+
+func (s *locationShift) shift(location uint32) uint32 {
+	if location >= s.sector {
+		return location + 1
+	}
+	return location
+}
+
+// shiftBothEndian32 shifts the location stored little then big endian in b
+func (s *locationShift) shiftBothEndian32(b []byte) {
+	putBothEndian32(b, s.shift(binary.LittleEndian.Uint32(b)))
+}
+
+// shiftLocations updates every reference to a sector moved by inserting sector in the iso in f, the volume
+// descriptors up to terminator, the path tables, the directory records and their Rock Ridge entries, and the boot
+// catalog with the boot info tables of its images
+func shiftLocations(f *os.File, pvdSector, terminator, sector uint32) error {
+	s := &locationShift{f: f, sector: sector, areas: make(map[[2]uint32]bool)}
+
+	pvd := make([]byte, isoBlockSize)
+	if _, err := f.ReadAt(pvd, int64(pvdSector)*isoBlockSize); err != nil {
+		return err
+	}
+	putBothEndian32(pvd[80:88], binary.LittleEndian.Uint32(pvd[80:84])+1)
+	s.shiftBothEndian32(pvd[158:166])
+	pathTableSize := binary.LittleEndian.Uint32(pvd[132:136])
+	for _, table := range []struct {
+		offset int
+		order  binary.ByteOrder
+	}{
+		{140, binary.LittleEndian},
+		{144, binary.LittleEndian},
+		{148, binary.BigEndian},
+		{152, binary.BigEndian},
+	} {
+		location := table.order.Uint32(pvd[table.offset:])
+		if location == 0 {
+			// no optional path table
+			continue
+		}
+		location = s.shift(location)
+		table.order.PutUint32(pvd[table.offset:], location)
+		if err := s.shiftPathTable(location, pathTableSize, table.order); err != nil {
+			return err
+		}
+	}
+	if _, err := f.WriteAt(pvd, int64(pvdSector)*isoBlockSize); err != nil {
+		return err
+	}
+
+	root := pvd[156:190]
+	if err := s.shiftDir(binary.LittleEndian.Uint32(root[2:6]), binary.LittleEndian.Uint32(root[10:14])); err != nil {
+		return err
+	}
+
+	descriptor := make([]byte, isoBlockSize)
+	for i := uint32(firstVolumeDescriptor); i < terminator; i++ {
+		if _, err := f.ReadAt(descriptor, int64(i)*isoBlockSize); err != nil {
+			return err
+		}
+		if descriptor[0] != 0 || !strings.HasPrefix(string(descriptor[7:39]), elToritoSystemID) {
+			continue
+		}
+		catalog := s.shift(binary.LittleEndian.Uint32(descriptor[71:75]))
+		binary.LittleEndian.PutUint32(descriptor[71:75], catalog)
+		if _, err := f.WriteAt(descriptor, int64(i)*isoBlockSize); err != nil {
+			return err
+		}
+		if err := s.shiftBootCatalog(catalog, pvdSector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shiftPathTable updates the directory locations of the path table of size bytes at location
+func (s *locationShift) shiftPathTable(location, size uint32, order binary.ByteOrder) error {
+	table := make([]byte, size)
+	if _, err := s.f.ReadAt(table, int64(location)*isoBlockSize); err != nil {
+		return err
+	}
+	for offset := 0; offset+8 <= len(table); {
+		nameLength := int(table[offset])
+		order.PutUint32(table[offset+2:], s.shift(order.Uint32(table[offset+2:])))
+		offset += 8 + nameLength + nameLength%2
+	}
+	_, err := s.f.WriteAt(table, int64(location)*isoBlockSize)
+	return err
+}
+
+// shiftDir updates the records of the directory of size bytes at location, already moved, and the directories under it
+func (s *locationShift) shiftDir(location, size uint32) error {
+	dir := make([]byte, blocksFor(size)*isoBlockSize)
+	if _, err := s.f.ReadAt(dir, int64(location)*isoBlockSize); err != nil {
+		return err
+	}
+	type child struct{ location, size uint32 }
+	var children []child
+	var records int
+	for offset := 0; offset < len(dir); {
+		length := int(dir[offset])
+		if length == 0 {
+			// records don't cross sectors, the rest of this one is padding
+			offset = (offset/isoBlockSize + 1) * isoBlockSize
+			continue
+		}
+		record := dir[offset : offset+length]
+		s.shiftBothEndian32(record[2:10])
+		// . and .. are the directory itself and its parent
+		if records >= 2 && record[25]&dirRecordFlagDir != 0 {
+			children = append(children, child{binary.LittleEndian.Uint32(record[2:6]), binary.LittleEndian.Uint32(record[10:14])})
+		}
+		if err := s.shiftSystemUse(systemUseArea(record)); err != nil {
+			return err
+		}
+		records++
+		offset += length
+	}
+	if _, err := s.f.WriteAt(dir, int64(location)*isoBlockSize); err != nil {
+		return err
+	}
+	for _, c := range children {
+		if err := s.shiftDir(c.location, c.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shiftSystemUse updates the locations in the Rock Ridge entries of area, following continuation areas
+func (s *locationShift) shiftSystemUse(area []byte) error {
+	for offset := 0; offset+4 <= len(area); {
+		length := int(area[offset+2])
+		if length < 4 || offset+length > len(area) {
+			break
+		}
+		entry := area[offset : offset+length]
+		switch string(entry[:2]) {
+		case "CE":
+			if length < 28 {
+				break
+			}
+			s.shiftBothEndian32(entry[4:12])
+			key := [2]uint32{binary.LittleEndian.Uint32(entry[4:8]), binary.LittleEndian.Uint32(entry[12:16])}
+			if s.areas[key] {
+				break
+			}
+			s.areas[key] = true
+			continuation := make([]byte, binary.LittleEndian.Uint32(entry[20:24]))
+			at := int64(key[0])*isoBlockSize + int64(key[1])
+			if _, err := s.f.ReadAt(continuation, at); err != nil {
+				return err
+			}
+			if err := s.shiftSystemUse(continuation); err != nil {
+				return err
+			}
+			if _, err := s.f.WriteAt(continuation, at); err != nil {
+				return err
+			}
+		case "CL", "PL":
+			// relocated deep directories
+			if length >= 12 {
+				s.shiftBothEndian32(entry[4:12])
+			}
+		}
+		offset += length
+	}
+	return nil
+}
+
+// shiftBootCatalog updates the image locations in the boot catalog at location and the boot info tables of the images
+func (s *locationShift) shiftBootCatalog(location, pvdSector uint32) error {
+	catalog := make([]byte, isoBlockSize)
+	if _, err := s.f.ReadAt(catalog, int64(location)*isoBlockSize); err != nil {
+		return err
+	}
+	// the default entry follows the validation entry, then come the section headers each followed by its entries
+	entries := [][]byte{catalog[32:64]}
+	for offset := 64; offset+32 <= len(catalog); {
+		header := catalog[offset : offset+32]
+		if header[0] != elToritoSection && header[0] != elToritoFinalSection {
+			break
+		}
+		count := int(binary.LittleEndian.Uint16(header[2:4]))
+		offset += 32
+		for i := 0; i < count && offset+32 <= len(catalog); i++ {
+			entries = append(entries, catalog[offset:offset+32])
+			offset += 32
+		}
+		if header[0] == elToritoFinalSection {
+			break
+		}
+	}
+	for _, entry := range entries {
+		old := binary.LittleEndian.Uint32(entry[8:12])
+		if old == 0 {
+			continue
+		}
+		image := s.shift(old)
+		binary.LittleEndian.PutUint32(entry[8:12], image)
+		// a boot info table records the primary volume descriptor and the image's own location
+		table := make([]byte, 8)
+		if _, err := s.f.ReadAt(table, int64(image)*isoBlockSize+8); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(table[0:4]) == pvdSector && binary.LittleEndian.Uint32(table[4:8]) == old {
+			binary.LittleEndian.PutUint32(table[4:8], image)
+			if _, err := s.f.WriteAt(table, int64(image)*isoBlockSize+8); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := s.f.WriteAt(catalog, int64(location)*isoBlockSize)
+	return err
+}
+
+// systemUseArea returns the system use area of the directory record, after its name padded to an even length
+func systemUseArea(record []byte) []byte {
+	nameLength := int(record[32])
+	offset := 33 + nameLength + (nameLength+1)%2
+	if offset > len(record) {
+		return nil
+	}
+	return record[offset:]
+}
+
+// shiftJolietFiles moves the extents of the files under dir from sector on up one
+func shiftJolietFiles(dir *jolietEntry, sector uint32) {
+	for _, entry := range dir.children {
+		if entry.dir {
+			shiftJolietFiles(entry, sector)
+		} else if entry.location >= sector {
+			entry.location++
+		}
+	}
+}
+
+// jolietDirs returns the directories under root breadth first with sorted children, the order of the path table
+func jolietDirs(root *jolietEntry) []*jolietEntry {
+	dirs := []*jolietEntry{root}
+	for i := 0; i < len(dirs); i++ {
+		dirs[i].index = i + 1
+		for _, child := range dirs[i].children {
+			if child.dir {
+				dirs = append(dirs, child)
+			}
+		}
+	}
+	return dirs
+}
+
+// jolietDirSize returns the size of the extent holding the records of dir
+func jolietDirSize(dir *jolietEntry) uint32 {
+	return uint32(len(jolietDirBytes(dir)))
+}
+
+// jolietDirBytes returns the extent of dir, its records are packed into sectors without crossing them
+func jolietDirBytes(dir *jolietEntry) []byte {
+	records := [][]byte{
+		dirRecord([]byte{0}, dir.location, dir.size, dirRecordFlagDir),
+		dirRecord([]byte{1}, dir.parent.location, dir.parent.size, dirRecordFlagDir),
+	}
+	for _, child := range dir.children {
+		var flags byte
+		if child.dir {
+			flags = dirRecordFlagDir
+		}
+		records = append(records, dirRecord(child.name, child.location, child.size, flags))
+	}
+	var extent []byte
+	sectorUsed := 0
+	for _, r := range records {
+		if sectorUsed+len(r) > isoBlockSize {
+			extent = append(extent, make([]byte, isoBlockSize-sectorUsed)...)
+			sectorUsed = 0
+		}
+		extent = append(extent, r...)
+		sectorUsed += len(r)
+	}
+	return append(extent, make([]byte, isoBlockSize-sectorUsed)...)
+}
+
+// dirRecord returns an ISO 9660 directory record
+func dirRecord(name []byte, location, size uint32, flags byte) []byte {
+	length := 33 + len(name)
+	length += length % 2
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBothEndian32(r[2:10], location)
+	putBothEndian32(r[10:18], size)
+	now := time.Now().UTC()
+	copy(r[18:25], []byte{byte(now.Year() - 1900), byte(now.Month()), byte(now.Day()), byte(now.Hour()), byte(now.Minute()), byte(now.Second()), 0})
+	r[25] = flags
+	binary.LittleEndian.PutUint16(r[28:30], 1)
+	binary.BigEndian.PutUint16(r[30:32], 1)
+	r[32] = byte(len(name))
+	copy(r[33:], name)
+	return r
+}
+
+// jolietPathTables returns the little and big endian path tables of dirs
+func jolietPathTables(dirs []*jolietEntry) ([]byte, []byte) {
+	var l, m []byte
+	for _, dir := range dirs {
+		name := dir.name
+		if dir.parent == dir {
+			name = []byte{0}
+		}
+		entry := make([]byte, 8+len(name)+len(name)%2)
+		entry[0] = byte(len(name))
+		copy(entry[8:], name)
+		le := append([]byte(nil), entry...)
+		binary.LittleEndian.PutUint32(le[2:6], dir.location)
+		binary.LittleEndian.PutUint16(le[6:8], uint16(dir.parent.index))
+		binary.BigEndian.PutUint32(entry[2:6], dir.location)
+		binary.BigEndian.PutUint16(entry[6:8], uint16(dir.parent.index))
+		l = append(l, le...)
+		m = append(m, entry...)
+	}
+	return l, m
+}
+
+// ucs2Bytes returns s big endian
+func ucs2Bytes(s []uint16) []byte {
+	b := make([]byte, 2*len(s))
+	for i, c := range s {
+		binary.BigEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// fillUCS2Spaces fills b with UCS-2 spaces
+func fillUCS2Spaces(b []byte) {
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = 0, ' '
+	}
+}
+
+// putBothEndian32 writes v little endian then big endian into the 8 bytes of b
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+// blocksFor returns the iso blocks needed for size bytes
+func blocksFor(size uint32) uint32 {
+	return (size + isoBlockSize - 1) / isoBlockSize
+}
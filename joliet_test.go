@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/diskfs/go-diskfs"
+)
+
+// readSectors returns size bytes of the iso at f starting at sector
+func readSectors(t *testing.T, f *os.File, sector, size uint32) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, int64(sector)*isoBlockSize); err != nil {
+		t.Fatalf("failed to read %d bytes at sector %d: %v", size, sector, err)
+	}
+	return data
+}
+
+// findVolumeDescriptor returns the first volume descriptor of the iso at f for which match is true
+func findVolumeDescriptor(t *testing.T, f *os.File, match func(vd []byte) bool) []byte {
+	t.Helper()
+	for sector := uint32(firstVolumeDescriptor); sector < firstVolumeDescriptor+maxVolumeDescriptors; sector++ {
+		vd := readSectors(t, f, sector, isoBlockSize)
+		if vd[0] == 0xff {
+			break
+		}
+		if match(vd) {
+			return vd
+		}
+	}
+	t.Fatal("volume descriptor not found")
+	return nil
+}
+
+// jolietExtent is where a directory of the Joliet tree is in the iso
+type jolietExtent struct {
+	location uint32
+	size     uint32
+}
+
+// readJolietTree returns the files of the Joliet tree of the iso at isoPath by path along with its directories
+// the path table is checked to list the same directories at the same locations
+func readJolietTree(t *testing.T, isoPath string) (map[string]string, map[string]jolietExtent) {
+	t.Helper()
+	f, err := os.Open(isoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	svd := findVolumeDescriptor(t, f, func(vd []byte) bool {
+		return vd[0] == 2 && string(vd[88:91]) == jolietEscape
+	})
+	files := map[string]string{}
+	dirs := map[string]jolietExtent{}
+	var readDir func(p string, location, size uint32)
+	readDir = func(p string, location, size uint32) {
+		dirs[p] = jolietExtent{location, size}
+		extent := readSectors(t, f, location, size)
+		for offset := 0; offset < len(extent); {
+			length := int(extent[offset])
+			if length == 0 {
+				// records don't cross sectors, the rest of this one is padding
+				offset = (offset/isoBlockSize + 1) * isoBlockSize
+				continue
+			}
+			record := extent[offset : offset+length]
+			offset += length
+			nameLength := int(record[32])
+			name := record[33 : 33+nameLength]
+			if nameLength == 1 && name[0] <= 1 {
+				continue
+			}
+			if nameLength%2 != 0 {
+				t.Fatalf("Joliet name %x in %s is not UCS-2", name, p)
+			}
+			units := make([]uint16, nameLength/2)
+			for i := range units {
+				units[i] = binary.BigEndian.Uint16(name[2*i:])
+			}
+			child := path.Join(p, string(utf16.Decode(units)))
+			childLocation := binary.LittleEndian.Uint32(record[2:6])
+			childSize := binary.LittleEndian.Uint32(record[10:14])
+			if record[25]&dirRecordFlagDir != 0 {
+				readDir(child, childLocation, childSize)
+				continue
+			}
+			files[child] = string(readSectors(t, f, childLocation, childSize))
+		}
+	}
+	readDir("/", binary.LittleEndian.Uint32(svd[158:162]), binary.LittleEndian.Uint32(svd[166:170]))
+
+	// the little endian path table has one entry per directory, the root first
+	pathTable := readSectors(t, f, binary.LittleEndian.Uint32(svd[140:144]), binary.LittleEndian.Uint32(svd[132:136]))
+	var locations []uint32
+	for offset := 0; offset < len(pathTable); {
+		nameLength := int(pathTable[offset])
+		locations = append(locations, binary.LittleEndian.Uint32(pathTable[offset+2:offset+6]))
+		offset += 8 + nameLength + nameLength%2
+	}
+	if len(locations) != len(dirs) || locations[0] != dirs["/"].location {
+		t.Fatalf("path table has directories at %v, the tree has %v", locations, dirs)
+	}
+	for _, location := range locations {
+		found := false
+		for _, dir := range dirs {
+			found = found || dir.location == location
+		}
+		if !found {
+			t.Fatalf("path table has a directory at sector %d that isn't in the tree", location)
+		}
+	}
+	return files, dirs
+}
+
+// jolietTestFiles returns files with long and mixed case names, and a directory with enough of them to need
+// several sectors for its records
+func jolietTestFiles() map[string]string {
+	files := map[string]string{
+		"config":                        "config-data",
+		"Long-Mixed-Case-Name.Config":   "long",
+		"MixedCaseDirectory/Nested.txt": "nested",
+		"MixedCaseDirectory/sub/deeper": "deeper",
+		"résumé.txt":                    "accented",
+	}
+	for i := 0; i < 60; i++ {
+		files[fmt.Sprintf("many/File-With-A-Long-Name-%02d", i)] = fmt.Sprintf("content %d", i)
+	}
+	return files
+}
+
+func TestCreateJoliet(t *testing.T) {
+	for _, rockRidge := range []bool{true, false} {
+		t.Run(fmt.Sprintf("rock ridge %t", rockRidge), func(t *testing.T) {
+			workDir := t.TempDir()
+			files := jolietTestFiles()
+			writeTree(t, workDir, files)
+			outPath := filepath.Join(t.TempDir(), "test.iso")
+			format := isoFormat{sectorSize: diskfs.SectorSizeDefault, rockRidge: rockRidge, joliet: true}
+			if err := create(outPath, workDir, "test-volume", bootImages{}, format); err != nil {
+				t.Fatal(err)
+			}
+
+			jolietFiles, dirs := readJolietTree(t, outPath)
+			if len(jolietFiles) != len(files) {
+				t.Errorf("Joliet tree has %d files, expected %d", len(jolietFiles), len(files))
+			}
+			for name, content := range files {
+				if got, ok := jolietFiles["/"+name]; !ok {
+					t.Errorf("%s is missing from the Joliet tree", name)
+				} else if got != content {
+					t.Errorf("%s has %q in the Joliet tree, expected %q", name, got, content)
+				}
+			}
+			for _, dir := range []string{"/", "/many", "/MixedCaseDirectory", "/MixedCaseDirectory/sub"} {
+				if _, ok := dirs[dir]; !ok {
+					t.Errorf("directory %s is missing from the Joliet tree", dir)
+				}
+			}
+			if size := dirs["/many"].size; size <= isoBlockSize {
+				t.Fatalf("records of /many fit in %d bytes, they don't test directories spanning sectors", size)
+			}
+
+			// the primary tree is still readable after being moved up for the Joliet volume descriptor
+			fs := openISO(t, outPath)
+			p := "/" + isoName("Long-Mixed-Case-Name.Config", false)
+			if rockRidge {
+				p = "/Long-Mixed-Case-Name.Config"
+			}
+			if got := readISOFile(t, fs, p); got != "long" {
+				t.Fatalf("primary tree has %q for %s, expected %q", got, p, "long")
+			}
+		})
+	}
+}
+
+func TestCreateJolietElTorito(t *testing.T) {
+	workDir := t.TempDir()
+	// longer than the sectors the BIOS entry loads, with a boot info table that must follow the loader as it moves
+	bios := bytes.Repeat([]byte("isolinux"), 1024)
+	efi := bytes.Repeat([]byte("efi-boot"), 512)
+	writeTree(t, workDir, map[string]string{
+		"isolinux/isolinux.bin": string(bios),
+		"EFI/efiboot.img":       string(efi),
+		"Long-Mixed-Case-Name":  "long",
+	})
+	outPath := filepath.Join(t.TempDir(), "test.iso")
+	format := isoFormat{sectorSize: diskfs.SectorSizeDefault, rockRidge: true, joliet: true}
+	if err := create(outPath, workDir, "test", bootImages{bios: "isolinux/isolinux.bin", efi: "EFI/efiboot.img"}, format); err != nil {
+		t.Fatal(err)
+	}
+
+	jolietFiles, _ := readJolietTree(t, outPath)
+	if jolietFiles["/Long-Mixed-Case-Name"] != "long" {
+		t.Fatalf("Joliet tree has %q for Long-Mixed-Case-Name", jolietFiles["/Long-Mixed-Case-Name"])
+	}
+
+	f, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	bootRecord := findVolumeDescriptor(t, f, func(vd []byte) bool {
+		return vd[0] == 0 && bytes.HasPrefix(vd[7:], []byte("EL TORITO SPECIFICATION"))
+	})
+	catalog := readSectors(t, f, binary.LittleEndian.Uint32(bootRecord[71:75]), isoBlockSize)
+	if catalog[0] != 1 || catalog[30] != 0x55 || catalog[31] != 0xaa {
+		t.Fatalf("boot catalog has no validation entry: %x", catalog[:32])
+	}
+	pvdSector, _, err := findVolumeDescriptors(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the default entry boots the BIOS loader and the EFI image follows in a section
+	biosLocation := binary.LittleEndian.Uint32(catalog[40:44])
+	loaded := readSectors(t, f, biosLocation, uint32(len(bios)))
+	if !bytes.Equal(loaded[:bootInfoTableStart], bios[:bootInfoTableStart]) || !bytes.Equal(loaded[bootInfoTableEnd:], bios[bootInfoTableEnd:]) {
+		t.Fatal("BIOS boot entry doesn't point at the BIOS loader")
+	}
+	if got := binary.LittleEndian.Uint32(loaded[8:12]); got != pvdSector {
+		t.Fatalf("boot info table has the primary volume descriptor at %d, expected %d", got, pvdSector)
+	}
+	if got := binary.LittleEndian.Uint32(loaded[12:16]); got != biosLocation {
+		t.Fatalf("boot info table has the loader at %d, expected %d", got, biosLocation)
+	}
+	if catalog[64] != elToritoFinalSection && catalog[64] != elToritoSection {
+		t.Fatalf("boot catalog has no section header for the EFI image: %x", catalog[64:96])
+	}
+	efiLocation := binary.LittleEndian.Uint32(catalog[104:108])
+	if got := readSectors(t, f, efiLocation, uint32(len(efi))); !bytes.Equal(got, efi) {
+		t.Fatal("EFI boot entry doesn't point at the EFI image")
+	}
+}
+
+func TestJolietIDsRejectTruncatedCollisions(t *testing.T) {
+	prefix := strings.Repeat("a", maxJolietNameLength)
+	ids := jolietIDs{}
+	for _, name := range []string{prefix, prefix[1:] + "b", "résumé"} {
+		if err := ids.add("/dir", name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	// the same as prefix once cut to the Joliet length
+	err := ids.add("/dir", prefix+"-longer")
+	if err == nil || !strings.Contains(err.Error(), "/dir/"+prefix+" and /dir/"+prefix+"-longer") {
+		t.Fatalf("expected names sharing a Joliet identifier to be rejected, got %v", err)
+	}
+}
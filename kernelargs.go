@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bootloaderConfigs are the names of the isolinux and GRUB configs kernel arguments are appended in
+var bootloaderConfigs = map[string]bool{
+	"isolinux.cfg": true,
+	"syslinux.cfg": true,
+	"grub.cfg":     true,
+}
+
+// kernelLinePrefixes start the config lines that boot a kernel, isolinux append lines and GRUB linux commands
+var kernelLinePrefixes = []string{"append", "linux", "linuxefi", "linux16"}
+
+// appendKernelArgs appends args to every kernel command line in the bootloader configs under workDir
+// arguments a line already has are not added again, so configs that were customized before are left as they are
+// it is an error if there is no kernel command line to append to
+func appendKernelArgs(workDir string, args []string) error {
+	var lines int
+	err := filepath.WalkDir(workDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !bootloaderConfigs[strings.ToLower(d.Name())] {
+			return nil
+		}
+		n, err := appendKernelArgsToFile(p, args)
+		if err != nil {
+			return fmt.Errorf("failed to append kernel arguments to %s: %w", strings.TrimPrefix(p, workDir), err)
+		}
+		lines += n
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if lines == 0 {
+		return fmt.Errorf("no isolinux or GRUB kernel command line found to append kernel arguments to")
+	}
+	return nil
+}
+
+// appendKernelArgsToFile appends args to the kernel command lines of the config at path and returns how many there are
+func appendKernelArgsToFile(path string, args []string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(string(data), "\n")
+	var n int
+	for i, line := range lines {
+		// keep CRLF line endings of configs written on windows
+		content := strings.TrimRight(line, "\r")
+		fields := strings.Fields(content)
+		if len(fields) == 0 || !isKernelLine(fields[0]) {
+			continue
+		}
+		n++
+		present := make(map[string]bool, len(fields))
+		for _, f := range fields[1:] {
+			present[f] = true
+		}
+		for _, arg := range args {
+			if !present[arg] {
+				content += " " + arg
+				present[arg] = true
+			}
+		}
+		lines[i] = content + line[len(strings.TrimRight(line, "\r")):]
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+// isKernelLine returns true if a config line starting with keyword boots a kernel, isolinux keywords are case insensitive
+func isKernelLine(keyword string) bool {
+	for _, prefix := range kernelLinePrefixes {
+		if strings.EqualFold(keyword, prefix) {
+			return true
+		}
+	}
+	return false
+}
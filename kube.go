@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kubeSourcePrefix marks a source listing ConfigMaps and Secrets whose keys are packaged into the iso as files,
+// such as kube://configmap/iso-content,secret/iso-certs
+const kubeSourcePrefix = "kube://"
+
+const (
+	kubeRequestTimeout = 30 * time.Second
+	// how long the API server keeps a watch open before ending it, it is then reopened from where it left off
+	kubeWatchTimeout = 5 * time.Minute
+	kubeConfigMap    = "configmap"
+	kubeSecret       = "secret"
+)
+
+// where the token, CA, and namespace of the pod's service account are mounted
+var kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// errKubeWatchExpired is returned by a watch when the API server no longer has the resource version it started from
+var errKubeWatchExpired = errors.New("resource version of the watch is too old")
+
+var (
+	kubeObjectName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+	kubeDataKey    = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+)
+
+// isKubeSource returns true if source lists ConfigMaps and Secrets
+func isKubeSource(source string) bool {
+	return strings.HasPrefix(source, kubeSourcePrefix)
+}
+
+// kubeObject is a ConfigMap or Secret of a kube source
+type kubeObject struct {
+	kind string
+	name string
+}
+
+func (o kubeObject) String() string {
+	return o.kind + "/" + o.name
+}
+
+// parseKubeSource returns the objects listed by source, a comma separated list of configmap/<name> and secret/<name>
+func parseKubeSource(source string) ([]kubeObject, error) {
+	var objects []kubeObject
+	for _, item := range strings.Split(strings.TrimPrefix(source, kubeSourcePrefix), ",") {
+		kind, name, _ := strings.Cut(strings.TrimSpace(item), "/")
+		if kind != kubeConfigMap && kind != kubeSecret {
+			return nil, fmt.Errorf("invalid kube source %s, %q must be configmap/<name> or secret/<name>", source, item)
+		}
+		if !kubeObjectName.MatchString(name) {
+			return nil, fmt.Errorf("invalid kube source %s, %q is not a valid %s name", source, name, kind)
+		}
+		objects = append(objects, kubeObject{kind: kind, name: name})
+	}
+	return objects, nil
+}
+
+// kubeClient reads ConfigMaps and Secrets of a namespace from the API server
+type kubeClient struct {
+	apiURL    string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+// newInClusterKubeClient returns a client of the API server of the cluster the pod runs in, authenticated as its
+// service account, for namespace or the namespace of the pod if that is empty
+// the token is read again for every client as the kubelet rotates it
+func newInClusterKubeClient(namespace string) (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kube sources need the in-cluster API, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	token, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in the service account CA")
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &kubeClient{
+		apiURL:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: namespace,
+		client: &http.Client{
+			Timeout:   kubeRequestTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// kubeObjectData is the part of a ConfigMap or Secret the iso is built from
+// the data of a Secret and the binaryData of a ConfigMap are base64 encoded
+type kubeObjectData struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData"`
+}
+
+// get returns the object from the namespace of the client
+func (c *kubeClient) get(obj kubeObject) (*kubeObjectData, error) {
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/%ss/%s", c.apiURL, url.PathEscape(c.namespace), obj.kind, url.PathEscape(obj.name))
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", obj, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get %s in namespace %s: %s", obj, c.namespace, resp.Status)
+	}
+	var data kubeObjectData
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", obj, err)
+	}
+	return &data, nil
+}
+
+// files returns the keys of the object with their decoded values
+func (d *kubeObjectData) files(obj kubeObject) (map[string][]byte, error) {
+	files := make(map[string][]byte, len(d.Data)+len(d.BinaryData))
+	for key, value := range d.Data {
+		if obj.kind != kubeSecret {
+			files[key] = []byte(value)
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %s of %s: %w", key, obj, err)
+		}
+		files[key] = decoded
+	}
+	for key, value := range d.BinaryData {
+		files[key] = value
+	}
+	for key := range files {
+		if !kubeDataKey.MatchString(key) || key == "." || key == ".." {
+			return nil, fmt.Errorf("key %q of %s is not a valid file name", key, obj)
+		}
+	}
+	return files, nil
+}
+
+// fetchKubeSource writes the keys of the ConfigMaps and Secrets of source as files of a temp dir under dataDir and
+// returns its path, the caller removes it, with the resource version each object was read at
+// objects are read from namespace, the pod's namespace if empty, and a key may only be in one of them
+func fetchKubeSource(source, dataDir, namespace string) (string, map[kubeObject]string, error) {
+	objects, err := parseKubeSource(source)
+	if err != nil {
+		return "", nil, err
+	}
+	client, err := newInClusterKubeClient(namespace)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := os.MkdirTemp(dataDir, "kube-source-")
+	if err != nil {
+		return "", nil, err
+	}
+	versions, err := writeKubeObjects(client, objects, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, versions, nil
+}
+
+// writeKubeObjects writes the keys of objects as files of dir and returns the resource version of each object
+func writeKubeObjects(client *kubeClient, objects []kubeObject, dir string) (map[kubeObject]string, error) {
+	owners := make(map[string]kubeObject)
+	versions := make(map[kubeObject]string, len(objects))
+	for _, obj := range objects {
+		data, err := client.get(obj)
+		if err != nil {
+			return nil, err
+		}
+		files, err := data.files(obj)
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range files {
+			if other, ok := owners[name]; ok {
+				return nil, fmt.Errorf("key %s is in both %s and %s", name, other, obj)
+			}
+			owners[name] = obj
+			if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+				return nil, err
+			}
+		}
+		versions[obj] = data.Metadata.ResourceVersion
+	}
+	return versions, nil
+}
+
+// kubeSources returns the distinct kube sources of the test iso and the configured isos
+func (b *testISOBuilder) kubeSources() []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, source := range append([]string{b.source}, isoSources(b.isos)...) {
+		if isKubeSource(source) && !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// kubeVersion returns the resource version obj was read at by the last build, empty if it wasn't read
+func (b *testISOBuilder) kubeVersion(obj kubeObject) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.kubeVersions[obj]
+}
+
+// isoSources returns the source of each of defs
+func isoSources(defs []isoDefinition) []string {
+	sources := make([]string, 0, len(defs))
+	for _, def := range defs {
+		sources = append(sources, def.source)
+	}
+	return sources
+}
+
+// kubeWatchEvent is a change to an object sent by a watch, object is a Status for errors
+type kubeWatchEvent struct {
+	Type   string `json:"type"`
+	Object struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"object"`
+}
+
+// watch follows obj from version until the API server ends the watch or ctx is done, calling changed whenever its
+// resource version moves on, and returns the last version seen so the watch can be reopened from it
+// errKubeWatchExpired is returned once version is too old for the API server to watch from
+func (c *kubeClient) watch(ctx context.Context, obj kubeObject, version string, changed func()) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"fieldSelector":       {"metadata.name=" + obj.name},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(kubeWatchTimeout.Seconds()))},
+	}
+	u := fmt.Sprintf("%s/api/v1/namespaces/%s/%ss?%s", c.apiURL, url.PathEscape(c.namespace), obj.kind, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return version, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	// the watch stays open for kubeWatchTimeout, longer than requests are otherwise allowed to take
+	client := &http.Client{Transport: c.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return version, fmt.Errorf("failed to watch %s: %w", obj, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return version, errKubeWatchExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		return version, fmt.Errorf("failed to watch %s in namespace %s: %s", obj, c.namespace, resp.Status)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubeWatchEvent
+		if err := decoder.Decode(&event); err == io.EOF || ctx.Err() != nil {
+			return version, nil
+		} else if err != nil {
+			return version, fmt.Errorf("failed to read watch of %s: %w", obj, err)
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			if v := event.Object.Metadata.ResourceVersion; v != version {
+				version = v
+				changed()
+			}
+		case "BOOKMARK":
+			version = event.Object.Metadata.ResourceVersion
+		case "ERROR":
+			if event.Object.Code == http.StatusGone {
+				return version, errKubeWatchExpired
+			}
+			return version, fmt.Errorf("watch of %s failed: %s", obj, event.Object.Message)
+		}
+	}
+}
+
+// watchKubeObject sends on changed whenever obj moves on from version, until ctx is done
+// the watch is reopened from the last version seen when the API server ends it, after interval if it failed, and
+// the object is read again when the API server no longer has that version, or if version is empty
+func watchKubeObject(ctx context.Context, log *logrus.Logger, obj kubeObject, namespace, version string, interval time.Duration, changed chan<- struct{}) {
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	for ctx.Err() == nil {
+		// the client is made again each time as the kubelet rotates the token
+		client, err := newInClusterKubeClient(namespace)
+		if err == nil && version == "" {
+			err = errKubeWatchExpired
+		}
+		if err == nil {
+			version, err = client.watch(ctx, obj, version, notify)
+		}
+		if errors.Is(err, errKubeWatchExpired) {
+			var data *kubeObjectData
+			if data, err = client.get(obj); err == nil {
+				if data.Metadata.ResourceVersion != version {
+					version = data.Metadata.ResourceVersion
+					notify()
+				}
+				continue
+			}
+		}
+		if err == nil {
+			continue
+		}
+		log.WithError(err).Warnf("failed to watch kube object %s, retrying in %s", obj, interval)
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchKubeSources rebuilds the isos with builder whenever an object of its kube sources changes until ctx is done
+// watches that fail are retried after interval, and so is a rebuild that fails
+func watchKubeSources(ctx context.Context, log *logrus.Logger, builder *testISOBuilder, namespace string, interval time.Duration) {
+	// a change while a rebuild is running is kept so the isos are rebuilt again with it
+	changed := make(chan struct{}, 1)
+	watched := make(map[kubeObject]bool)
+	for _, source := range builder.kubeSources() {
+		objects, err := parseKubeSource(source)
+		if err != nil {
+			log.WithError(err).Warnf("not watching kube source %s", source)
+			continue
+		}
+		for _, obj := range objects {
+			if watched[obj] {
+				continue
+			}
+			watched[obj] = true
+			// the version the isos were built from, so a change made since the build was read is seen by the watch,
+			// or empty to rebuild once it can be read when the build failed
+			go watchKubeObject(ctx, log, obj, namespace, builder.kubeVersion(obj), interval, changed)
+		}
+	}
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-retry:
+		}
+		retry = nil
+		checksum, err := builder.build()
+		if err != nil {
+			log.WithError(err).Errorf("failed to rebuild iso after its kube source changed, retrying in %s", interval)
+			retry = time.After(interval)
+			continue
+		}
+		log.Infof("rebuilt iso %s with sha256 %s after its kube source changed", builder.isoPath, checksum)
+	}
+}
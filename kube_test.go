@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveKubeAPI serves handler as the in-cluster API server, with a service account for namespace isos whose token
+// is kube-token
+func serveKubeAPI(t *testing.T, handler http.Handler) {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kube-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	writeTree(t, dir, map[string]string{"token": "kube-token\n", "ca.crt": string(ca), "namespace": "isos"})
+	saved := kubeServiceAccountDir
+	kubeServiceAccountDir = dir
+	t.Cleanup(func() { kubeServiceAccountDir = saved })
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(server.URL, "https://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+}
+
+// kubeObjects serves the objects of namespace isos keyed by their API path under it, such as configmaps/content
+type kubeObjects map[string]interface{}
+
+func (o kubeObjects) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	obj, ok := o[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/isos/")]
+	if !ok || r.URL.Query().Get("watch") != "" {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(obj)
+}
+
+func TestFetchKubeSource(t *testing.T) {
+	serveKubeAPI(t, kubeObjects{
+		"configmaps/content": map[string]interface{}{
+			"metadata":   map[string]string{"resourceVersion": "7"},
+			"data":       map[string]string{"config": "config-data"},
+			"binaryData": map[string]string{"binary": "AAEC"},
+		},
+		"secrets/certs": map[string]interface{}{
+			"metadata": map[string]string{"resourceVersion": "9"},
+			"data":     map[string]string{"tls.crt": "Y2VydA=="},
+		},
+		"configmaps/clash": map[string]interface{}{
+			"data": map[string]string{"config": "other"},
+		},
+		"configmaps/escape": map[string]interface{}{
+			"data": map[string]string{"..": "x"},
+		},
+	})
+
+	dir, versions, err := fetchKubeSource(kubeSourcePrefix+"configmap/content,secret/certs", t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the watches start from the versions the build read
+	for obj, version := range map[kubeObject]string{{kind: kubeConfigMap, name: "content"}: "7", {kind: kubeSecret, name: "certs"}: "9"} {
+		if versions[obj] != version {
+			t.Errorf("%s was read at version %q, expected %q", obj, versions[obj], version)
+		}
+	}
+	for name, content := range map[string]string{"config": "config-data", "binary": "\x00\x01\x02", "tls.crt": "cert"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s has %q, expected %q", name, data, content)
+		}
+	}
+
+	for source, expected := range map[string]string{
+		"configmap/content,configmap/clash": "is in both",
+		"configmap/escape":                  "not a valid file name",
+		"configmap/missing":                 "404",
+	} {
+		dataDir := t.TempDir()
+		if _, _, err := fetchKubeSource(kubeSourcePrefix+source, dataDir, ""); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", source, expected, err)
+		}
+		if entries, _ := os.ReadDir(dataDir); len(entries) != 0 {
+			t.Errorf("%s: failed fetch left %d entries in the data dir", source, len(entries))
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(kubeServiceAccountDir, "token"), []byte("rotated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchKubeSource(kubeSourcePrefix+"configmap/content", t.TempDir(), ""); err == nil {
+		t.Error("expected a token the API server doesn't accept to fail")
+	}
+}
+
+// kubeWatchStep is how the fake API server answers one watch request of the object
+type kubeWatchStep struct {
+	// resource version the watch is expected to start from
+	from   string
+	events []string
+	status int
+	// keeps the watch open until the client goes away
+	hold bool
+}
+
+func TestWatchKubeObjectReconnects(t *testing.T) {
+	var mu sync.Mutex
+	steps := []kubeWatchStep{
+		// ended by the API server after a bookmark, reopened from it
+		{from: "1", events: []string{`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"2"}}}`}},
+		{from: "2", events: []string{`{"type":"MODIFIED","object":{"metadata":{"resourceVersion":"3"}}}`}},
+		// the version is gone so the object is read again, it changed in between
+		{from: "3", events: []string{`{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version"}}`}},
+		// failed watches are retried from the same version
+		{from: "5", status: http.StatusInternalServerError},
+		{from: "5", hold: true},
+	}
+	var froms []string
+	held := make(chan struct{})
+	serveKubeAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/namespaces/isos/configmaps/content" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"metadata": map[string]string{"resourceVersion": "5"}})
+			return
+		}
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v1/namespaces/isos/configmaps" || query.Get("watch") == "" || query.Get("fieldSelector") != "metadata.name=content" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		if len(steps) == 0 {
+			mu.Unlock()
+			t.Errorf("unexpected watch from %s", query.Get("resourceVersion"))
+			http.Error(w, "no more watches", http.StatusInternalServerError)
+			return
+		}
+		step := steps[0]
+		steps = steps[1:]
+		froms = append(froms, query.Get("resourceVersion"))
+		mu.Unlock()
+
+		if step.status != 0 {
+			http.Error(w, "failed", step.status)
+			return
+		}
+		for _, event := range step.events {
+			w.Write([]byte(event + "\n"))
+		}
+		w.(http.Flusher).Flush()
+		if step.hold {
+			close(held)
+			<-r.Context().Done()
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changed := make(chan struct{}, 10)
+	done := make(chan struct{})
+	go func() {
+		watchKubeObject(ctx, discardLog().Logger, kubeObject{kind: kubeConfigMap, name: "content"}, "", "1", 10*time.Millisecond, changed)
+		close(done)
+	}()
+
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch was not reopened after it ended")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not stop once its context was done")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(froms, ","); got != "1,2,3,5,5" {
+		t.Errorf("watches started from versions %s, expected 1,2,3,5,5", got)
+	}
+	if len(changed) != 2 {
+		t.Errorf("expected the modification and the change found on reading it again, got %d changes", len(changed))
+	}
+}
@@ -2,47 +2,268 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/diskfs/go-diskfs"
-	"github.com/diskfs/go-diskfs/disk"
-	"github.com/diskfs/go-diskfs/filesystem"
-	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+	"github.com/google/uuid"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sirupsen/logrus"
-	"github.com/stmcginnis/gofish"
-	"github.com/stmcginnis/gofish/redfish"
 )
 
 var Options struct {
-	DataDir       string `envconfig:"DATA_DIR"`
-	LogLevel      string `envconfig:"LOG_LEVEL" default:"info"`
-	Port          string `envconfig:"PORT" default:"8080"`
-	BaseURL       string `envconfig:"BASE_URL"`
-	HTTPSKeyFile  string `envconfig:"HTTPS_KEY_FILE"`
-	HTTPSCertFile string `envconfig:"HTTPS_CERT_FILE"`
+	DataDir            string        `envconfig:"DATA_DIR"`
+	LogLevel           string        `envconfig:"LOG_LEVEL" default:"info"`
+	LogReportCaller    bool          `envconfig:"LOG_REPORT_CALLER" default:"true"`
+	Port               string        `envconfig:"PORT" default:"8080"`
+	BindAddress        string        `envconfig:"BIND_ADDRESS"`
+	BaseURL            string        `envconfig:"BASE_URL"`
+	HTTPSKeyFile       string        `envconfig:"HTTPS_KEY_FILE"`
+	HTTPSCertFile      string        `envconfig:"HTTPS_CERT_FILE"`
+	ServerReadyTimeout time.Duration `envconfig:"SERVER_READY_TIMEOUT" default:"30s"`
+	// additional directories served under /images/ after the created isos, the first dir containing a name wins
+	ISODirs []string `envconfig:"ISO_DIRS"`
+	// maximum bytes per second sent on each iso download, unlimited when unset
+	DownloadRateLimit int64 `envconfig:"DOWNLOAD_RATE_LIMIT"`
+	// downloads served at once, further requests get 503 until one finishes, unlimited when unset
+	MaxConcurrentDownloads int `envconfig:"MAX_CONCURRENT_DOWNLOADS"`
+	// Content-Type sent with .iso downloads
+	ISOContentType string `envconfig:"ISO_CONTENT_TYPE" default:"application/octet-stream"`
+	// how long a created iso is served before it is removed, zero disables expiry
+	// the deadlines are kept in DATA_DIR so isos left from a previous run still expire
+	ISOTTL time.Duration `envconfig:"ISO_TTL"`
+	// sign every built iso and USB image, and the isos created through the API, with gpg using the secret key
+	// GPGSigningKey, a key ID, fingerprint, or user ID, of the keyring in GPGHome or the default one, and serve the
+	// detached signature next to each as <name>.sig, uploaded isos are not signed
+	// GPGPassphraseFile holds the passphrase of the key if it has one
+	GPGSigningKey     string `envconfig:"GPG_SIGNING_KEY"`
+	GPGHome           string `envconfig:"GPG_HOME"`
+	GPGPassphraseFile string `envconfig:"GPG_PASSPHRASE_FILE"`
+	// directory, tarball, or zip whose contents are packaged into the iso, *.tmpl files are rendered with TemplateVars
+	// on top of the values in TemplateVarsFile and the builtin BaseURL, BMCAddress, Hostname, and SSHAuthorizedKeys
+	// an http or https URL of a tarball, zip, or git archive is downloaded on every build, and must have SourceSHA256
+	// as its hex sha256 when that is set, an oci:// image reference such as oci://quay.io/org/bundle:v1 is pulled
+	// and its filesystem packaged, with SourceRegistryUser and SourceRegistryPassword for a private registry
+	// a kube:// list of ConfigMaps and Secrets such as kube://configmap/iso-content,secret/iso-certs is read through
+	// the in-cluster API from SourceKubeNamespace, or the namespace of the pod, each key becoming a file, and the isos
+	// are rebuilt when the objects change if SourceKubeWatch is set, failed watches and rebuilds being retried after
+	// SourceKubeRetryInterval, as changes are watched for rather than polled
+	// symlinks in the source are replaced by the regular files they point to within it, other symlinks are left out
+	Source                  string        `envconfig:"SOURCE"`
+	SourceSHA256            string        `envconfig:"SOURCE_SHA256"`
+	SourceRegistryUser      string        `envconfig:"SOURCE_REGISTRY_USER"`
+	SourceRegistryPassword  string        `envconfig:"SOURCE_REGISTRY_PASSWORD"`
+	SourceKubeNamespace     string        `envconfig:"SOURCE_KUBE_NAMESPACE"`
+	SourceKubeWatch         bool          `envconfig:"SOURCE_KUBE_WATCH" default:"true"`
+	SourceKubeRetryInterval time.Duration `envconfig:"SOURCE_KUBE_RETRY_INTERVAL" default:"30s"`
+	// directory of the source packaged into the iso, such as a sub-path of an OCI image filesystem, all of it when unset
+	SourcePath       string            `envconfig:"SOURCE_PATH"`
+	TemplateVars     map[string]string `envconfig:"TEMPLATE_VARS"`
+	TemplateVarsFile string            `envconfig:"TEMPLATE_VARS_FILE"`
+	// comma separated names of the environment variables templates may read with env, no others are readable as
+	// templates may come from remote sources and the isos are served without authentication
+	TemplateEnv []string `envconfig:"TEMPLATE_ENV"`
+	// template vars read from the secrets of the Vault server at VaultAddress on every build, overriding the others,
+	// as name:path#field such as RootPassword:secret/data/iso#root, the path being the API path of the secret under
+	// /v1, KV version 2 secrets are unwrapped
+	// authenticated with VaultToken, the token in VaultTokenFile, or the pod's service account as VaultKubernetesRole
+	// of the Kubernetes auth method mounted at VaultKubernetesMount
+	VaultSecrets         map[string]string `envconfig:"VAULT_SECRETS"`
+	VaultAddress         string            `envconfig:"VAULT_ADDR"`
+	VaultToken           string            `envconfig:"VAULT_TOKEN"`
+	VaultTokenFile       string            `envconfig:"VAULT_TOKEN_FILE"`
+	VaultKubernetesRole  string            `envconfig:"VAULT_KUBERNETES_ROLE"`
+	VaultKubernetesMount string            `envconfig:"VAULT_KUBERNETES_MOUNT" default:"kubernetes"`
+	// PEM bundle of CAs trusted for the Vault certificate in addition to the system roots
+	VaultCACertFile string `envconfig:"VAULT_CACERT"`
+	// directory tree packaged into the iso, the same as a directory SOURCE, only one of the two may be set
+	ContentDir string `envconfig:"CONTENT_DIR"`
+	// YAML or JSON file listing further isos, each with a name, label, source, and template vars, built with the
+	// test iso and served under /images/
+	ISOConfigFile string `envconfig:"ISO_CONFIG_FILE"`
+	// existing iso whose contents are extracted and overlaid with Source, its volume label and the boot images in
+	// its boot catalog are kept unless set otherwise
+	BaseISO string `envconfig:"BASE_ISO"`
+	// path inside the iso to write a manifest of its contents to, no manifest is written when unset
+	ISOManifestPath   string `envconfig:"ISO_MANIFEST_PATH"`
+	ISOManifestFormat string `envconfig:"ISO_MANIFEST_FORMAT" default:"json"`
+	// paths inside the iso of El Torito boot images, set both for an iso that boots with BIOS or UEFI
+	// an iso with an EFI image gets a partition table making it an EFI system partition, so it also boots with UEFI
+	// written to a USB stick, BIOS firmware only boots it as a CD
+	BIOSBootImage string `envconfig:"BIOS_BOOT_IMAGE"`
+	EFIBootImage  string `envconfig:"EFI_BOOT_IMAGE"`
+	// directory in the iso, usually EFI, packed into a generated EFI system partition image to boot with UEFI
+	// firmware when there is no prebuilt EFIBootImage, only one of the two may be set
+	EFIBootDir string `envconfig:"EFI_BOOT_DIR"`
+	// sector size of the iso image in bytes, 512 or 4096, defaults to the diskfs default
+	SectorSize int `envconfig:"SECTOR_SIZE"`
+	// add Joliet extensions alongside Rock Ridge for tools that read long names the Windows way
+	Joliet bool `envconfig:"JOLIET"`
+	// Rock Ridge keeps the names, permissions, and symlinks of the content, without it only ISO9660 names are written
+	RockRidge bool `envconfig:"ROCK_RIDGE" default:"true"`
+	// allow directories nested deeper than the 8 levels of ISO9660 as they are, rather than Rock Ridge relocating them
+	DeepDirectories bool `envconfig:"DEEP_DIRECTORIES"`
+	// write the trigger file for an automated installer, kickstart or coreos-installer, populated from InstallerParams
+	InstallerType   string          `envconfig:"INSTALLER_TYPE"`
+	InstallerParams installerParams `envconfig:"INSTALLER_PARAMS"`
+	// space separated arguments appended to the kernel command lines of the isolinux and GRUB configs in the iso,
+	// such as console settings or an inst.ks URL, for customizing a bootable BaseISO
+	KernelArgs string `envconfig:"KERNEL_ARGS"`
+	// comma separated SSH public keys, followed by those in the authorized_keys file SSHAuthorizedKeysFile, written
+	// to ssh/authorized_keys in the iso, into the public keys of nocloud and configdrive seeds, for root with
+	// the kickstart installer, and for the core user of a coreos Ignition config
+	// templates get them as SSHAuthorizedKeys, one per line
+	SSHAuthorizedKeys     []string `envconfig:"SSH_AUTHORIZED_KEYS"`
+	SSHAuthorizedKeysFile string   `envconfig:"SSH_AUTHORIZED_KEYS_FILE"`
+	// test builds the test iso, nocloud a cloud-init NoCloud seed labelled cidata whose user-data, meta-data, and
+	// network-config are taken from the NoCloud files if set, otherwise from Source, meta-data is generated if missing
+	// configdrive an OpenStack config drive labelled config-2 with openstack/latest/user_data, meta_data.json, and
+	// network_data.json taken the same way from the config drive files
+	ISOMode                    string `envconfig:"ISO_MODE" default:"test"`
+	NoCloudUserDataFile        string `envconfig:"NOCLOUD_USER_DATA_FILE"`
+	NoCloudMetaDataFile        string `envconfig:"NOCLOUD_META_DATA_FILE"`
+	NoCloudNetworkConfigFile   string `envconfig:"NOCLOUD_NETWORK_CONFIG_FILE"`
+	ConfigDriveUserDataFile    string `envconfig:"CONFIG_DRIVE_USER_DATA_FILE"`
+	ConfigDriveMetaDataFile    string `envconfig:"CONFIG_DRIVE_META_DATA_FILE"`
+	ConfigDriveNetworkDataFile string `envconfig:"CONFIG_DRIVE_NETWORK_DATA_FILE"`
+	// coreos embeds the Ignition config in CoreOSIgnitionFile into the CoreOS live iso in BaseISO, which is
+	// otherwise served unchanged
+	CoreOSIgnitionFile string `envconfig:"COREOS_IGNITION_FILE"`
+	// bearer token required by the API endpoints, the API is disabled when unset
+	APIToken string `envconfig:"API_TOKEN"`
+	// largest iso in bytes accepted by PUT /images/<name>, and largest archive by POST /api/isos/from-archive
+	MaxUploadSize int64 `envconfig:"MAX_UPLOAD_SIZE" default:"10737418240"`
 
 	BMCAddress  string `envconfig:"BMC_ADDRESS"`
 	BMCPassword string `envconfig:"BMC_PASSWORD"`
 	BMCUser     string `envconfig:"BMC_USER"`
+	// files holding the BMC credentials, such as mounted secrets, used instead of BMC_USER and BMC_PASSWORD
+	// they are read again by every BMC operation, so a rotated password is used from the next one on
+	BMCUserFile     string `envconfig:"BMC_USER_FILE"`
+	BMCPasswordFile string `envconfig:"BMC_PASSWORD_FILE"`
+	// YAML or JSON file listing BMCs to test in addition to BMC_ADDRESS
+	BMCConfigFile string `envconfig:"BMC_CONFIG_FILE"`
+	// build an iso for each host in BMC_CONFIG_FILE rendered with its hostname, BMC address, and template vars, with
+	// its network config embedded, and insert it rather than the shared test iso
+	PerHostISOs bool `envconfig:"PER_HOST_ISOS"`
+	// PEM bundle of CAs trusted for BMC certificates in addition to the system roots
+	BMCCACertFile string `envconfig:"BMC_CA_CERT_FILE"`
+	// skip verification of BMC certificates
+	BMCInsecureTLS bool `envconfig:"BMC_INSECURE_TLS"`
+	// authenticate with a redfish session token rather than basic auth on every request
+	BMCSessionAuth bool `envconfig:"BMC_SESSION_AUTH"`
+	// times a transient failure of an insert, eject, or reset is retried, with exponential backoff between attempts
+	BMCRetries         int           `envconfig:"BMC_RETRIES"`
+	BMCRetryBackoff    time.Duration `envconfig:"BMC_RETRY_BACKOFF" default:"1s"`
+	BMCRetryMaxBackoff time.Duration `envconfig:"BMC_RETRY_MAX_BACKOFF" default:"30s"`
+	// how long to follow the task a BMC starts for an asynchronous insert or eject
+	BMCTaskTimeout time.Duration `envconfig:"BMC_TASK_TIMEOUT" default:"5m"`
+	// BMCs tested at once
+	BMCWorkers int `envconfig:"BMC_WORKERS" default:"1"`
+	// idle connections kept open for reuse by the BMC http client
+	BMCMaxIdleConns int `envconfig:"BMC_MAX_IDLE_CONNS" default:"10"`
+	// limit on each request to a BMC including reading the response, so a hung BMC fails the test, zero means no limit
+	BMCHTTPTimeout time.Duration `envconfig:"BMC_HTTP_TIMEOUT" default:"2m"`
+	// limit on establishing a connection to a BMC, each of the TCP connect and the TLS handshake
+	BMCConnectTimeout time.Duration `envconfig:"BMC_CONNECT_TIMEOUT" default:"10s"`
+	// file every insert, eject, reset, and boot override change made on a BMC is appended to as a JSON line
+	AuditLogFile string `envconfig:"AUDIT_LOG_FILE"`
+	// log the raw redfish requests and responses at debug level
+	BMCDump bool `envconfig:"BMC_DUMP"`
+	// User-Agent sent with every BMC request, defaults to simple-iso/<version>
+	BMCUserAgent string `envconfig:"BMC_USER_AGENT"`
+	// manufacturers of the system or BMC that operations are allowed on, any when unset
+	RequireVendor []string `envconfig:"REQUIRE_VENDOR"`
+	// overall limit for each insert, boot, and eject cycle against a BMC, zero means no limit
+	BMCOperationTimeout time.Duration `envconfig:"BMC_OPERATION_TIMEOUT"`
+	// eject media left inserted from BaseURL by a previous run before testing
+	CleanupOnStart bool `envconfig:"CLEANUP_ON_START"`
+	// connect to the BMCs and log the calls BMC_ACTION would make without making them, also set by --dry-run
+	DryRun bool `envconfig:"DRY_RUN"`
+	// full-test runs the insert, boot, and eject cycle, insert only attaches the iso, eject only removes inserted media
+	BMCAction string `envconfig:"BMC_ACTION" default:"full-test"`
+	// what to do after booting the host: wait, none, or until-ejected-externally
+	WaitMode         string        `envconfig:"WAIT_MODE" default:"wait"`
+	WaitPollInterval time.Duration `envconfig:"WAIT_POLL_INTERVAL" default:"10s"`
+	// leave the iso inserted once the wait mode is done waiting so the host can go on to install from it
+	KeepMediaInserted bool `envconfig:"KEEP_MEDIA_INSERTED"`
+	// embed a script in the iso that calls back to BASE_URL, the test only passes once the booted host runs it
+	PhoneHome        bool          `envconfig:"PHONE_HOME"`
+	PhoneHomeTimeout time.Duration `envconfig:"PHONE_HOME_TIMEOUT" default:"30m"`
+	// subscribe to the BMC's redfish events at BASE_URL/redfish-events in the wait mode and check the boot when
+	// a power or boot event arrives, polling only as a fallback
+	BMCEvents bool `envconfig:"BMC_EVENTS"`
+	// how long the wait mode polls for the host to boot from the media before ejecting it
+	BMCBootWait time.Duration `envconfig:"BMC_BOOT_WAIT" default:"10m"`
+	// comma separated BootProgress states, or OEM states, that confirm the boot in the wait mode
+	// defaults to OSBootStarted and OSRunning
+	BootSuccessStates []string `envconfig:"BOOT_SUCCESS_STATES"`
+	// reset used to boot the host: On, ForceRestart, GracefulRestart, or PowerCycle
+	BMCResetType string `envconfig:"BMC_RESET_TYPE" default:"On"`
+	// consecutive polls that must report the host powered on after reset, zero skips the check
+	PowerStableChecks   int           `envconfig:"POWER_STABLE_CHECKS"`
+	PowerStableInterval time.Duration `envconfig:"POWER_STABLE_INTERVAL" default:"5s"`
+	PowerStableTimeout  time.Duration `envconfig:"POWER_STABLE_TIMEOUT" default:"5m"`
+	// URL handed to InsertMedia instead of the served iso, e.g. nfs://server/path/image.iso
+	// the transfer protocol is derived from its scheme unless set explicitly
+	MediaURLOverride string `envconfig:"MEDIA_URL_OVERRIDE"`
+	// redfish path to the virtual media resource, skips discovery through the system's managers
+	VirtualMediaURI string `envconfig:"VIRTUAL_MEDIA_URI"`
+	// virtual media type to test, CD inserts the iso, USBStick a FAT image of the same contents built alongside it
+	// for BMCs that only have a removable disk slot
+	MediaType string `envconfig:"MEDIA_TYPE" default:"CD"`
+	// how long to wait for InsertMedia to complete and the media to be reported inserted, zero waits on the request only
+	InsertTimeout time.Duration `envconfig:"INSERT_TIMEOUT"`
+	// when the BMC has no redfish virtual media, boot from CD and power cycle over IPMI with ipmitool instead
+	// the iso must be attached to the BMC by other means
+	IPMIFallback bool `envconfig:"IPMI_FALLBACK"`
+	// save the serial console of the host to DATA_DIR/console over IPMI Serial-over-LAN while the full test boots it
+	ConsoleCapture bool `envconfig:"CONSOLE_CAPTURE"`
+	// save a screenshot of the host console to DATA_DIR/screenshots when the host isn't confirmed to boot the iso
+	ScreenshotOnFailure bool `envconfig:"SCREENSHOT_ON_FAILURE"`
+	// PEM CA certificate added to the virtual media trust store of the BMC before inserting an https iso
+	BMCPushCACertFile string `envconfig:"BMC_PUSH_CA_CERT_FILE"`
+	// eject and insert again even when the iso is already inserted
+	ForceReinsert bool `envconfig:"FORCE_REINSERT"`
+	// optional InsertMedia parameters for BMCs that require them
+	// the transfer protocol may be auto to derive it from the scheme of the iso URL
+	VirtualMediaTransferProtocol string `envconfig:"VIRTUAL_MEDIA_TRANSFER_PROTOCOL"`
+	VirtualMediaTransferMethod   string `envconfig:"VIRTUAL_MEDIA_TRANSFER_METHOD"`
+	VirtualMediaUser             string `envconfig:"VIRTUAL_MEDIA_USER"`
+	VirtualMediaPassword         string `envconfig:"VIRTUAL_MEDIA_PASSWORD"`
 }
 
-const testISOName = "test-config.iso"
+// version is set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+const (
+	testISOName         = "test-config.iso"
+	testISOVolumeLabel  = "test-config"
+	expirySweepInterval = time.Minute
+	// where the expiry of served isos is saved in DATA_DIR
+	expiryStateFile = "iso-expiry.json"
+)
 
 func main() {
 	log := logrus.New()
-	log.SetReportCaller(true)
 	err := envconfig.Process("fileserver", &Options)
 	if err != nil {
 		log.Fatalf("Failed to process config: %v\n", err)
 	}
+	flag.BoolVar(&Options.DryRun, "dry-run", Options.DryRun, "log the BMC calls that would be made without making them")
+	selftest := flag.Bool("e2e-selftest", false, "run the full create, serve, insert, and eject cycle against a built-in mock BMC and exit")
+	flag.Parse()
+	// applied before anything else is logged so every line is formatted the same way
+	log.SetReportCaller(Options.LogReportCaller)
 
 	level, err := logrus.ParseLevel(Options.LogLevel)
 	if err != nil {
@@ -50,203 +271,411 @@ func main() {
 	}
 	log.SetLevel(level)
 
+	if Options.BindAddress != "" {
+		if _, err := netip.ParseAddr(Options.BindAddress); err != nil {
+			log.Fatalf("invalid bind address %q, must be an IP address: %v", Options.BindAddress, err)
+		}
+	}
+
+	if *selftest {
+		configureSelftest(tlsEnabled(Options.HTTPSCertFile, Options.HTTPSKeyFile))
+	}
+	if err := absOptionPaths(); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := validateResetType(Options.BMCResetType); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateBMCAction(Options.BMCAction); err != nil {
+		log.Fatal(err)
+	}
+
+	tlsConfig, err := loadTLSConfig(Options.HTTPSCertFile, Options.HTTPSKeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// directory for fileserver and for isos to be created in
 	isosDir := filepath.Join(Options.DataDir, "isos")
 	if err := os.MkdirAll(isosDir, 0755); err != nil && !os.IsExist(err) {
 		log.WithError(err).Fatal("failed to create iso output dir")
 	}
 
-	if err := createTestISO(log, Options.DataDir, filepath.Join(isosDir, testISOName)); err != nil {
-		log.Fatal(err)
-	}
-	// parse url and create full url to iso
-	isoURL, err := url.JoinPath(Options.BaseURL, "images", testISOName)
+	sectorSize, err := isoSectorSize(Options.SectorSize)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Infof("got ISO URL: %s", isoURL)
-
-	server := startHTTPServer(log, isosDir, Options.Port, Options.HTTPSKeyFile, Options.HTTPSCertFile)
+	format := isoFormat{
+		sectorSize:      sectorSize,
+		rockRidge:       Options.RockRidge,
+		deepDirectories: Options.DeepDirectories,
+		joliet:          Options.Joliet,
+	}
 
-	if Options.BMCAddress != "" {
-		if err := testVirtualMedia(log, isoURL); err != nil {
-			log.WithError(err).Errorf("failed to test virtual media")
+	var callbacks *phoneHome
+	if Options.PhoneHome {
+		callbacks, err = newPhoneHome(Options.BaseURL, uuid.New().String())
+		if err != nil {
+			log.Fatal(err)
 		}
+		http.Handle("/api/phone-home/", http.StripPrefix("/api/phone-home/", callbacks.handler(log)))
+	}
+	var events *redfishEvents
+	if Options.BMCEvents {
+		events, err = newRedfishEvents(Options.BaseURL, uuid.New().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		http.Handle(redfishEventsPath, http.StripPrefix(redfishEventsPath, events.handler(log)))
 	}
 
-	waitForShutDown(log, server)
-}
-
-// createTestISO creates a single ISO containing a single file at isoPath
-// the temp dir is cleaned up by the ISO creation process
-func createTestISO(log *logrus.Logger, dataDir, isoPath string) error {
-	isoWorkDir, err := os.MkdirTemp(dataDir, "test-config")
+	source, err := isoContentSource(Options.Source, Options.ContentDir)
 	if err != nil {
-		return fmt.Errorf("failed to create iso work dir: %w", err)
-	}
-	if err := createInputData(isoWorkDir); err != nil {
-		return fmt.Errorf("failed to write input data: %w", err)
+		log.Fatal(err)
 	}
-	if err := create(isoPath, isoWorkDir, "test-config"); err != nil {
-		return fmt.Errorf("failed to create iso: %w", err)
+	if Options.SourceSHA256 != "" && !isHTTPSource(source) {
+		log.Fatal("SOURCE_SHA256 is only supported with an http or https SOURCE, reference an OCI image by digest instead")
 	}
-	log.Infof("Test iso created at %s", isoPath)
-	return nil
-}
-
-// createInputData writes a test file in dir to be packaged into an iso
-// in the future more meaningful data should be included here
-func createInputData(dir string) error {
-	return os.WriteFile(filepath.Join(dir, "config"), []byte("config-data"), 0644)
-}
-
-// create builds an iso file at outPath with the given volumeLabel using the contents of the working directory
-func create(outPath string, workDir string, volumeLabel string) error {
-	// Use the minimum iso size that will satisfy diskfs validations here.
-	// This value doesn't determine the final image size, but is used
-	// to truncate the initial file. This value would be relevant if
-	// we were writing to a particular partition on a device, but we are
-	// not so the minimum iso size will work for us here
-	minISOSize := 38 * 1024
-	d, err := diskfs.Create(outPath, int64(minISOSize), diskfs.Raw, diskfs.SectorSizeDefault)
+	hostname, err := os.Hostname()
 	if err != nil {
-		return err
+		log.WithError(err).Warn("failed to get host name for templates")
 	}
-
-	d.LogicalBlocksize = 2048
-	fspec := disk.FilesystemSpec{
-		Partition:   0,
-		FSType:      filesystem.TypeISO9660,
-		VolumeLabel: volumeLabel,
-		WorkDir:     workDir,
+	sshKeys, err := loadSSHAuthorizedKeys(Options.SSHAuthorizedKeys, Options.SSHAuthorizedKeysFile)
+	if err != nil {
+		log.Fatal(err)
 	}
-	fs, err := d.CreateFilesystem(fspec)
+	templateVars, err := isoTemplateVars(map[string]string{
+		"BaseURL":           Options.BaseURL,
+		"BMCAddress":        Options.BMCAddress,
+		"Hostname":          hostname,
+		"SSHAuthorizedKeys": strings.Join(sshKeys, "\n"),
+	}, Options.TemplateVarsFile, Options.TemplateVars)
 	if err != nil {
-		return err
+		log.Fatal(err)
 	}
-
-	iso, ok := fs.(*iso9660.FileSystem)
-	if !ok {
-		return fmt.Errorf("not an iso9660 filesystem")
+	var signer *isoSigner
+	if Options.GPGSigningKey != "" {
+		signer, err = newISOSigner(Options.GPGSigningKey, Options.GPGHome, Options.GPGPassphraseFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	options := iso9660.FinalizeOptions{
-		RockRidge:        true,
-		VolumeIdentifier: volumeLabel,
+	var vault *vaultClient
+	if len(Options.VaultSecrets) > 0 {
+		vault, err = newVaultClient(Options.VaultAddress, Options.VaultToken, Options.VaultTokenFile, Options.VaultKubernetesRole, Options.VaultKubernetesMount, Options.VaultCACertFile, Options.VaultSecrets)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	return iso.Finalize(options)
-}
-
-// testVirtualMedia connects to the BMC using the fields of Options and inserts and removes the test ISO
-func testVirtualMedia(log *logrus.Logger, isoURL string) error {
-	bmcURL, err := url.Parse(Options.BMCAddress)
+	var isos []isoDefinition
+	if Options.ISOConfigFile != "" {
+		if Options.ISOMode != isoModeTest {
+			log.Fatal("ISO_CONFIG_FILE is only supported with ISO_MODE test")
+		}
+		isos, err = loadISODefinitions(Options.ISOConfigFile, templateVars)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	seed, err := loadISOSeed(Options.ISOMode, sshKeys)
 	if err != nil {
-		return fmt.Errorf("failed to parse BMC Address %s: %w", Options.BMCAddress, err)
+		log.Fatal(err)
 	}
-
-	config := gofish.ClientConfig{
-		Endpoint:   fmt.Sprintf("%s://%s", bmcURL.Scheme, bmcURL.Host),
-		Username:   Options.BMCUser,
-		Password:   Options.BMCPassword,
-		BasicAuth:  true,
-		DumpWriter: log.WriterLevel(logrus.DebugLevel),
+	if Options.ISOMode == isoModeCoreOS && (Options.BaseISO == "" || Options.CoreOSIgnitionFile == "" || source != "") {
+		log.Fatal("ISO_MODE coreos needs BASE_ISO and COREOS_IGNITION_FILE set and SOURCE and CONTENT_DIR unset")
 	}
-	client, err := gofish.Connect(config)
+	if Options.ISOMode == isoModeCoreOS && Options.KernelArgs != "" {
+		log.Fatal("KERNEL_ARGS is not supported with ISO_MODE coreos")
+	}
+	if err := validateMediaType(Options.MediaType); err != nil {
+		log.Fatal(err)
+	}
+	testImageName := testISOName
+	if Options.MediaType == mediaTypeUSBStick {
+		if Options.ISOMode == isoModeCoreOS {
+			log.Fatal("MEDIA_TYPE USBStick is not supported with ISO_MODE coreos")
+		}
+		if Options.IPMIFallback {
+			log.Fatal("IPMI_FALLBACK only boots from CD and is not supported with MEDIA_TYPE USBStick")
+		}
+		testImageName = testUSBImageName
+	}
+	volumeLabel := testISOVolumeLabel
+	if Options.EFIBootImage != "" && Options.EFIBootDir != "" {
+		log.Fatal("only one of EFI_BOOT_IMAGE and EFI_BOOT_DIR may be set")
+	}
+	boot := bootImages{bios: Options.BIOSBootImage, efi: Options.EFIBootImage, efiDir: Options.EFIBootDir}
+	if Options.BaseISO != "" && Options.ISOMode != isoModeCoreOS {
+		base, err := readBaseISO(Options.BaseISO)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if base.label != "" {
+			volumeLabel = base.label
+		}
+		// images set explicitly replace the ones of the base iso
+		if boot.bios == "" {
+			boot.bios = base.boot.bios
+		}
+		if boot.efi == "" && boot.efiDir == "" {
+			boot.efi = base.boot.efi
+		}
+		for _, platform := range base.unreachable {
+			log.Warnf("%s boot image of base iso %s is outside its filesystem and is not carried over", platform, Options.BaseISO)
+		}
+		log.Infof("overlaying base iso %s with label %q, BIOS boot image %q, EFI boot image %q", Options.BaseISO, volumeLabel, boot.bios, boot.efi)
+	}
+	if seed != nil {
+		volumeLabel = seed.volumeLabel()
+	}
+	var usbImagePath string
+	if Options.MediaType == mediaTypeUSBStick {
+		usbImagePath = filepath.Join(isosDir, testUSBImageName)
+	}
+	credentials := bmcCredentials{
+		user:         Options.BMCUser,
+		password:     Options.BMCPassword,
+		userFile:     Options.BMCUserFile,
+		passwordFile: Options.BMCPasswordFile,
+	}
+	if err := credentials.check("BMC_USER", "BMC_PASSWORD"); err != nil {
+		log.Fatal(err)
+	}
+	// loaded before the isos are built as each host may get its own
+	var fileTargets []bmcTarget
+	if Options.BMCConfigFile != "" && !*selftest {
+		fileTargets, err = loadBMCTargets(Options.BMCConfigFile, credentials)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, target := range fileTargets {
+		if target.networkConfig != "" && !Options.PerHostISOs {
+			log.Fatalf("BMC %s has a network config, which is only embedded with PER_HOST_ISOS", target.address)
+		}
+	}
+	if Options.PerHostISOs {
+		switch {
+		case Options.ISOMode == isoModeCoreOS:
+			log.Fatal("PER_HOST_ISOS is not supported with ISO_MODE coreos")
+		case Options.MediaType != mediaTypeCD:
+			log.Fatal("PER_HOST_ISOS is only supported with MEDIA_TYPE CD")
+		case Options.MediaURLOverride != "":
+			log.Fatal("PER_HOST_ISOS and MEDIA_URL_OVERRIDE may not both be set")
+		}
+		test := isoDefinition{
+			label:        volumeLabel,
+			source:       source,
+			sourceSHA256: Options.SourceSHA256,
+			sourcePath:   Options.SourcePath,
+			templateVars: templateVars,
+		}
+		hostISOs, err := hostISODefinitions(fileTargets, test, Options.BaseURL, isos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		isos = append(isos, hostISOs...)
+	}
+	expiry, err := newISOExpiry(filepath.Join(Options.DataDir, expiryStateFile))
 	if err != nil {
-		return fmt.Errorf("failed to connect to BMC: %w", err)
+		log.Fatal(err)
+	}
+	builder := &testISOBuilder{
+		log:              log,
+		dataDir:          Options.DataDir,
+		source:           source,
+		sourceSHA256:     Options.SourceSHA256,
+		sourcePath:       Options.SourcePath,
+		registryUser:     Options.SourceRegistryUser,
+		registryPassword: Options.SourceRegistryPassword,
+		kubeNamespace:    Options.SourceKubeNamespace,
+		baseISO:          Options.BaseISO,
+		templateVars:     templateVars,
+		vault:            vault,
+		signer:           signer,
+		manifestPath:     Options.ISOManifestPath,
+		manifestFormat:   Options.ISOManifestFormat,
+		isoPath:          filepath.Join(isosDir, testISOName),
+		usbImagePath:     usbImagePath,
+		ttl:              Options.ISOTTL,
+		expiry:           expiry,
+		boot:             boot,
+		format:           format,
+		installerType:    Options.InstallerType,
+		installerParams:  Options.InstallerParams,
+		kernelArgs:       strings.Fields(Options.KernelArgs),
+		sshKeys:          sshKeys,
+		phoneHome:        callbacks,
+		volumeLabel:      volumeLabel,
+		seed:             seed,
+		ignitionFile:     Options.CoreOSIgnitionFile,
+		isos:             isos,
+	}
+	if _, err := builder.build(); err != nil {
+		log.Fatal(err)
 	}
+	go expiry.sweep(log, isosDir, expirySweepInterval)
 
-	system, err := redfish.GetComputerSystem(client, bmcURL.Path)
+	// parse url and create full url to iso
+	isoURL, err := url.JoinPath(Options.BaseURL, "images", testImageName)
 	if err != nil {
-		return fmt.Errorf("failed to get computer system: %w", err)
+		log.Fatal(err)
 	}
-
-	var isoVM *redfish.VirtualMedia
-	for _, m := range system.ManagedBy {
-		manager, err := redfish.GetManager(client, m)
-		if err != nil {
-			return err
+	if Options.MediaURLOverride != "" {
+		if Options.VirtualMediaTransferProtocol == "" {
+			Options.VirtualMediaTransferProtocol = transferProtocolAuto
 		}
-		vms, err := manager.VirtualMedia()
+		isoURL = Options.MediaURLOverride
+	}
+	if Options.VirtualMediaTransferProtocol == transferProtocolAuto {
+		protocol, err := transferProtocolForURL(isoURL)
 		if err != nil {
-			return err
-		}
-		for _, vm := range vms {
-			for _, vmType := range vm.MediaTypes {
-				if vmType == redfish.CDMediaType {
-					isoVM = vm
-					break
-				}
-			}
+			log.Fatal(err)
 		}
+		Options.VirtualMediaTransferProtocol = string(protocol)
 	}
-
-	if isoVM == nil {
-		return fmt.Errorf("failed to find CD type virtual media")
+	if err := validateTransferProtocol(Options.VirtualMediaTransferProtocol); err != nil {
+		log.Fatal(err)
 	}
+	log.Infof("got ISO URL: %s", isoURL)
 
-	if isoVM.Inserted {
-		if err := isoVM.EjectMedia(); err != nil {
-			return fmt.Errorf("failed to eject media: %w", err)
+	userAgent := Options.BMCUserAgent
+	if userAgent == "" {
+		userAgent = "simple-iso/" + version
+	}
+	correlationID := uuid.New().String()
+	log.Infof("using correlation id %s for BMC requests", correlationID)
+	bmcTLS, err := bmcTLSConfig(Options.BMCCACertFile, Options.BMCInsecureTLS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if Options.BMCInsecureTLS {
+		log.Warn("BMC_INSECURE_TLS is set, BMC certificates are not verified")
+	}
+	if Options.AuditLogFile != "" {
+		audit, err = openAuditLog(log, Options.AuditLogFile)
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-	if err := isoVM.InsertMedia(isoURL, true, true); err != nil {
-		return fmt.Errorf("failed to insert media: %w", err)
+	bmcHTTPClient := newBMCHTTPClient(log, Options.BMCMaxIdleConns, Options.BMCConnectTimeout, Options.BMCHTTPTimeout, userAgent, correlationID, bmcTLS)
+
+	isoDirs := append([]string{isosDir}, Options.ISODirs...)
+	logISODirCollisions(log, isoDirs)
+
+	store := &isoStore{
+		dataDir:   Options.DataDir,
+		isosDir:   isosDir,
+		baseURL:   Options.BaseURL,
+		expiry:    expiry,
+		downloads: newDownloadTracker(),
+		format:    format,
+		ttl:       Options.ISOTTL,
+		signer:    signer,
 	}
 
-	log.Info("media inserted, booting host")
+	// done on SIGINT or SIGTERM so BMC operations in progress stop waiting and clean up before the server shuts down
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := system.Reset(redfish.OnResetType); err != nil {
-		return fmt.Errorf("failed to boot system: %w", err)
+	if len(builder.kubeSources()) > 0 && Options.SourceKubeWatch {
+		if Options.SourceKubeRetryInterval <= 0 {
+			log.Fatalf("invalid SOURCE_KUBE_RETRY_INTERVAL %s, must be positive", Options.SourceKubeRetryInterval)
+		}
+		go watchKubeSources(ctx, log, builder, Options.SourceKubeNamespace, Options.SourceKubeRetryInterval)
 	}
 
-	log.Info("waiting 5 minutes")
-	time.Sleep(5 * time.Minute)
-
-	if err := isoVM.EjectMedia(); err != nil {
-		return fmt.Errorf("failed to eject media: %w", err)
+	// tested once the server is up, and the only BMCs the insert API uses the configured credentials for
+	var targets []bmcTarget
+	if Options.BMCAddress != "" && !*selftest {
+		targets = append(targets, bmcTarget{address: Options.BMCAddress, credentials: credentials})
+	}
+	targets = append(targets, fileTargets...)
+
+	var upload http.Handler
+	if Options.APIToken != "" {
+		upload = requireToken(Options.APIToken, uploadISOHandler(log, store, Options.MaxUploadSize))
+		http.Handle("/reload", requireToken(Options.APIToken, reloadHandler(log, builder)))
+		http.Handle("/api/isos", requireToken(Options.APIToken, isosHandler(listISOsHandler(log, store), createISOHandler(log, store))))
+		http.Handle("/api/isos/from-archive", requireToken(Options.APIToken, createISOFromArchiveHandler(log, store, Options.MaxUploadSize)))
+		http.Handle("/api/isos/", requireToken(Options.APIToken, http.StripPrefix("/api/isos/", deleteISOHandler(log, store))))
+		http.Handle("/bmc/insert", requireToken(Options.APIToken, bmcInsertHandler(ctx, log, bmcHTTPClient, targets, mergedDirs(isoDirs), Options.BaseURL, Options.BMCOperationTimeout)))
+	} else {
+		log.Info("API_TOKEN is not set, API endpoints are disabled")
 	}
-	log.Info("media ejected")
 
-	return nil
-}
+	server := startHTTPServer(log, isoDirs, expiry, store.downloads, Options.DownloadRateLimit, Options.MaxConcurrentDownloads, Options.ISOContentType, upload, net.JoinHostPort(Options.BindAddress, Options.Port), tlsConfig)
 
-func startHTTPServer(log *logrus.Logger, isosDir, port, httpsKeyFile, httpsCertFile string) *http.Server {
-	http.Handle("/images/", http.StripPrefix("/images/", http.FileServer(http.Dir(isosDir))))
-	server := &http.Server{
-		Addr: fmt.Sprintf(":%s", port),
+	var mock *mockBMC
+	if *selftest {
+		var mockURL string
+		mock, mockURL, err = startMockBMC(log)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets = append(targets, bmcTarget{address: mockURL + mockSystemURI})
 	}
 
-	go func() {
-		var err error
-		if httpsKeyFile != "" && httpsCertFile != "" {
-			log.Infof("Starting https handler on %s...", server.Addr)
-			err = server.ListenAndServeTLS(httpsCertFile, httpsKeyFile)
-		} else {
-			log.Infof("Starting http handler on %s...", server.Addr)
-			err = server.ListenAndServe()
+	if len(targets) > 0 {
+		if err := waitForServerReady(log, localServerAddress(Options.BindAddress, Options.Port), Options.ServerReadyTimeout); err != nil {
+			log.Fatal(err)
 		}
-
-		if err != http.ErrServerClosed {
-			log.WithError(err).Fatalf("HTTP listener closed: %v", err)
+		failed := logBMCResults(log, testBMCTargets(ctx, log, bmcHTTPClient, targets, isoURL, callbacks, events, Options.BMCWorkers))
+		if *selftest {
+			server.Close()
+			if err := mock.checkBoot(); err != nil {
+				log.Error(err)
+				failed++
+			}
+			if failed > 0 {
+				os.Exit(1)
+			}
+			os.Exit(0)
 		}
-	}()
+	}
 
-	return server
+	waitForShutDown(ctx, log, server)
+	// connections still open were abandoned by the shutdown, their sessions would otherwise be left on the BMCs
+	bmcSessions.logoutAll()
 }
 
-func waitForShutDown(log *logrus.Logger, server *http.Server) {
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
-
-	if err := server.Shutdown(context.Background()); err != nil {
-		log.WithError(err).Errorf("shutdown failed")
-		if err := server.Close(); err != nil {
-			log.WithError(err).Fatal("emergency shutdown failed")
+// absOptionPaths makes DataDir and the local files and directories of Options absolute
+// isos are built while the server runs and diskfs changes the working directory of the whole process while it
+// finalizes one, relative paths used meanwhile would resolve against the work dir of that build
+func absOptionPaths() error {
+	paths := []*string{
+		&Options.HTTPSKeyFile, &Options.HTTPSCertFile, &Options.GPGHome, &Options.GPGPassphraseFile,
+		&Options.TemplateVarsFile, &Options.VaultTokenFile, &Options.VaultCACertFile, &Options.ContentDir,
+		&Options.ISOConfigFile, &Options.BaseISO, &Options.SSHAuthorizedKeysFile,
+		&Options.NoCloudUserDataFile, &Options.NoCloudMetaDataFile, &Options.NoCloudNetworkConfigFile,
+		&Options.ConfigDriveUserDataFile, &Options.ConfigDriveMetaDataFile, &Options.ConfigDriveNetworkDataFile,
+		&Options.CoreOSIgnitionFile, &Options.BMCUserFile, &Options.BMCPasswordFile, &Options.BMCConfigFile,
+		&Options.BMCCACertFile, &Options.AuditLogFile, &Options.BMCPushCACertFile,
+	}
+	for i := range Options.ISODirs {
+		paths = append(paths, &Options.ISODirs[i])
+	}
+	// remote sources are URLs
+	if !strings.Contains(Options.Source, "://") {
+		paths = append(paths, &Options.Source)
+	}
+	for _, p := range paths {
+		if *p == "" {
+			continue
 		}
-	} else {
-		log.Infof("server terminated gracefully")
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return fmt.Errorf("failed to make %s absolute: %w", *p, err)
+		}
+		*p = abs
 	}
+
+	// an empty DataDir is the working directory
+	dataDir, err := filepath.Abs(Options.DataDir)
+	if err != nil {
+		return fmt.Errorf("failed to make DATA_DIR absolute: %w", err)
+	}
+	Options.DataDir = dataDir
+	return nil
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAbsOptionPaths(t *testing.T) {
+	withOptions(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options.DataDir = ""
+	Options.ISODirs = []string{"extra", "/srv/isos"}
+	Options.BMCPasswordFile = "secrets/password"
+	Options.Source = "oci://quay.io/org/bundle:v1"
+	Options.BaseISO = ""
+
+	if err := absOptionPaths(); err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]string{
+		"DataDir":         Options.DataDir,
+		"ISODirs[0]":      Options.ISODirs[0],
+		"ISODirs[1]":      Options.ISODirs[1],
+		"BMCPasswordFile": Options.BMCPasswordFile,
+	} {
+		if !filepath.IsAbs(got) {
+			t.Errorf("%s is %q, expected an absolute path", name, got)
+		}
+	}
+	if Options.DataDir != cwd {
+		t.Errorf("empty DataDir became %q, expected the working directory %q", Options.DataDir, cwd)
+	}
+	if Options.BMCPasswordFile != filepath.Join(cwd, "secrets/password") {
+		t.Errorf("BMCPasswordFile is %q", Options.BMCPasswordFile)
+	}
+	if Options.Source != "oci://quay.io/org/bundle:v1" {
+		t.Errorf("remote Source was changed to %q", Options.Source)
+	}
+	if Options.BaseISO != "" {
+		t.Errorf("unset BaseISO was set to %q", Options.BaseISO)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// isoManifest describes the contents of an iso and how it was built
+type isoManifest struct {
+	VolumeLabel string             `json:"volumeLabel"`
+	BuildTime   time.Time          `json:"buildTime"`
+	ToolVersion string             `json:"toolVersion"`
+	Files       []isoManifestEntry `json:"files"`
+}
+
+type isoManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeISOManifest lists the files in workDir and writes the manifest to manifestPath inside workDir
+// format may be "json" or "yaml"
+func writeISOManifest(workDir, manifestPath, format, volumeLabel string) error {
+	manifest := isoManifest{
+		VolumeLabel: volumeLabel,
+		BuildTime:   time.Now().UTC(),
+		ToolVersion: version,
+		Files:       []isoManifestEntry{},
+	}
+
+	err := filepath.WalkDir(workDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		checksum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, isoManifestEntry{
+			Path:   "/" + filepath.ToSlash(rel),
+			Size:   info.Size(),
+			SHA256: checksum,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list iso contents: %w", err)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+
+	var data []byte
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(manifest, "", "  ")
+	case "yaml":
+		data, err = yaml.Marshal(manifest)
+	default:
+		return fmt.Errorf("unsupported manifest format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	dest, err := securePath(workDir, strings.TrimPrefix(manifestPath, "/"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, data, 0644)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	mockSystemURI       = "/redfish/v1/Systems/1"
+	mockManagerURI      = "/redfish/v1/Managers/1"
+	mockVirtualMediaURI = "/redfish/v1/Managers/1/VirtualMedia/Cd"
+)
+
+// mockBMC is a minimal redfish service with a single system whose manager has one virtual media device of
+// Options.MediaType
+// inserted images are downloaded and checked to be isos, or FAT images for USB sticks, so the whole serve and
+// insert path is exercised
+// a reset boots the host from the inserted media, reaching OSBootStarted after mockBootDelay
+type mockBMC struct {
+	mu       sync.Mutex
+	log      *logrus.Logger
+	power    string
+	inserted bool
+	image    string
+	boot     map[string]string
+	// LastState of BootProgress, and whether a reset is still booting from the media
+	bootState string
+	booting   bool
+	// set when the media is ejected while the host is still booting from it
+	ejectedEarly bool
+	// fetches inserted images, certificates aren't verified as the server may use a self-signed one
+	client *http.Client
+}
+
+// mockBootDelay is how long the mock host takes from a reset to booting the inserted media
+const mockBootDelay = 500 * time.Millisecond
+
+// startMockBMC serves a mockBMC on a random local port and returns it with its base URL
+func startMockBMC(log *logrus.Logger) (*mockBMC, string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to listen for mock BMC: %w", err)
+	}
+	m := &mockBMC{
+		log:       log,
+		power:     "Off",
+		bootState: "None",
+		boot: map[string]string{
+			"BootSourceOverrideEnabled": "Disabled",
+			"BootSourceOverrideTarget":  "None",
+		},
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}},
+	}
+	go func() {
+		if err := http.Serve(listener, m); err != nil {
+			log.WithError(err).Error("mock BMC stopped")
+		}
+	}()
+	return m, "http://" + listener.Addr().String(), nil
+}
+
+// bootMedia finishes the boot started by a reset, the host only reaches the OS with the media still inserted
+func (m *mockBMC) bootMedia() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.booting {
+		return
+	}
+	m.booting = false
+	if m.inserted {
+		m.bootState = "OSBootStarted"
+	}
+}
+
+// checkBoot returns an error if the media was ejected before the host booted from it
+func (m *mockBMC) checkBoot() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ejectedEarly {
+		return fmt.Errorf("mock BMC: media was ejected before the host booted from it")
+	}
+	return nil
+}
+
+// mockLink returns a redfish reference to uri
+func mockLink(uri string) map[string]string {
+	return map[string]string{"@odata.id": uri}
+}
+
+func (m *mockBMC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.log.Debugf("mock BMC: %s %s", r.Method, r.URL.Path)
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodGet:
+		m.get(w, path)
+	case r.Method == http.MethodPatch && path == mockSystemURI:
+		var body struct {
+			Boot map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			m.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for k, v := range body.Boot {
+			m.boot[k] = v
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && path == mockSystemURI+"/Actions/ComputerSystem.Reset":
+		m.power = "On"
+		m.bootState, m.booting = "SystemHardwareInitializationStarted", true
+		time.AfterFunc(mockBootDelay, m.bootMedia)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && path == mockVirtualMediaURI+"/Actions/VirtualMedia.InsertMedia":
+		var body struct {
+			Image string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			m.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := m.fetchImage(body.Image); err != nil {
+			m.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m.inserted, m.image = true, body.Image
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && path == mockVirtualMediaURI+"/Actions/VirtualMedia.EjectMedia":
+		if m.booting {
+			m.ejectedEarly = true
+		}
+		m.inserted, m.image = false, ""
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		m.error(w, http.StatusNotFound, "not found")
+	}
+}
+
+// get responds with the resource at path
+func (m *mockBMC) get(w http.ResponseWriter, path string) {
+	var resource interface{}
+	switch path {
+	case "/redfish/v1":
+		resource = map[string]interface{}{
+			"@odata.id": "/redfish/v1/",
+			"Systems":   mockLink("/redfish/v1/Systems"),
+			"Managers":  mockLink("/redfish/v1/Managers"),
+		}
+	case "/redfish/v1/Systems":
+		resource = map[string]interface{}{"Members": []interface{}{mockLink(mockSystemURI)}}
+	case mockSystemURI:
+		resource = map[string]interface{}{
+			"@odata.id":    mockSystemURI,
+			"Id":           "1",
+			"Manufacturer": "simple-iso",
+			"Model":        "mock",
+			"PowerState":   m.power,
+			"BootProgress": map[string]string{"LastState": m.bootState},
+			"Boot":         m.boot,
+			"Links":        map[string]interface{}{"ManagedBy": []interface{}{mockLink(mockManagerURI)}},
+			"Actions": map[string]interface{}{
+				"#ComputerSystem.Reset": map[string]string{"target": mockSystemURI + "/Actions/ComputerSystem.Reset"},
+			},
+		}
+	case "/redfish/v1/Managers":
+		resource = map[string]interface{}{"Members": []interface{}{mockLink(mockManagerURI)}}
+	case mockManagerURI:
+		resource = map[string]interface{}{
+			"@odata.id":       mockManagerURI,
+			"Id":              "1",
+			"Manufacturer":    "simple-iso",
+			"Model":           "mock",
+			"FirmwareVersion": version,
+			"VirtualMedia":    mockLink(mockManagerURI + "/VirtualMedia"),
+		}
+	case mockManagerURI + "/VirtualMedia":
+		resource = map[string]interface{}{"Members": []interface{}{mockLink(mockVirtualMediaURI)}}
+	case mockVirtualMediaURI:
+		connectedVia := "NotConnected"
+		if m.inserted {
+			connectedVia = "URI"
+		}
+		mediaTypes := []string{"CD", "DVD"}
+		if Options.MediaType == mediaTypeUSBStick {
+			mediaTypes = []string{"USBStick"}
+		}
+		resource = map[string]interface{}{
+			"@odata.id":    mockVirtualMediaURI,
+			"Id":           "Cd",
+			"MediaTypes":   mediaTypes,
+			"Inserted":     m.inserted,
+			"Image":        m.image,
+			"ConnectedVia": connectedVia,
+			"Actions": map[string]interface{}{
+				"#VirtualMedia.InsertMedia": map[string]string{"target": mockVirtualMediaURI + "/Actions/VirtualMedia.InsertMedia"},
+				"#VirtualMedia.EjectMedia":  map[string]string{"target": mockVirtualMediaURI + "/Actions/VirtualMedia.EjectMedia"},
+			},
+		}
+	default:
+		m.error(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		m.log.WithError(err).Error("mock BMC failed to write response")
+	}
+}
+
+// fetchImage downloads the start of image and checks that it is of Options.MediaType
+func (m *mockBMC) fetchImage(image string) error {
+	resp, err := m.client.Get(image)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", image, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", image, resp.Status)
+	}
+	header, err := io.ReadAll(io.LimitReader(resp.Body, mediaHeaderSize(Options.MediaType)))
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", image, err)
+	}
+	if err := checkMediaHeader(bytes.NewReader(header), Options.MediaType); err != nil {
+		return fmt.Errorf("%s is not a %s image: %w", image, Options.MediaType, err)
+	}
+	return nil
+}
+
+// error writes a redfish error response
+func (m *mockBMC) error(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body := map[string]interface{}{"error": map[string]string{"message": message}}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		m.log.WithError(err).Error("mock BMC failed to write response")
+	}
+}
+
+// selftestPollInterval replaces the wait poll interval in the self test as the mock host boots within mockBootDelay
+const selftestPollInterval = 100 * time.Millisecond
+
+// configureSelftest overrides Options so the full test runs against the mock BMC and the local server
+func configureSelftest(https bool) {
+	if Options.BaseURL == "" {
+		scheme := "http"
+		if https {
+			scheme = "https"
+		}
+		Options.BaseURL = scheme + "://" + localServerAddress(Options.BindAddress, Options.Port)
+	}
+	Options.BMCAction = bmcActionFullTest
+	Options.WaitMode = waitModeWait
+	Options.KeepMediaInserted = false
+	Options.WaitPollInterval = selftestPollInterval
+	Options.DryRun = false
+	Options.PhoneHome = false
+	Options.BMCEvents = false
+	Options.AuditLogFile = ""
+	Options.MediaURLOverride = ""
+	Options.IPMIFallback = false
+	Options.ConsoleCapture = false
+	Options.ScreenshotOnFailure = false
+	Options.BootSuccessStates = nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// path inside the iso of the nmstate config of a host
+	nmstateConfigPath = "network/nmstate.yaml"
+	// dir inside the iso of the NetworkManager keyfiles of a host
+	nmKeyfileDir = "network/system-connections"
+	nmKeyfileExt = ".nmconnection"
+)
+
+// networkConfigISOPath returns where the network config at path is written inside the iso, the nmstate file or
+// the keyfile dir
+func networkConfigISOPath(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read network config: %w", err)
+	}
+	if info.IsDir() {
+		return nmKeyfileDir, nil
+	}
+	return nmstateConfigPath, nil
+}
+
+// checkNetworkConfig returns an error if path is neither an nmstate YAML file nor a dir of NetworkManager keyfiles
+func checkNetworkConfig(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read network config: %w", err)
+	}
+	if info.IsDir() {
+		_, err = readNMKeyfiles(path)
+	} else {
+		_, err = readNMStateConfig(path)
+	}
+	return err
+}
+
+// writeNetworkConfig writes the nmstate file or the keyfiles of the dir at path to their place in workDir
+// keyfiles are only readable by their owner as NetworkManager ignores them otherwise
+func writeNetworkConfig(workDir, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read network config: %w", err)
+	}
+	if !info.IsDir() {
+		data, err := readNMStateConfig(path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(workDir, filepath.FromSlash(nmstateConfigPath))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		return os.WriteFile(dest, data, 0644)
+	}
+
+	keyfiles, err := readNMKeyfiles(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(workDir, filepath.FromSlash(nmKeyfileDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range keyfiles {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readNMStateConfig returns the nmstate config at path, which must be a YAML or JSON object with interfaces
+func readNMStateConfig(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network config: %w", err)
+	}
+	var state map[string]interface{}
+	if err := yaml.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("network config %s is not valid nmstate YAML: %w", path, err)
+	}
+	if _, ok := state["interfaces"]; !ok {
+		return nil, fmt.Errorf("network config %s has no nmstate interfaces", path)
+	}
+	return data, nil
+}
+
+// readNMKeyfiles returns the *.nmconnection files of dir by name, there must be at least one and each must have
+// a [connection] section, other files are ignored
+func readNMKeyfiles(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network config: %w", err)
+	}
+	keyfiles := make(map[string][]byte)
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != nmKeyfileExt {
+			continue
+		}
+		if !e.Type().IsRegular() {
+			return nil, fmt.Errorf("keyfile %s in network config %s is not a regular file", e.Name(), dir)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read network config: %w", err)
+		}
+		if !hasKeyfileSection(data, "connection") {
+			return nil, fmt.Errorf("keyfile %s in network config %s has no [connection] section", e.Name(), dir)
+		}
+		keyfiles[e.Name()] = data
+	}
+	if len(keyfiles) == 0 {
+		return nil, fmt.Errorf("network config %s has no %s keyfiles", dir, nmKeyfileExt)
+	}
+	return keyfiles, nil
+}
+
+// hasKeyfileSection returns true if the keyfile data has a [section] group header
+func hasKeyfileSection(data []byte, section string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "["+section+"]" {
+			return true
+		}
+	}
+	return false
+}
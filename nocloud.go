@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"sigs.k8s.io/yaml"
+)
+
+// cloud-init only looks for a NoCloud seed on a filesystem with this label
+const noCloudVolumeLabel = "cidata"
+
+// noCloudSeed is the content of the files of a NoCloud seed
+// files left empty are kept from the rest of the iso content, meta-data is generated if there is none
+type noCloudSeed struct {
+	UserData      string `json:"userData"`
+	MetaData      string `json:"metaData"`
+	NetworkConfig string `json:"networkConfig"`
+	// added to the public-keys of meta-data, which cloud-init installs for the default user
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+}
+
+func (s *noCloudSeed) volumeLabel() string {
+	return noCloudVolumeLabel
+}
+
+// loadNoCloudSeed reads the seed files at the given paths, any of which may be empty
+func loadNoCloudSeed(userDataFile, metaDataFile, networkConfigFile string) (*noCloudSeed, error) {
+	seed := &noCloudSeed{}
+	for _, f := range []struct {
+		path    string
+		content *string
+	}{
+		{userDataFile, &seed.UserData},
+		{metaDataFile, &seed.MetaData},
+		{networkConfigFile, &seed.NetworkConfig},
+	} {
+		if f.path == "" {
+			continue
+		}
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NoCloud seed file: %w", err)
+		}
+		*f.content = string(data)
+	}
+	return seed, nil
+}
+
+// write writes the files of the seed into the root of workDir
+// user-data must end up in workDir, either from the seed or the content already there
+func (s *noCloudSeed) write(workDir string) error {
+	for _, f := range []struct {
+		name    string
+		content string
+	}{
+		{"user-data", s.UserData},
+		{"meta-data", s.MetaData},
+		{"network-config", s.NetworkConfig},
+	} {
+		if f.content == "" {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(workDir, f.name), []byte(f.content), 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, "user-data")); os.IsNotExist(err) {
+		return fmt.Errorf("NoCloud seed has no user-data")
+	} else if err != nil {
+		return err
+	}
+	metaData := filepath.Join(workDir, "meta-data")
+	if _, err := os.Stat(metaData); os.IsNotExist(err) {
+		// cloud-init requires meta-data, a new instance id makes it run again on hosts seeded before
+		if err := os.WriteFile(metaData, []byte("instance-id: iid-"+uuid.New().String()+"\n"), 0644); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(s.SSHAuthorizedKeys) > 0 {
+		return addNoCloudPublicKeys(metaData, s.SSHAuthorizedKeys)
+	}
+	return nil
+}
+
+// addNoCloudPublicKeys adds keys to the public-keys of the meta-data file at path
+// the file is rewritten from its parsed YAML so any comments in it are lost
+func addNoCloudPublicKeys(path string, keys []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var metaData map[string]interface{}
+	if err := yaml.Unmarshal(data, &metaData); err != nil {
+		return fmt.Errorf("failed to parse NoCloud meta-data: %w", err)
+	}
+	if metaData == nil {
+		metaData = map[string]interface{}{}
+	}
+	var publicKeys []interface{}
+	switch existing := metaData["public-keys"].(type) {
+	case nil:
+	case string:
+		publicKeys = append(publicKeys, existing)
+	case []interface{}:
+		publicKeys = existing
+	default:
+		return fmt.Errorf("NoCloud meta-data public-keys must be a string or a list to add SSH keys to")
+	}
+	for _, key := range keys {
+		publicKeys = append(publicKeys, key)
+	}
+	metaData["public-keys"] = publicKeys
+	data, err = yaml.Marshal(metaData)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// ociSourcePrefix marks a source that is the reference of an OCI image whose filesystem is packaged into the iso
+const ociSourcePrefix = "oci://"
+
+const (
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	// largest manifest read from a registry
+	maxOCIManifestSize = 4 * 1024 * 1024
+	// whiteout files of a layer delete a path of the layers below, the opaque one everything in its directory
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+)
+
+// isOCISource returns true if source is an OCI image reference
+func isOCISource(source string) bool {
+	return strings.HasPrefix(source, ociSourcePrefix)
+}
+
+// ociReference is an image in a registry, by tag unless digest is set
+type ociReference struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseOCIReference parses an image reference such as quay.io/org/bundle:v1 or quay.io/org/bundle@sha256:...
+// references without a registry are on Docker Hub and default to the latest tag like docker does
+func parseOCIReference(ref string) (ociReference, error) {
+	var r ociReference
+	name := strings.TrimPrefix(ref, ociSourcePrefix)
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.digest = name[:i], name[i+1:]
+		if !strings.HasPrefix(r.digest, "sha256:") {
+			return r, fmt.Errorf("unsupported digest %q in image reference %s, only sha256 is supported", r.digest, ref)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.tag = name[:i], name[i+1:]
+	}
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		r.registry, r.repository = name[:i], name[i+1:]
+	} else {
+		r.registry, r.repository = "registry-1.docker.io", name
+		if !strings.Contains(name, "/") {
+			r.repository = "library/" + name
+		}
+	}
+	if r.repository == "" {
+		return r, fmt.Errorf("invalid image reference %s", ref)
+	}
+	if r.tag == "" && r.digest == "" {
+		r.tag = "latest"
+	}
+	return r, nil
+}
+
+// manifestReference returns the digest if set, otherwise the tag
+func (r ociReference) manifestReference() string {
+	if r.digest != "" {
+		return r.digest
+	}
+	return r.tag
+}
+
+// ociDescriptor points to a manifest or layer by its digest
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform"`
+}
+
+// ociManifest is an image manifest or an index of the manifests of a multi-platform image
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// ociRegistry reads the manifests and blobs of a repository over the registry HTTP API
+type ociRegistry struct {
+	client     *http.Client
+	baseURL    string
+	repository string
+	// bearer token from the registry's token service, fetched on the first unauthorized response
+	token string
+	// basic credentials for registries that take them directly, or for the token service
+	user     string
+	password string
+}
+
+// newOCIRegistry returns a client for the repository of ref
+// registries on localhost are reached over plain http like docker does, anything else over https
+func newOCIRegistry(ref ociReference, user, password string) *ociRegistry {
+	scheme := "https"
+	host := ref.registry
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+	return &ociRegistry{
+		client:     &http.Client{Timeout: remoteSourceTimeout},
+		baseURL:    scheme + "://" + ref.registry,
+		repository: ref.repository,
+		user:       user,
+		password:   password,
+	}
+}
+
+// get requests path of the repository, authenticating and retrying once if the registry asks for it
+func (r *ociRegistry) get(kind, reference string, accept ...string) (*http.Response, error) {
+	uri := fmt.Sprintf("%s/v2/%s/%s/%s", r.baseURL, r.repository, kind, reference)
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		} else if r.user != "" {
+			req.SetBasicAuth(r.user, r.password)
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := r.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to get %s %s of %s: %s", kind, reference, r.repository, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+var ociChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate fetches a bearer token as the WWW-Authenticate challenge of the registry says
+// a basic challenge is answered with the configured credentials on the retry
+func (r *ociRegistry) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if r.user == "" {
+			return fmt.Errorf("registry requires credentials")
+		}
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry authentication %q", scheme)
+	}
+
+	values := map[string]string{}
+	for _, m := range ociChallengeParam.FindAllStringSubmatch(params, -1) {
+		values[m[1]] = m[2]
+	}
+	if values["realm"] == "" {
+		return fmt.Errorf("registry authentication challenge has no realm")
+	}
+	tokenURL, err := url.Parse(values["realm"])
+	if err != nil {
+		return fmt.Errorf("invalid registry authentication realm: %w", err)
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if values[key] != "" {
+			query.Set(key, values[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if r.user != "" {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry token service returned no token")
+	}
+	return nil
+}
+
+// manifest returns the image manifest of reference, choosing the one for linux on the architecture of this host,
+// or the first, from an index
+// the manifest must have reference as its digest when reference is a digest
+func (r *ociRegistry) manifest(reference string) (*ociManifest, error) {
+	resp, err := r.get("manifests", reference, ociIndexMediaType, ociManifestMediaType, dockerManifestListMediaType, dockerManifestMediaType)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxOCIManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", reference, err)
+	}
+	if strings.HasPrefix(reference, "sha256:") {
+		if sum := sha256.Sum256(data); "sha256:"+hex.EncodeToString(sum[:]) != reference {
+			return nil, fmt.Errorf("manifest %s does not match its digest", reference)
+		}
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", reference, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	}
+
+	switch manifest.MediaType {
+	case ociManifestMediaType, dockerManifestMediaType:
+		return &manifest, nil
+	case ociIndexMediaType, dockerManifestListMediaType:
+	default:
+		return nil, fmt.Errorf("unsupported manifest type %q", manifest.MediaType)
+	}
+	if len(manifest.Manifests) == 0 {
+		return nil, fmt.Errorf("image index %s lists no manifests", reference)
+	}
+	chosen := manifest.Manifests[0]
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+			chosen = m
+			break
+		}
+	}
+	if strings.HasPrefix(chosen.MediaType, "application/vnd.oci.image.index") || chosen.MediaType == dockerManifestListMediaType {
+		return nil, fmt.Errorf("nested image index %s is not supported", chosen.Digest)
+	}
+	return r.manifest(chosen.Digest)
+}
+
+// applyLayer downloads the layer and extracts it over rootfs, checking its digest
+func (r *ociRegistry) applyLayer(layer ociDescriptor, rootfs string) error {
+	if !strings.HasPrefix(layer.Digest, "sha256:") {
+		return fmt.Errorf("unsupported layer digest %q", layer.Digest)
+	}
+	resp, err := r.get("blobs", layer.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	body := bufio.NewReader(io.TeeReader(resp.Body, h))
+	var content io.Reader = body
+	// gzip layers are told apart by content as some registries report the media type loosely
+	if magic, _ := body.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		content = gz
+	} else if strings.Contains(layer.MediaType, "zstd") {
+		return fmt.Errorf("layer %s is zstd compressed, which is not supported", layer.Digest)
+	}
+	if err := extractOCILayer(content, rootfs); err != nil {
+		return fmt.Errorf("failed to extract layer %s: %w", layer.Digest, err)
+	}
+	// the rest of the blob, such as tar padding, counts towards the digest
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if "sha256:"+hex.EncodeToString(h.Sum(nil)) != layer.Digest {
+		return fmt.Errorf("layer %s does not match its digest", layer.Digest)
+	}
+	return nil
+}
+
+// fetchOCIImage extracts the filesystem of the image source refers to into a temp dir under dataDir and returns
+// its path, the caller removes it
+// device nodes and fifos are left out as they can't be packaged into an iso
+func fetchOCIImage(source, dataDir, user, password string) (string, error) {
+	ref, err := parseOCIReference(source)
+	if err != nil {
+		return "", err
+	}
+	registry := newOCIRegistry(ref, user, password)
+	manifest, err := registry.manifest(ref.manifestReference())
+	if err != nil {
+		return "", fmt.Errorf("failed to get image %s: %w", strings.TrimPrefix(source, ociSourcePrefix), err)
+	}
+
+	rootfs, err := os.MkdirTemp(dataDir, "oci-source-")
+	if err != nil {
+		return "", err
+	}
+	for _, layer := range manifest.Layers {
+		if err := registry.applyLayer(layer, rootfs); err != nil {
+			os.RemoveAll(rootfs)
+			return "", fmt.Errorf("failed to get image %s: %w", strings.TrimPrefix(source, ociSourcePrefix), err)
+		}
+	}
+	return rootfs, nil
+}
+
+// extractOCILayer extracts the layer tarball read from r over rootfs, applying its whiteouts to the layers below
+// entries are never written through a symlink so a layer can't reach outside rootfs
+func extractOCILayer(r io.Reader, rootfs string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if rel == "" {
+			continue
+		}
+		dir, base := path.Split(rel)
+		if err := checkNoSymlinks(rootfs, dir); err != nil {
+			return err
+		}
+		dest := filepath.Join(rootfs, filepath.FromSlash(rel))
+
+		switch {
+		case base == ociOpaqueWhiteout:
+			entries, err := os.ReadDir(filepath.Dir(dest))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(filepath.Join(filepath.Dir(dest), e.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		case strings.HasPrefix(base, ociWhiteoutPrefix):
+			if err := os.RemoveAll(filepath.Join(filepath.Dir(dest), strings.TrimPrefix(base, ociWhiteoutPrefix))); err != nil {
+				return err
+			}
+			continue
+		}
+
+		mode := hdr.FileInfo().Mode().Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+				if err := os.Remove(dest); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(dest, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.RemoveAll(dest); err != nil {
+				return err
+			}
+			if err := writeArchiveFile(tr, dest, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.RemoveAll(dest); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target := strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+			if err := checkNoSymlinks(rootfs, target); err != nil {
+				return err
+			}
+			src, err := os.Open(filepath.Join(rootfs, filepath.FromSlash(target)))
+			if err != nil {
+				return fmt.Errorf("failed to link %s: %w", rel, err)
+			}
+			err = os.RemoveAll(dest)
+			if err == nil {
+				err = writeArchiveFile(src, dest, mode)
+			}
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkNoSymlinks returns an error if any existing component of rel under rootfs is a symlink
+func checkNoSymlinks(rootfs, rel string) error {
+	p := rootfs
+	for _, part := range strings.Split(strings.Trim(rel, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		p = filepath.Join(p, part)
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s passes through the symlink %s", rel, strings.TrimPrefix(p, rootfs))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRegistry serves the manifests and blobs of org/bundle by digest, and its v1 tag, to requests with the bearer
+// token it hands out for user and password
+type fakeRegistry struct {
+	mu      sync.Mutex
+	t       *testing.T
+	server  *httptest.Server
+	blobs   map[string][]byte
+	tag     []byte
+	tokens  int
+	scope   string
+	service string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{t: t, blobs: map[string][]byte{}}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// add stores data as a blob or manifest and returns its digest
+func (r *fakeRegistry) add(data []byte) string {
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	r.blobs[digest] = data
+	return digest
+}
+
+// addJSON stores v as a manifest and returns its descriptor
+func (r *fakeRegistry) addJSON(mediaType string, v interface{}) ociDescriptor {
+	data, err := json.Marshal(v)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: r.add(data)}
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		if user, password, ok := req.BasicAuth(); !ok || user != "user" || password != "password" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		r.tokens++
+		r.scope, r.service = req.URL.Query().Get("scope"), req.URL.Query().Get("service")
+		json.NewEncoder(w).Encode(map[string]string{"token": "registry-token"})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer registry-token" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="fake-registry",scope="repository:org/bundle:pull"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	reference := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	data, ok := r.blobs[reference]
+	if reference == "v1" {
+		data, ok = r.tag, true
+	}
+	if !ok || !strings.HasPrefix(req.URL.Path, "/v2/org/bundle/") {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(data)
+}
+
+func TestFetchOCIImage(t *testing.T) {
+	registry := newFakeRegistry(t)
+	base := registry.add(tarData(t, []archiveEntry{
+		{name: "dir/", dir: true},
+		{name: "dir/removed", content: "removed"},
+		{name: "dir/kept", content: "kept"},
+		{name: "opaque/", dir: true},
+		{name: "opaque/replaced", content: "replaced"},
+		{name: "overwritten", content: "old"},
+	}, true))
+	top := registry.add(tarData(t, []archiveEntry{
+		{name: "dir/.wh.removed"},
+		{name: "opaque/.wh..wh..opq"},
+		{name: "opaque/added", content: "added"},
+		{name: "overwritten", content: "new"},
+		{name: "new", content: "new"},
+	}, false))
+	image := registry.addJSON(ociManifestMediaType, ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers:    []ociDescriptor{{Digest: base}, {Digest: top}},
+	})
+	// the manifest of another platform listed first, with a layer the registry doesn't have
+	other := registry.addJSON(ociManifestMediaType, ociManifest{
+		MediaType: ociManifestMediaType,
+		Layers:    []ociDescriptor{{Digest: "sha256:" + strings.Repeat("0", 64)}},
+	})
+	platform := func(arch string) map[string]string { return map[string]string{"architecture": arch, "os": "linux"} }
+	indexData, err := json.Marshal(map[string]interface{}{
+		"mediaType": ociIndexMediaType,
+		"manifests": []map[string]interface{}{
+			{"mediaType": other.MediaType, "digest": other.Digest, "platform": platform("not-" + runtime.GOARCH)},
+			{"mediaType": image.MediaType, "digest": image.Digest, "platform": platform(runtime.GOARCH)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.tag = indexData
+	indexDigest := registry.add(indexData)
+
+	host := strings.TrimPrefix(registry.server.URL, "http://")
+	for name, source := range map[string]string{
+		"tag":    ociSourcePrefix + host + "/org/bundle:v1",
+		"digest": ociSourcePrefix + host + "/org/bundle@" + indexDigest,
+	} {
+		t.Run(name, func(t *testing.T) {
+			rootfs, err := fetchOCIImage(source, t.TempDir(), "user", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{
+				"dir/kept":     "kept",
+				"opaque/added": "added",
+				"overwritten":  "new",
+				"new":          "new",
+			} {
+				data, err := os.ReadFile(filepath.Join(rootfs, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("%s has %q, expected %q", name, data, content)
+				}
+			}
+			for _, name := range []string{"dir/removed", "dir/.wh.removed", "opaque/replaced", "opaque/.wh..wh..opq"} {
+				if _, err := os.Lstat(filepath.Join(rootfs, filepath.FromSlash(name))); !os.IsNotExist(err) {
+					t.Errorf("%s is in the image, expected it to be removed by a whiteout", name)
+				}
+			}
+		})
+	}
+
+	registry.mu.Lock()
+	if registry.tokens != 2 {
+		t.Errorf("expected a token to be fetched for each image, got %d", registry.tokens)
+	}
+	if registry.scope != "repository:org/bundle:pull" || registry.service != "fake-registry" {
+		t.Errorf("token was requested for scope %q and service %q, not the ones of the challenge", registry.scope, registry.service)
+	}
+
+	registry.mu.Unlock()
+	if _, err := fetchOCIImage(ociSourcePrefix+host+"/org/bundle:v1", t.TempDir(), "user", "wrong"); err == nil {
+		t.Error("expected fetching with the wrong credentials to fail")
+	}
+	registry.mu.Lock()
+	registry.blobs[top] = tarData(t, []archiveEntry{{name: "tampered", content: "x"}}, false)
+	registry.mu.Unlock()
+	if _, err := fetchOCIImage(ociSourcePrefix+host+"/org/bundle:v1", t.TempDir(), "user", "password"); err == nil || !strings.Contains(err.Error(), "does not match its digest") {
+		t.Errorf("expected a layer that doesn't match its digest to be rejected, got %v", err)
+	}
+}
+
+func TestOCIImageSymlinks(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := registry.add(tarData(t, []archiveEntry{
+		{name: "usr/", dir: true},
+		{name: "usr/lib/", dir: true},
+		{name: "usr/lib/os-release", content: "ID=test"},
+		{name: "etc/", dir: true},
+		{name: "etc/os-release", linkname: "../usr/lib/os-release"},
+		{name: "etc/os-release.abs", linkname: "/usr/lib/os-release"},
+		{name: "lib", linkname: "usr/lib"},
+		// resolved through the directory link lib
+		{name: "etc/chained", linkname: "/lib/os-release"},
+		// absolute and escaping links are resolved in the image, not on the host building it
+		{name: "etc/hostname", linkname: "/etc/hostname"},
+		{name: "etc/passwd", linkname: "../../../../../../etc/passwd"},
+		{name: "etc/mtab", linkname: "/proc/self/mounts"},
+		{name: "loop", linkname: "loop"},
+	}, false))
+	manifest, err := json.Marshal(ociManifest{MediaType: ociManifestMediaType, Layers: []ociDescriptor{{Digest: layer}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.tag = manifest
+
+	host := strings.TrimPrefix(registry.server.URL, "http://")
+	dataDir := t.TempDir()
+	rootfs, err := fetchOCIImage(ociSourcePrefix+host+"/org/bundle:v1", dataDir, "user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir := t.TempDir()
+	if err := copySource(rootfs, "", dataDir, workDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	outPath := filepath.Join(t.TempDir(), "test.iso")
+	if err := create(outPath, workDir, "test", bootImages{}, rockRidgeFormat); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := openISO(t, outPath)
+	for _, p := range []string{"/usr/lib/os-release", "/etc/os-release", "/etc/os-release.abs", "/etc/chained"} {
+		if got := readISOFile(t, fs, p); got != "ID=test" {
+			t.Errorf("%s has %q, expected the file it links to", p, got)
+		}
+	}
+	for _, name := range []string{"lib", "etc/hostname", "etc/passwd", "etc/mtab", "loop"} {
+		if _, err := os.Lstat(filepath.Join(workDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("%s doesn't link to a file in the image, expected it to be left out", name)
+		}
+	}
+}
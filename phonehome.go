@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	phoneHomeScriptName = "phone-home.sh"
+	phoneHomeURLName    = "phone-home-url"
+	// how often waiters check for a callback
+	phoneHomePollInterval = time.Second
+	// largest callback body read, it only carries the system uuid
+	maxPhoneHomeBody = 1024
+)
+
+// phoneHomeScript is written into the iso for the booted host to run, %s is replaced with the callback URL
+const phoneHomeScript = `#!/bin/sh
+# confirms to simple-iso that this host booted the iso
+uuid=$(cat /sys/class/dmi/id/product_uuid 2>/dev/null)
+curl -fsS -X POST --data "$uuid" %[1]s || wget -q -O- --post-data "$uuid" %[1]s
+`
+
+// phoneHome records callbacks from hosts that booted the test iso
+// hosts identify themselves with their system uuid so callbacks can be matched to BMC targets
+type phoneHome struct {
+	mu    sync.Mutex
+	token string
+	url   string
+	// time each system uuid called back, lowercased
+	arrived map[string]time.Time
+	// whether any callback arrived, used for systems that don't report a uuid
+	any bool
+}
+
+// newPhoneHome returns a phoneHome accepting callbacks to baseURL/api/phone-home/token
+func newPhoneHome(baseURL, token string) (*phoneHome, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("BASE_URL must be set to phone home")
+	}
+	return &phoneHome{
+		token:   token,
+		url:     strings.TrimSuffix(baseURL, "/") + "/api/phone-home/" + token,
+		arrived: make(map[string]time.Time),
+	}, nil
+}
+
+// handler records a POST to the token path, the request path is expected to be relative to /api/phone-home/
+func (p *phoneHome) handler(log *logrus.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(r.URL.Path, "/")), []byte(p.token)) != 1 {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxPhoneHomeBody))
+		if err != nil {
+			http.Error(w, "failed to read body", http.StatusBadRequest)
+			return
+		}
+		uuid := strings.ToLower(strings.TrimSpace(string(body)))
+		log.Infof("host %q phoned home from %s", uuid, r.RemoteAddr)
+
+		p.mu.Lock()
+		p.arrived[uuid] = time.Now()
+		p.any = true
+		p.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// wait blocks until the host with systemUUID calls back, timeout elapses, or ctx is done
+// if systemUUID is empty any callback is accepted
+func (p *phoneHome) wait(ctx context.Context, systemUUID string, timeout time.Duration) error {
+	systemUUID = strings.ToLower(systemUUID)
+	deadline := time.Now().Add(timeout)
+	for {
+		p.mu.Lock()
+		_, ok := p.arrived[systemUUID]
+		if systemUUID == "" {
+			ok = p.any
+		}
+		p.mu.Unlock()
+		if ok {
+			return nil
+		}
+		if time.Now().Add(phoneHomePollInterval).After(deadline) {
+			return wrapError(ErrNoPhoneHome, fmt.Errorf("no callback from system %q within %s", systemUUID, timeout))
+		}
+		if err := sleepContext(ctx, phoneHomePollInterval); err != nil {
+			return err
+		}
+	}
+}
+
+// writeFiles writes the callback script and URL into the root of workDir
+func (p *phoneHome) writeFiles(workDir string) error {
+	script := fmt.Sprintf(phoneHomeScript, p.url)
+	if err := os.WriteFile(filepath.Join(workDir, phoneHomeScriptName), []byte(script), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(workDir, phoneHomeURLName), []byte(p.url+"\n"), 0644)
+}
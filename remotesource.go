@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// remoteSourceTimeout bounds the whole download of a remote source
+const remoteSourceTimeout = 10 * time.Minute
+
+// isRemoteSource returns true if source is an http or https URL of an archive, an OCI image, or ConfigMaps and
+// Secrets rather than a local path
+func isRemoteSource(source string) bool {
+	return isHTTPSource(source) || isOCISource(source) || isKubeSource(source)
+}
+
+// isHTTPSource returns true if source is an http or https URL of an archive
+func isHTTPSource(source string) bool {
+	lower := strings.ToLower(source)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// fetchRemoteSource downloads the tarball, zip, or git archive at source into a temp file under dataDir and returns
+// its path, the caller removes it
+// the download must have checksum as its hex encoded sha256 if one is set, credentials may be given in the URL
+func fetchRemoteSource(source, dataDir, checksum string) (string, error) {
+	client := &http.Client{Timeout: remoteSourceTimeout}
+	resp, err := client.Get(source)
+	if err != nil {
+		return "", fmt.Errorf("failed to download source: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download source %s: %s", redactURL(source), resp.Status)
+	}
+
+	f, err := os.CreateTemp(dataDir, "remote-source-")
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(f, io.TeeReader(resp.Body, h)); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to download source %s: %w", redactURL(source), err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); checksum != "" && !strings.EqualFold(sum, checksum) {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("source %s has sha256 %s, expected %s", redactURL(source), sum, checksum)
+	}
+	return f.Name(), nil
+}
+
+// redactURL returns rawURL with any password replaced so it can be logged
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// remoteSources downloads each remote source needed by a build once, however many isos are built from it
+type remoteSources struct {
+	dataDir string
+	// credentials for the registries of OCI sources, anonymous when empty
+	registryUser     string
+	registryPassword string
+	// namespace of the ConfigMaps and Secrets of kube sources, the pod's namespace when empty
+	kubeNamespace string
+	// local copy of each URL and checksum downloaded
+	paths map[string]string
+	// resource version the objects of kube sources were read at
+	kubeVersions map[kubeObject]string
+}
+
+// local returns the path source can be read from, downloading it first if it is a URL not yet downloaded with checksum
+// or extracting it if it is an OCI image, which is verified by its digests rather than a checksum, or reading its
+// ConfigMaps and Secrets
+func (s *remoteSources) local(source, checksum string) (string, error) {
+	if !isRemoteSource(source) {
+		return source, nil
+	}
+	key := source + "\x00" + strings.ToLower(checksum)
+	if p, ok := s.paths[key]; ok {
+		return p, nil
+	}
+	var p string
+	var err error
+	switch {
+	case isOCISource(source):
+		if checksum != "" {
+			return "", fmt.Errorf("a checksum is not supported for OCI image %s, reference it by digest instead", source)
+		}
+		p, err = fetchOCIImage(source, s.dataDir, s.registryUser, s.registryPassword)
+	case isKubeSource(source):
+		if checksum != "" {
+			return "", fmt.Errorf("a checksum is not supported for kube source %s", source)
+		}
+		var versions map[kubeObject]string
+		p, versions, err = fetchKubeSource(source, s.dataDir, s.kubeNamespace)
+		if s.kubeVersions == nil {
+			s.kubeVersions = make(map[kubeObject]string)
+		}
+		for obj, version := range versions {
+			s.kubeVersions[obj] = version
+		}
+	default:
+		p, err = fetchRemoteSource(source, s.dataDir, checksum)
+	}
+	if err != nil {
+		return "", err
+	}
+	if s.paths == nil {
+		s.paths = make(map[string]string)
+	}
+	s.paths[key] = p
+	return p, nil
+}
+
+// remove deletes the downloaded sources
+func (s *remoteSources) remove() {
+	for _, p := range s.paths {
+		os.RemoveAll(p)
+	}
+}
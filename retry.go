@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+)
+
+// retryBMCCall calls fn until it succeeds, fails with an error that isn't transient,
+// or has been retried Options.BMCRetries times, fn is not called again once ctx is done
+// the wait between attempts starts at Options.BMCRetryBackoff and doubles up to Options.BMCRetryMaxBackoff,
+// with jitter so BMCs tested concurrently don't retry in lockstep
+func retryBMCCall(ctx context.Context, log *logrus.Entry, action string, fn func() error) error {
+	backoff := Options.BMCRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn()
+		if err == nil || attempt >= Options.BMCRetries || !transientBMCError(err) {
+			return err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.WithError(err).Warnf("%s failed, retrying in %s (%d/%d)", action, wait, attempt+1, Options.BMCRetries)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > Options.BMCRetryMaxBackoff {
+			backoff = Options.BMCRetryMaxBackoff
+		}
+	}
+}
+
+// transientBMCError returns true for errors a BMC is likely to recover from, such as those returned while
+// it is busy after a reset, and for requests that failed before getting a response
+// responses with Retry-After aren't, retryAfterTransport has already waited on them as long as it could
+func transientBMCError(err error) bool {
+	var retryAfterErr *retryAfterError
+	if errors.As(err, &retryAfterErr) {
+		return false
+	}
+	var redfishErr *common.Error
+	if errors.As(err, &redfishErr) {
+		switch redfishErr.HTTPReturnedStatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// sleepContext waits for d and returns early with the error of ctx if it is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// screenshotMaxSize limits how much of a screenshot response is read
+const screenshotMaxSize = 32 << 20
+
+// captureScreenshot saves a screenshot of the host console under DATA_DIR/screenshots using the first OEM
+// screenshot action found on a manager of system and returns the path of the image
+// redfish has no standard screenshot action so the manager and, on iDRAC, its DellLCService are searched for one
+func captureScreenshot(log *logrus.Entry, client common.Client, system *redfish.ComputerSystem, address string) (string, error) {
+	for _, m := range system.ManagedBy {
+		action, target, err := screenshotAction(client, m)
+		if err != nil {
+			return "", err
+		}
+		if target == "" {
+			continue
+		}
+		log.Debugf("taking screenshot with %s", action)
+
+		var payload interface{} = struct{}{}
+		if strings.HasSuffix(action, ".ExportServerScreenShot") {
+			payload = map[string]string{"FileType": "ServerScreenShot"}
+		}
+		resp, err := client.Post(target, payload)
+		if err != nil {
+			return "", fmt.Errorf("failed to take screenshot with %s: %w", action, err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, screenshotMaxSize))
+		if err != nil {
+			return "", fmt.Errorf("failed to read screenshot: %w", err)
+		}
+		image := screenshotImage(body)
+		if image == nil {
+			return "", fmt.Errorf("%s response doesn't contain an image", action)
+		}
+
+		path, err := bmcArtifactPath("screenshots", address, screenshotExtension(image))
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, image, 0644); err != nil {
+			return "", fmt.Errorf("failed to write screenshot: %w", err)
+		}
+		return path, nil
+	}
+	return "", fmt.Errorf("BMC has no screenshot action")
+}
+
+// screenshotAction returns the name and target of a screenshot action of the manager at managerURI,
+// or an empty target if it has none
+func screenshotAction(client common.Client, managerURI string) (string, string, error) {
+	var manager struct {
+		Actions interface{}
+		Links   struct {
+			Oem struct {
+				Dell struct {
+					DellLCService common.Link
+				}
+			}
+		}
+	}
+	if err := getJSON(client, managerURI, &manager); err != nil {
+		return "", "", err
+	}
+	if action, target := findScreenshotAction(manager.Actions); target != "" {
+		return action, target, nil
+	}
+
+	lcService := string(manager.Links.Oem.Dell.DellLCService)
+	if lcService == "" {
+		return "", "", nil
+	}
+	var service struct {
+		Actions interface{}
+	}
+	if err := getJSON(client, lcService, &service); err != nil {
+		return "", "", err
+	}
+	action, target := findScreenshotAction(service.Actions)
+	return action, target, nil
+}
+
+// findScreenshotAction searches decoded redfish actions, including nested Oem ones, for a screenshot action
+func findScreenshotAction(actions interface{}) (string, string) {
+	members, ok := actions.(map[string]interface{})
+	if !ok {
+		return "", ""
+	}
+	for name, value := range members {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "screenshot") || strings.Contains(lower, "capturescreen") {
+			if action, ok := value.(map[string]interface{}); ok {
+				if target, ok := action["target"].(string); ok && target != "" {
+					return name, target
+				}
+			}
+		}
+		if action, target := findScreenshotAction(value); target != "" {
+			return action, target
+		}
+	}
+	return "", ""
+}
+
+// screenshotImage returns the image in a screenshot response, which is either the image itself
+// or a JSON object with the image base64 encoded in one of its properties
+func screenshotImage(body []byte) []byte {
+	if strings.HasPrefix(http.DetectContentType(body), "image/") {
+		return body
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
+	for _, value := range fields {
+		encoded, ok := value.(string)
+		if !ok {
+			continue
+		}
+		image, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil && strings.HasPrefix(http.DetectContentType(image), "image/") {
+			return image
+		}
+	}
+	return nil
+}
+
+// screenshotExtension returns the file extension for image
+func screenshotExtension(image []byte) string {
+	switch http.DetectContentType(image) {
+	case "image/jpeg":
+		return "jpg"
+	case "image/bmp":
+		return "bmp"
+	case "image/gif":
+		return "gif"
+	}
+	return "png"
+}
+
+// bmcArtifactPath returns a new path under DATA_DIR/dir for a file about the BMC at address
+// named after its host and the current time
+func bmcArtifactPath(dir, address, extension string) (string, error) {
+	host := address
+	if bmcURL, err := url.Parse(address); err == nil && bmcURL.Hostname() != "" {
+		host = bmcURL.Hostname()
+	}
+	dir = filepath.Join(Options.DataDir, dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	name := fmt.Sprintf("%s-%s.%s", strings.ReplaceAll(host, ":", "_"), time.Now().UTC().Format("20060102T150405Z"), extension)
+	return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// loadTLSConfig returns the TLS config for the server or nil if neither certFile nor keyFile are set
+// setting only one of them, or a keypair that can't be loaded, is an error rather than a fallback to plain http
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both HTTPS_CERT_FILE and HTTPS_KEY_FILE must be set to serve https")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load https keypair from %s and %s: %w", certFile, keyFile, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// tlsEnabled returns true if the server is configured to serve https
+func tlsEnabled(certFile, keyFile string) bool {
+	return certFile != "" || keyFile != ""
+}
+
+// startHTTPServer serves the contents of isoDirs under /images/, earlier dirs take precedence on name collisions
+// PUT requests under /images/ are passed to upload, or rejected if it is nil
+func startHTTPServer(log *logrus.Logger, isoDirs []string, expiry *isoExpiry, tracker *downloadTracker, downloadRateLimit int64, maxConcurrentDownloads int, isoContentType string, upload http.Handler, addr string, tlsConfig *tls.Config) *http.Server {
+	fsys := mergedDirs(isoDirs)
+	fileServer := throttleHandler(downloadRateLimit, etagHandler(fsys, isoContentTypeHandler(isoContentType, http.FileServer(fsys))))
+	downloads := concurrencyLimitHandler(maxConcurrentDownloads, expiry.handler(tracker.handler(fileServer)))
+	http.Handle("/images/", http.StripPrefix("/images/", imagesHandler(downloads, upload)))
+	server := &http.Server{
+		Addr:      addr,
+		TLSConfig: tlsConfig,
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			log.Infof("Starting https handler on %s...", server.Addr)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("Starting http handler on %s...", server.Addr)
+			err = server.ListenAndServe()
+		}
+
+		if err != http.ErrServerClosed {
+			log.WithError(err).Fatalf("HTTP listener closed: %v", err)
+		}
+	}()
+
+	return server
+}
+
+// imagesHandler sends PUT requests to upload and everything else to downloads
+func imagesHandler(downloads, upload http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			downloads.ServeHTTP(w, r)
+			return
+		}
+		if upload == nil {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		upload.ServeHTTP(w, r)
+	})
+}
+
+// isoContentTypeHandler sets the Content-Type of .iso responses to contentType
+// http.FileServer keeps a Content-Type that's already set rather than detecting one
+func isoContentTypeHandler(contentType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(strings.ToLower(r.URL.Path), ".iso") {
+			w.Header().Set("Content-Type", contentType)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// localServerAddress returns an address that reaches a server listening on bindAddress and port from this host
+func localServerAddress(bindAddress, port string) string {
+	if addr, err := netip.ParseAddr(bindAddress); err != nil || addr.IsUnspecified() {
+		bindAddress = "localhost"
+	}
+	return net.JoinHostPort(bindAddress, port)
+}
+
+// waitForServerReady polls addr with exponential backoff until it accepts connections or timeout elapses
+func waitForServerReady(log *logrus.Logger, addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 50 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			log.Debugf("server is accepting connections on %s", addr)
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("server on %s not ready after %s: %w", addr, timeout, err)
+		}
+		log.Debugf("server not ready yet, retrying in %s", backoff)
+		time.Sleep(backoff)
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// waitForShutDown shuts server down once ctx is done
+func waitForShutDown(ctx context.Context, log *logrus.Logger, server *http.Server) {
+	<-ctx.Done()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		log.WithError(err).Errorf("shutdown failed")
+		if err := server.Close(); err != nil {
+			log.WithError(err).Fatal("emergency shutdown failed")
+		}
+	} else {
+		log.Infof("server terminated gracefully")
+	}
+}
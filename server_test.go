@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestISOContentTypeHandler(t *testing.T) {
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "test.iso"), 'a', 64*1024)
+	if err := os.WriteFile(filepath.Join(isosDir, "test.iso"+checksumSuffix), []byte("abc  test.iso\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const contentType = "application/x-iso9660-image"
+	server := httptest.NewServer(isoContentTypeHandler(contentType, http.FileServer(mergedDirs{isosDir})))
+	defer server.Close()
+
+	get := func(path, rangeHeader string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := get("/test.iso", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET returned %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != contentType {
+		t.Fatalf("iso has Content-Type %q, expected %q", got, contentType)
+	}
+
+	resp = get("/test.iso", "bytes=100-199")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("range GET returned %d, expected %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	if got := resp.Header.Get("Content-Type"); got != contentType {
+		t.Fatalf("range of the iso has Content-Type %q, expected %q", got, contentType)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 100-199/65536" {
+		t.Fatalf("range of the iso has Content-Range %q", got)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != strings.Repeat("a", 100) {
+		t.Fatalf("range of the iso has %d bytes of unexpected content", len(body))
+	}
+
+	resp = get("/test.iso"+checksumSuffix, "")
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Fatalf("checksum file has Content-Type %q, expected it to be detected as text", got)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish"
+)
+
+// logoutTimeout is how long deleting a redfish session may take, it has its own context as the one the client was
+// created with is often done by the time the session is ended
+const logoutTimeout = 10 * time.Second
+
+// bmcSessions tracks the redfish sessions open on BMCs so every one is ended, including on shutdown
+var bmcSessions = &sessionTracker{open: make(map[*gofish.APIClient]*bmcSession)}
+
+// bmcSession is a redfish session created by connecting a client with session auth
+type bmcSession struct {
+	log        *logrus.Entry
+	httpClient *http.Client
+	// endpoint of the BMC, the session URI is relative to it
+	endpoint string
+	session  *gofish.Session
+}
+
+// sessionTracker holds the sessions that haven't been logged out yet by client
+type sessionTracker struct {
+	mu   sync.Mutex
+	open map[*gofish.APIClient]*bmcSession
+}
+
+// track records the session of client, clients without one are ignored
+func (t *sessionTracker) track(log *logrus.Entry, httpClient *http.Client, endpoint string, client *gofish.APIClient) {
+	session, err := client.GetSession()
+	if err != nil {
+		// basic auth, there is nothing to end
+		return
+	}
+	t.mu.Lock()
+	t.open[client] = &bmcSession{log: log, httpClient: httpClient, endpoint: endpoint, session: session}
+	t.mu.Unlock()
+}
+
+// logout ends the session of client if it is still open
+func (t *sessionTracker) logout(client *gofish.APIClient) {
+	t.mu.Lock()
+	s, ok := t.open[client]
+	delete(t.open, client)
+	t.mu.Unlock()
+	if ok {
+		s.logout()
+	}
+}
+
+// logoutAll ends every session still open, for connections abandoned by shutting down
+func (t *sessionTracker) logoutAll() {
+	t.mu.Lock()
+	open := t.open
+	t.open = make(map[*gofish.APIClient]*bmcSession)
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range open {
+		wg.Add(1)
+		go func(s *bmcSession) {
+			defer wg.Done()
+			s.log.Info("ending redfish session left open at shutdown")
+			s.logout()
+		}(s)
+	}
+	wg.Wait()
+}
+
+// logout deletes the session, failures are only logged as the BMC expires the session eventually
+func (s *bmcSession) logout() {
+	if err := s.delete(); err != nil {
+		s.log.WithError(err).Warnf("failed to end redfish session %s", s.session.ID)
+		return
+	}
+	s.log.Debugf("ended redfish session %s", s.session.ID)
+}
+
+// delete sends the DELETE for the session authenticated with its own token
+// a session the BMC no longer knows about has already ended
+func (s *bmcSession) delete() error {
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, strings.TrimSuffix(s.endpoint, "/")+s.session.ID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", s.session.Token)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("BMC responded %s", resp.Status)
+	}
+	return nil
+}
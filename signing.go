@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signatureSuffix is appended to the name of a served image for its detached signature
+const signatureSuffix = ".sig"
+
+// isoSigner makes detached GPG signatures of served images with gpg
+type isoSigner struct {
+	// key ID, fingerprint, or user ID of the secret key to sign with
+	key string
+	// GnuPG home dir of the keyring, the default of gpg when empty
+	home string
+	// file holding the passphrase of the key, unset if it has none
+	passphraseFile string
+}
+
+// newISOSigner returns a signer using key from the keyring in home, checking that gpg has its secret key
+func newISOSigner(key, home, passphraseFile string) (*isoSigner, error) {
+	s := &isoSigner{key: key, home: home, passphraseFile: passphraseFile}
+	if _, err := s.gpg("--list-secret-keys", key); err != nil {
+		return nil, fmt.Errorf("failed to find GPG secret key %s: %w", key, err)
+	}
+	return s, nil
+}
+
+// gpg runs gpg non-interactively on the keyring of the signer and returns its output
+func (s *isoSigner) gpg(args ...string) (string, error) {
+	base := []string{"--batch", "--no-tty"}
+	if s.home != "" {
+		base = append(base, "--homedir", s.home)
+	}
+	cmd := exec.Command("gpg", append(base, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", fmt.Errorf("gpg failed: %w", err)
+	}
+	return string(out), nil
+}
+
+// sign writes the detached signature of the image at path next to it
+// the file is replaced by a rename so a reader never sees it half written
+func (s *isoSigner) sign(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".signature-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	args := []string{"--yes", "--local-user", s.key}
+	if s.passphraseFile != "" {
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-file", s.passphraseFile)
+	}
+	if _, err := s.gpg(append(args, "--output", f.Name(), "--detach-sign", path)...); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path+signatureSuffix)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// path inside the iso of the authorized_keys file written when SSH keys are set
+const sshAuthorizedKeysPath = "ssh/authorized_keys"
+
+// sshKeyTypePrefixes start the key types OpenSSH accepts in authorized_keys
+var sshKeyTypePrefixes = []string{"ssh-", "ecdsa-sha2-", "sk-ssh-", "sk-ecdsa-sha2-"}
+
+// loadSSHAuthorizedKeys returns keys followed by the keys in the authorized_keys file at path, if set
+// blank lines and comments of the file are skipped, every key must start with its type and the base64 key
+func loadSSHAuthorizedKeys(keys []string, path string) ([]string, error) {
+	var loaded []string
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			loaded = append(loaded, key)
+		}
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSH authorized keys: %w", err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				loaded = append(loaded, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read SSH authorized keys %s: %w", path, err)
+		}
+	}
+	for _, key := range loaded {
+		if err := checkSSHPublicKey(key); err != nil {
+			return nil, err
+		}
+	}
+	return loaded, nil
+}
+
+// checkSSHPublicKey returns an error if key doesn't look like an authorized_keys line without options
+func checkSSHPublicKey(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) >= 2 {
+		for _, prefix := range sshKeyTypePrefixes {
+			if strings.HasPrefix(fields[0], prefix) {
+				return nil
+			}
+		}
+	}
+	short := key
+	if len(short) > 20 {
+		short = short[:20] + "..."
+	}
+	return fmt.Errorf("SSH public key %q must start with its type, such as ssh-ed25519, followed by the key", short)
+}
+
+// writeSSHAuthorizedKeys writes keys as an authorized_keys file at its path in workDir
+func writeSSHAuthorizedKeys(workDir string, keys []string) error {
+	dest := filepath.Join(workDir, filepath.FromSlash(sshAuthorizedKeysPath))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, []byte(strings.Join(keys, "\n")+"\n"), 0644)
+}
+
+// addIgnitionSSHKeys returns the Ignition config with keys added to the authorized keys of the core user,
+// which is added if the config has no such user
+func addIgnitionSSHKeys(config []byte, keys []string) ([]byte, error) {
+	var ign map[string]interface{}
+	if err := json.Unmarshal(config, &ign); err != nil {
+		return nil, fmt.Errorf("failed to decode Ignition config: %w", err)
+	}
+	passwd, _ := ign["passwd"].(map[string]interface{})
+	if passwd == nil {
+		passwd = map[string]interface{}{}
+		ign["passwd"] = passwd
+	}
+	users, _ := passwd["users"].([]interface{})
+	var core map[string]interface{}
+	for _, u := range users {
+		if user, ok := u.(map[string]interface{}); ok && user["name"] == "core" {
+			core = user
+			break
+		}
+	}
+	if core == nil {
+		core = map[string]interface{}{"name": "core"}
+		users = append(users, core)
+		passwd["users"] = users
+	}
+	existing, _ := core["sshAuthorizedKeys"].([]interface{})
+	for _, key := range keys {
+		existing = append(existing, key)
+	}
+	core["sshAuthorizedKeys"] = existing
+	return json.Marshal(ign)
+}
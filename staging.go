@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// isoStaging collects newly built isos in a directory next to the served isos
+// so the whole set can be verified before any of them replaces what is being served
+type isoStaging struct {
+	dir     string
+	isosDir string
+	names   []string
+	// signs the staged isos when set
+	signer *isoSigner
+}
+
+// newISOStaging creates a staging directory on the same filesystem as isosDir so commits are renames
+// staged isos are signed with signer if it is set
+func newISOStaging(isosDir string, signer *isoSigner) (*isoStaging, error) {
+	dir, err := os.MkdirTemp(isosDir, ".staging-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging dir: %w", err)
+	}
+	return &isoStaging{dir: dir, isosDir: isosDir, signer: signer}, nil
+}
+
+// path returns where the iso called name should be built and adds it to the staged set
+func (s *isoStaging) path(name string) string {
+	s.names = append(s.names, name)
+	return filepath.Join(s.dir, name)
+}
+
+// commit verifies every staged iso and writes its sidecar checksum file and signature, then renames them over the
+// served copies and removes any of previous that is no longer staged
+// a served signature is removed rather than left to not match when the staged iso isn't signed
+// the sidecars are moved before their iso so whoever finds the new iso also finds its checksum and signature
+// readers holding an old file open keep reading it as rename doesn't affect open files
+func (s *isoStaging) commit(previous []string) error {
+	for _, name := range s.names {
+		if err := verifyImage(filepath.Join(s.dir, name)); err != nil {
+			return fmt.Errorf("staged image %s is invalid: %w", name, err)
+		}
+		if _, err := writeChecksumFile(filepath.Join(s.dir, name)); err != nil {
+			return fmt.Errorf("failed to write checksum of %s: %w", name, err)
+		}
+		if s.signer != nil {
+			if err := s.signer.sign(filepath.Join(s.dir, name)); err != nil {
+				return fmt.Errorf("failed to sign %s: %w", name, err)
+			}
+		}
+	}
+
+	staged := make(map[string]bool, len(s.names))
+	for _, name := range s.names {
+		for _, suffix := range sidecarSuffixes {
+			src, dest := filepath.Join(s.dir, name)+suffix, filepath.Join(s.isosDir, name)+suffix
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to remove %s: %w", filepath.Base(dest), err)
+				}
+				continue
+			}
+			if err := os.Rename(src, dest); err != nil {
+				return fmt.Errorf("failed to move %s into place: %w", filepath.Base(dest), err)
+			}
+		}
+		if err := os.Rename(filepath.Join(s.dir, name), filepath.Join(s.isosDir, name)); err != nil {
+			return fmt.Errorf("failed to move %s into place: %w", name, err)
+		}
+		staged[name] = true
+	}
+	for _, name := range previous {
+		if staged[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.isosDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove obsolete iso %s: %w", name, err)
+		}
+		if err := removeSidecarFiles(filepath.Join(s.isosDir, name)); err != nil {
+			return fmt.Errorf("failed to remove the checksum or signature of obsolete iso %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// discard removes the staging directory and anything left in it
+func (s *isoStaging) discard() {
+	os.RemoveAll(s.dir)
+}
+
+// verifyImage checks that the file at path is a FAT image if its name ends in .img, otherwise an iso
+func verifyImage(path string) error {
+	if filepath.Ext(path) != ".img" {
+		return verifyISO(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkFATHeader(f)
+}
+
+// verifyISO checks that the file at path starts with an iso9660 primary volume descriptor
+func verifyISO(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return checkISOHeader(f)
+}
+
+// isoHeaderSize is the number of bytes from the start of an iso needed by checkISOHeader
+const isoHeaderSize = 16*2048 + 6
+
+// checkISOHeader returns an error if r doesn't start with an iso9660 volume descriptor
+func checkISOHeader(r io.ReaderAt) error {
+	// volume descriptors start at sector 16 with a type byte followed by the standard identifier
+	header := make([]byte, 6)
+	if _, err := r.ReadAt(header, 16*2048); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("file is too small to be an iso")
+		}
+		return err
+	}
+	if string(header[1:6]) != "CD001" {
+		return fmt.Errorf("missing iso9660 volume descriptor")
+	}
+	return nil
+}
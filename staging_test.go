@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFakeISO writes an image of size bytes filled with fill and an iso9660 volume descriptor where verifyISO
+// looks for one
+func writeFakeISO(t *testing.T, path string, fill byte, size int) {
+	t.Helper()
+	data := bytes.Repeat([]byte{fill}, size)
+	copy(data[16*2048:], "\x01CD001")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFill reads the rest of r, which is at offset in the image, and fails unless every byte outside the volume
+// descriptor is fill
+func readFill(t *testing.T, r io.Reader, offset int, fill byte) {
+	t.Helper()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range data {
+		if i += offset; (i < 16*2048 || i >= 16*2048+6) && b != fill {
+			t.Fatalf("byte %d is %#x, expected %#x", i, b, fill)
+		}
+	}
+}
+
+func TestStagingCommitUnderConcurrentReads(t *testing.T) {
+	isosDir := t.TempDir()
+	const size = 1 << 20
+	writeFakeISO(t, filepath.Join(isosDir, "a.iso"), 'a', size)
+	writeFakeISO(t, filepath.Join(isosDir, "obsolete.iso"), 'o', size)
+	server := httptest.NewServer(http.FileServer(mergedDirs{isosDir}))
+	defer server.Close()
+
+	// downloads started before the swap that are still going on after it
+	var downloads []*http.Response
+	for _, name := range []string{"a.iso", "obsolete.iso"} {
+		resp, err := http.Get(server.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if _, err := io.ReadFull(resp.Body, make([]byte, 4096)); err != nil {
+			t.Fatal(err)
+		}
+		downloads = append(downloads, resp)
+	}
+
+	staging, err := newISOStaging(isosDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.discard()
+	writeFakeISO(t, staging.path("a.iso"), 'b', size)
+	writeFakeISO(t, staging.path("new.iso"), 'n', size)
+	if err := staging.commit([]string{"a.iso", "obsolete.iso"}); err != nil {
+		t.Fatal(err)
+	}
+
+	readFill(t, downloads[0].Body, 4096, 'a')
+	readFill(t, downloads[1].Body, 4096, 'o')
+
+	for name, fill := range map[string]byte{"a.iso": 'b', "new.iso": 'n'} {
+		resp, err := http.Get(server.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readFill(t, resp.Body, 0, fill)
+		resp.Body.Close()
+		if _, err := os.Stat(filepath.Join(isosDir, name+checksumSuffix)); err != nil {
+			t.Fatalf("no checksum file for %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(isosDir, "obsolete.iso")); !os.IsNotExist(err) {
+		t.Fatalf("obsolete.iso was not removed: %v", err)
+	}
+}
+
+func TestStagingCommitRollsBackOnInvalidImage(t *testing.T) {
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "a.iso"), 'a', 64*1024)
+
+	staging, err := newISOStaging(isosDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFakeISO(t, staging.path("a.iso"), 'b', 64*1024)
+	if err := os.WriteFile(staging.path("broken.iso"), []byte("not an iso"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := staging.commit([]string{"a.iso"}); err == nil {
+		t.Fatal("expected the commit of an invalid iso to fail")
+	}
+	staging.discard()
+
+	f, err := os.Open(filepath.Join(isosDir, "a.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	readFill(t, f, 0, 'a')
+	entries, err := os.ReadDir(isosDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only a.iso to be left in the isos dir, got %d entries", len(entries))
+	}
+}
+
+func TestStagingCommitMovesSidecarsFirst(t *testing.T) {
+	isosDir := t.TempDir()
+	writeFakeISO(t, filepath.Join(isosDir, "a.iso"), 'a', 64*1024)
+	// a non-empty directory where the checksum goes can't be renamed over
+	if err := os.MkdirAll(filepath.Join(isosDir, "a.iso"+checksumSuffix, "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	staging, err := newISOStaging(isosDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.discard()
+	writeFakeISO(t, staging.path("a.iso"), 'b', 64*1024)
+	if err := staging.commit([]string{"a.iso"}); err == nil {
+		t.Fatal("expected the commit to fail when the checksum can't be moved into place")
+	}
+
+	// the new iso isn't served without its checksum
+	f, err := os.Open(filepath.Join(isosDir, "a.iso"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	readFill(t, f, 0, 'a')
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// taskPollInterval is how often a task monitor is polled for an action that completes asynchronously
+var taskPollInterval = time.Second
+
+// redfishTask is the part of a redfish Task needed to tell when it has finished and why it failed
+type redfishTask struct {
+	ODataID    string `json:"@odata.id"`
+	TaskState  string `json:"TaskState"`
+	TaskStatus string `json:"TaskStatus"`
+	Messages   []struct {
+		Message string `json:"Message"`
+	} `json:"Messages"`
+}
+
+// failed returns true if the task finished unsuccessfully
+func (t redfishTask) failed() bool {
+	switch t.TaskState {
+	case "Exception", "Killed", "Cancelled":
+		return true
+	}
+	return t.TaskStatus == "Critical"
+}
+
+// running returns true if the task hasn't finished yet
+func (t redfishTask) running() bool {
+	switch t.TaskState {
+	case "New", "Starting", "Running", "Pending", "Stopping", "Suspended", "Interrupted", "Service":
+		return true
+	}
+	return false
+}
+
+// messages joins the messages of the task
+func (t redfishTask) messages() string {
+	messages := make([]string, 0, len(t.Messages))
+	for _, m := range t.Messages {
+		messages = append(messages, m.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+// insertVirtualMediaConfig sends InsertMedia with config to vm and waits for the task if the BMC starts one
+func insertVirtualMediaConfig(ctx context.Context, client common.Client, vm *redfish.VirtualMedia, config redfish.VirtualMediaConfig) error {
+	if !vm.SupportsMediaInsert {
+		return errors.New("redfish service does not support VirtualMedia.InsertMedia calls")
+	}
+	return postVirtualMediaAction(ctx, client, vm.ODataID, "#VirtualMedia.InsertMedia", config)
+}
+
+// ejectVirtualMedia sends EjectMedia to vm and waits for the task if the BMC starts one
+func ejectVirtualMedia(ctx context.Context, client common.Client, vm *redfish.VirtualMedia) error {
+	if !vm.SupportsMediaEject {
+		return errors.New("redfish service does not support VirtualMedia.EjectMedia calls")
+	}
+	return postVirtualMediaAction(ctx, client, vm.ODataID, "#VirtualMedia.EjectMedia", struct{}{})
+}
+
+// postVirtualMediaAction posts payload to action of the virtual media at vmURI
+// gofish drops the response so the action target is looked up and posted to directly to see if a task was started
+func postVirtualMediaAction(ctx context.Context, client common.Client, vmURI, action string, payload interface{}) error {
+	var vm struct {
+		Actions map[string]struct {
+			Target string `json:"target"`
+		} `json:"Actions"`
+	}
+	if err := getJSON(client, vmURI, &vm); err != nil {
+		return err
+	}
+	target := vm.Actions[action].Target
+	if target == "" {
+		return fmt.Errorf("virtual media %s has no %s action", vmURI, action)
+	}
+	// the action is abandoned if ctx was done while looking it up
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	resp, err := client.Post(target, payload)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil
+	}
+	return waitForTask(ctx, client, resp, Options.BMCTaskTimeout)
+}
+
+// waitForTask follows the task started by the action that returned resp until it finishes or timeout elapses
+// a failed task is returned as an error including its messages
+func waitForTask(ctx context.Context, client common.Client, resp *http.Response, timeout time.Duration) error {
+	var task redfishTask
+	// the body is optional, an empty one leaves task unset
+	if err := json.NewDecoder(resp.Body).Decode(&task); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to decode task: %w", err)
+	}
+	monitor := resp.Header.Get("Location")
+	if monitor == "" {
+		monitor = task.ODataID
+	}
+	if monitor == "" {
+		// nothing to follow, the BMC only said the action was accepted
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if time.Now().Add(taskPollInterval).After(deadline) {
+			return fmt.Errorf("task %s did not finish within %s", monitor, timeout)
+		}
+		if err := sleepContext(ctx, taskPollInterval); err != nil {
+			return err
+		}
+
+		resp, err := client.Get(monitor)
+		if err != nil {
+			return fmt.Errorf("failed to get task %s: %w", monitor, err)
+		}
+		task = redfishTask{}
+		err = json.NewDecoder(resp.Body).Decode(&task)
+		resp.Body.Close()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to decode task %s: %w", monitor, err)
+		}
+
+		if task.failed() {
+			return fmt.Errorf("task %s %s: %s", monitor, strings.ToLower(task.TaskState), task.messages())
+		}
+		if resp.StatusCode != http.StatusAccepted && !task.running() {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stmcginnis/gofish"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+func TestInsertWaitsForTask(t *testing.T) {
+	withOptions(t)
+	Options.BMCTaskTimeout = 200 * time.Millisecond
+	saved := taskPollInterval
+	taskPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { taskPollInterval = saved })
+
+	const taskURI = "/redfish/v1/TaskService/Tasks/1"
+	for _, tc := range []struct {
+		name string
+		// task states reported by each poll, the last one repeated
+		states []string
+		// the insert responds with the task as its body rather than a Location header
+		inBody bool
+		err    string
+		polls  int
+	}{
+		{name: "completed", states: []string{"Running", "Running", "Completed"}, polls: 3},
+		{name: "task in the body", states: []string{"Completed"}, inBody: true, polls: 1},
+		{name: "failed", states: []string{"Running", "Exception"}, err: "exception: image unreachable", polls: 2},
+		{name: "timed out", states: []string{"Running"}, err: "did not finish within"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			polls := 0
+			server := serveMockBMC(t, map[string]http.HandlerFunc{
+				"POST " + mockVirtualMediaURI + "/Actions/VirtualMedia.InsertMedia": func(w http.ResponseWriter, r *http.Request) {
+					if tc.inBody {
+						w.WriteHeader(http.StatusAccepted)
+						json.NewEncoder(w).Encode(map[string]string{"@odata.id": taskURI, "TaskState": "New"})
+						return
+					}
+					w.Header().Set("Location", taskURI)
+					w.WriteHeader(http.StatusAccepted)
+				},
+				"GET " + taskURI: func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					state := tc.states[len(tc.states)-1]
+					if polls < len(tc.states) {
+						state = tc.states[polls]
+					}
+					polls++
+					mu.Unlock()
+					task := map[string]interface{}{"@odata.id": taskURI, "TaskState": state}
+					if state == "Exception" {
+						task["Messages"] = []map[string]string{{"Message": "image unreachable"}}
+					}
+					if state == "Running" {
+						w.WriteHeader(http.StatusAccepted)
+					}
+					json.NewEncoder(w).Encode(task)
+				},
+			})
+			client, err := gofish.ConnectDefault(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm, err := redfish.GetVirtualMedia(client, mockVirtualMediaURI)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = insertVirtualMediaConfig(context.Background(), client, vm, redfish.VirtualMediaConfig{Image: "http://example.com/test.iso"})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tc.polls != 0 && polls != tc.polls {
+				t.Fatalf("task was polled %d times, expected %d", polls, tc.polls)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// throttleHandler limits the rate at which each response from next is written to bytesPerSec
+// a limit of zero or less disables throttling
+func throttleHandler(bytesPerSec int64, next http.Handler) http.Handler {
+	if bytesPerSec <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&throttledResponseWriter{ResponseWriter: w, rate: bytesPerSec, start: time.Now()}, r)
+	})
+}
+
+// throttledResponseWriter writes in small chunks and sleeps as needed to keep the average rate at or below rate bytes per second
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	rate    int64
+	start   time.Time
+	written int64
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	// write roughly ten chunks per second so the rate is smooth rather than bursty
+	chunkSize := int(w.rate / 10)
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		total += n
+		w.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+
+		expected := time.Duration(float64(w.written) / float64(w.rate) * float64(time.Second))
+		if wait := expected - time.Since(w.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return total, nil
+}
+
+// downloadRetryAfter is the Retry-After value in seconds sent when too many downloads are in progress
+const downloadRetryAfter = "10"
+
+// concurrencyLimitHandler allows at most limit requests to be served by next at once
+// requests over the limit are rejected with 503 rather than queued, a limit of zero or less disables the check
+func concurrencyLimitHandler(limit int, next http.Handler) http.Handler {
+	if limit <= 0 {
+		return next
+	}
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", downloadRetryAfter)
+			http.Error(w, "too many concurrent downloads", http.StatusServiceUnavailable)
+		}
+	})
+}
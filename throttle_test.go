@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottleHandler(t *testing.T) {
+	const size, rate = 32 * 1024, 64 * 1024
+	minDuration := time.Duration(size) * time.Second / rate
+	data := bytes.Repeat([]byte{'a'}, size)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+
+	download := func(server *httptest.Server) time.Duration {
+		t.Helper()
+		start := time.Now()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !bytes.Equal(body, data) {
+			t.Errorf("got %d bytes, expected %d", len(body), len(data))
+		}
+		return time.Since(start)
+	}
+
+	unlimited := httptest.NewServer(throttleHandler(0, handler))
+	defer unlimited.Close()
+	if elapsed := download(unlimited); elapsed >= minDuration {
+		t.Errorf("unthrottled download took %s", elapsed)
+	}
+
+	throttled := httptest.NewServer(throttleHandler(rate, handler))
+	defer throttled.Close()
+	if elapsed := download(throttled); elapsed < minDuration {
+		t.Errorf("download took %s, expected at least %s", elapsed, minDuration)
+	}
+
+	// the limit applies to each download on its own rather than to all of them together
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if elapsed := download(throttled); elapsed < minDuration {
+				t.Errorf("download took %s, expected at least %s", elapsed, minDuration)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed >= 2*minDuration {
+		t.Errorf("concurrent downloads took %s, they shared the limit", elapsed)
+	}
+}
+
+func TestConcurrencyLimitHandler(t *testing.T) {
+	const limit = 2
+	started := make(chan struct{}, limit)
+	release := make(chan struct{})
+	handler := concurrencyLimitHandler(limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	statuses := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		go func() {
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < limit; i++ {
+		<-started
+	}
+
+	// every download over the limit is turned away while the others are in progress
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("download over the limit returned %d, expected %d", resp.StatusCode, http.StatusServiceUnavailable)
+		}
+		if got := resp.Header.Get("Retry-After"); got != downloadRetryAfter {
+			t.Fatalf("download over the limit had Retry-After %q, expected %q", got, downloadRetryAfter)
+		}
+	}
+
+	close(release)
+	for i := 0; i < limit; i++ {
+		if status := <-statuses; status != http.StatusOK {
+			t.Fatalf("download within the limit returned %d", status)
+		}
+	}
+	// the slots are freed once the downloads are done
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download after the others finished returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+const (
+	mediaTypeCD       = "CD"
+	mediaTypeUSBStick = "USBStick"
+	testUSBImageName  = "test-config.img"
+)
+
+// validateMediaType returns an error if mediaType is not one of the supported MEDIA_TYPE values
+func validateMediaType(mediaType string) error {
+	switch mediaType {
+	case mediaTypeCD, mediaTypeUSBStick:
+		return nil
+	}
+	return fmt.Errorf("unsupported media type %q, must be %s or %s", mediaType, mediaTypeCD, mediaTypeUSBStick)
+}
+
+// virtualMediaType returns the redfish virtual media type devices must support to be inserted with mediaType
+func virtualMediaType(mediaType string) redfish.VirtualMediaType {
+	if mediaType == mediaTypeUSBStick {
+		return redfish.USBStickMediaType
+	}
+	return redfish.CDMediaType
+}
+
+// bootOverrideTarget returns the boot source override that boots the virtual media of mediaType
+func bootOverrideTarget(mediaType string) redfish.BootSourceOverrideTarget {
+	if mediaType == mediaTypeUSBStick {
+		return redfish.UsbBootSourceOverrideTarget
+	}
+	return redfish.CdBootSourceOverrideTarget
+}
+
+// noMediaError returns the error for a system without virtual media of mediaType
+func noMediaError(mediaType string) error {
+	if mediaType == mediaTypeUSBStick {
+		return ErrNoUSBMedia
+	}
+	return ErrNoCDMedia
+}
+
+// mediaHeaderSize returns the number of bytes from the start of an image needed by checkMediaHeader
+func mediaHeaderSize(mediaType string) int64 {
+	if mediaType == mediaTypeUSBStick {
+		return fatHeaderSize
+	}
+	return isoHeaderSize
+}
+
+// checkMediaHeader returns an error if r doesn't start like an image of mediaType, a FAT image for USB sticks
+// and an iso otherwise
+func checkMediaHeader(r io.ReaderAt, mediaType string) error {
+	if mediaType == mediaTypeUSBStick {
+		return checkFATHeader(r)
+	}
+	return checkISOHeader(r)
+}
+
+// createUSBImage writes a FAT32 image at outPath holding the contents of workDir, labelled with label cut to
+// what FAT allows
+// unlike an iso the image is a superfloppy, a file system without a partition table, which BMCs attach as is
+func createUSBImage(outPath, workDir, label string) error {
+	size, err := fatImageSize(workDir)
+	if err != nil {
+		return wrapError(ErrISOBuild, fmt.Errorf("failed to read USB image contents: %w", err))
+	}
+	if err := writeFATImage(outPath, size, fatLabel(label), workDir, "/"); err != nil {
+		return wrapError(ErrISOBuild, fmt.Errorf("failed to create USB image: %w", err))
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const vaultRequestTimeout = 30 * time.Second
+
+// vaultSecretRef is a field of a Vault secret, the value of a template var
+type vaultSecretRef struct {
+	path  string
+	field string
+}
+
+// parseVaultSecrets parses template var names mapped to path#field of a secret, the path being its API path under /v1
+func parseVaultSecrets(secrets map[string]string) (map[string]vaultSecretRef, error) {
+	refs := make(map[string]vaultSecretRef, len(secrets))
+	for name, ref := range secrets {
+		p, field, ok := strings.Cut(ref, "#")
+		p = strings.Trim(p, "/")
+		if !ok || p == "" || field == "" {
+			return nil, fmt.Errorf("invalid Vault secret %q for %s, must be path#field", ref, name)
+		}
+		refs[name] = vaultSecretRef{path: p, field: field}
+	}
+	return refs, nil
+}
+
+// vaultClient reads the template vars kept in Vault
+type vaultClient struct {
+	addr string
+	// authenticates with token, the token in tokenFile, or the pod's service account as kubernetesRole
+	token           string
+	tokenFile       string
+	kubernetesRole  string
+	kubernetesMount string
+	secrets         map[string]vaultSecretRef
+	client          *http.Client
+}
+
+// newVaultClient returns a client of the Vault server at addr reading secrets, which map template var names to
+// path#field of a secret
+// exactly one of token, tokenFile, and kubernetesRole must be set, caCertFile is a PEM bundle trusted in addition
+// to the system roots
+func newVaultClient(addr, token, tokenFile, kubernetesRole, kubernetesMount, caCertFile string, secrets map[string]string) (*vaultClient, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is required with VAULT_SECRETS")
+	}
+	var auth int
+	for _, s := range []string{token, tokenFile, kubernetesRole} {
+		if s != "" {
+			auth++
+		}
+	}
+	if auth != 1 {
+		return nil, fmt.Errorf("exactly one of VAULT_TOKEN, VAULT_TOKEN_FILE, and VAULT_KUBERNETES_ROLE must be set")
+	}
+	refs, err := parseVaultSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCertFile != "" {
+		pem, err := os.ReadFile(caCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Vault CA bundle %s: %w", caCertFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Vault CA bundle %s", caCertFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &vaultClient{
+		addr:            strings.TrimSuffix(addr, "/"),
+		token:           token,
+		tokenFile:       tokenFile,
+		kubernetesRole:  kubernetesRole,
+		kubernetesMount: strings.Trim(kubernetesMount, "/"),
+		secrets:         refs,
+		client:          &http.Client{Timeout: vaultRequestTimeout, Transport: transport},
+	}, nil
+}
+
+// login returns the token to read secrets with, logging in with the Kubernetes auth method if that is configured
+// the token file and service account token are read again every time as they may be rotated
+func (c *vaultClient) login() (string, error) {
+	switch {
+	case c.token != "":
+		return c.token, nil
+	case c.tokenFile != "":
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read Vault token: %w", err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+
+	jwt, err := os.ReadFile(filepath.Join(kubeServiceAccountDir, "token"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read service account token: %w", err)
+	}
+	body, err := json.Marshal(map[string]string{"role": c.kubernetesRole, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do(http.MethodPost, "auth/"+c.kubernetesMount+"/login", "", body, &login); err != nil {
+		return "", fmt.Errorf("failed to log in to Vault as role %s: %w", c.kubernetesRole, err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", fmt.Errorf("failed to log in to Vault as role %s: no token returned", c.kubernetesRole)
+	}
+	return login.Auth.ClientToken, nil
+}
+
+// do sends a request for the API path under /v1 and decodes the JSON response into v
+func (c *vaultClient) do(method, apiPath, token string, body []byte, v interface{}) error {
+	u, err := url.JoinPath(c.addr, "v1", apiPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// read returns the fields of the secret at path, unwrapping the data of a KV version 2 secret
+func (c *vaultClient) read(token, path string) (map[string]interface{}, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := c.do(http.MethodGet, path, token, nil, &secret); err != nil {
+		return nil, fmt.Errorf("failed to read Vault secret %s: %w", path, err)
+	}
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return data, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+// templateVars returns the value of each configured secret by the name of its template var
+// each secret is read once however many of its fields are used, fields that aren't strings are JSON encoded
+func (c *vaultClient) templateVars() (map[string]string, error) {
+	token, err := c.login()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]map[string]interface{})
+	vars := make(map[string]string, len(c.secrets))
+	for name, ref := range c.secrets {
+		data, ok := secrets[ref.path]
+		if !ok {
+			if data, err = c.read(token, ref.path); err != nil {
+				return nil, err
+			}
+			secrets[ref.path] = data
+		}
+		value, ok := data[ref.field]
+		if !ok {
+			return nil, fmt.Errorf("Vault secret %s has no field %s for %s", ref.path, ref.field, name)
+		}
+		if s, ok := value.(string); ok {
+			vars[name] = s
+			continue
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		vars[name] = string(encoded)
+	}
+	return vars, nil
+}
+
+// withSecrets returns vars overridden by secrets, vars itself if there are none
+func withSecrets(vars, secrets map[string]string) map[string]string {
+	if len(secrets) == 0 {
+		return vars
+	}
+	merged := make(map[string]string, len(vars)+len(secrets))
+	for k, v := range vars {
+		merged[k] = v
+	}
+	for k, v := range secrets {
+		merged[k] = v
+	}
+	return merged
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault serves a KV version 1 and a version 2 secret engine to static-token and login-token, the latter
+// handed out to the Kubernetes role iso-builder logging in with the service account token kube-jwt
+type fakeVault struct {
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/v1/auth/kubernetes/login" {
+		var login struct {
+			Role string `json:"role"`
+			JWT  string `json:"jwt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login.Role != "iso-builder" || login.JWT != "kube-jwt" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": "login-token"}})
+		return
+	}
+	if token := r.Header.Get("X-Vault-Token"); token != "static-token" && token != "login-token" {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+
+	v.mu.Lock()
+	v.reads[r.URL.Path]++
+	v.mu.Unlock()
+	var secret map[string]interface{}
+	switch r.URL.Path {
+	case "/v1/kv1/app":
+		secret = map[string]interface{}{"password": "v1-password", "port": 8080}
+	case "/v1/kv1/wrapped":
+		// a version 1 secret with a field called data is not mistaken for a version 2 one
+		secret = map[string]interface{}{"data": map[string]string{"key": "value"}}
+	case "/v1/kv2/data/app":
+		secret = map[string]interface{}{
+			"data":     map[string]interface{}{"password": "v2-password", "nested": map[string]int{"a": 1}},
+			"metadata": map[string]interface{}{"version": 3},
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": secret})
+}
+
+var vaultTestSecrets = map[string]string{
+	"V1Password": "kv1/app#password",
+	"V1Port":     "kv1/app#port",
+	"Wrapped":    "kv1/wrapped#data",
+	"V2Password": "/kv2/data/app/#password",
+	"V2Nested":   "kv2/data/app#nested",
+}
+
+func TestVaultTemplateVars(t *testing.T) {
+	vault := &fakeVault{reads: map[string]int{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("static-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := kubeServiceAccountDir
+	kubeServiceAccountDir = t.TempDir()
+	defer func() { kubeServiceAccountDir = saved }()
+	if err := os.WriteFile(filepath.Join(kubeServiceAccountDir, "token"), []byte("kube-jwt\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name                             string
+		token, tokenFile, kubernetesRole string
+	}{
+		{name: "token", token: "static-token"},
+		{name: "token file", tokenFile: tokenFile},
+		{name: "kubernetes", kubernetesRole: "iso-builder"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := newVaultClient(server.URL+"/", tc.token, tc.tokenFile, tc.kubernetesRole, "/kubernetes/", "", vaultTestSecrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vault.mu.Lock()
+			vault.reads = map[string]int{}
+			vault.mu.Unlock()
+
+			vars, err := client.templateVars()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[string]string{
+				"V1Password": "v1-password",
+				"V1Port":     "8080",
+				"Wrapped":    `{"key":"value"}`,
+				"V2Password": "v2-password",
+				"V2Nested":   `{"a":1}`,
+			}
+			for name, value := range expected {
+				if vars[name] != value {
+					t.Errorf("%s is %q, expected %q", name, vars[name], value)
+				}
+			}
+			if len(vars) != len(expected) {
+				t.Errorf("got %d vars, expected %d", len(vars), len(expected))
+			}
+			vault.mu.Lock()
+			defer vault.mu.Unlock()
+			for path, n := range vault.reads {
+				if n != 1 {
+					t.Errorf("%s was read %d times, expected once", path, n)
+				}
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		secrets map[string]string
+		err     string
+	}{
+		// the token file is read again for every render so a rotated token is picked up
+		{name: "rotated token file", token: "revoked", secrets: vaultTestSecrets, err: "403"},
+		{name: "missing field", token: "static-token", secrets: map[string]string{"Missing": "kv1/app#missing"}, err: "has no field missing"},
+		{name: "missing secret", token: "static-token", secrets: map[string]string{"Missing": "kv1/missing#password"}, err: "404"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := newVaultClient(server.URL, "", tokenFile, "", "kubernetes", "", tc.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(tokenFile, []byte(tc.token), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.templateVars(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestNewVaultClientAuth(t *testing.T) {
+	secrets := map[string]string{"Password": "kv1/app#password"}
+	if _, err := newVaultClient("http://vault:8200", "", "", "", "kubernetes", "", secrets); err == nil {
+		t.Error("expected a client without authentication to be rejected")
+	}
+	if _, err := newVaultClient("http://vault:8200", "token", "", "role", "kubernetes", "", secrets); err == nil {
+		t.Error("expected a client with two ways to authenticate to be rejected")
+	}
+	if _, err := newVaultClient("http://vault:8200", "token", "", "", "kubernetes", "", map[string]string{"Password": "kv1/app"}); err == nil {
+		t.Error("expected a secret without a field to be rejected")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stmcginnis/gofish/common"
+	"github.com/stmcginnis/gofish/redfish"
+)
+
+// bmcQuirks are the deviations from standard redfish needed by a vendor's BMCs
+type bmcQuirks struct {
+	// InsertMedia must not include the Inserted and WriteProtected fields, some iDRAC firmware rejects them
+	minimalInsert bool
+	// key of the HPE OEM virtual media properties used when InsertMedia is unavailable, Hpe for iLO 5 and Hp for iLO 4
+	hpeOEM string
+}
+
+// quirksFor returns the quirks of the BMC managing system based on its manufacturer
+func quirksFor(system *redfish.ComputerSystem) bmcQuirks {
+	manufacturer := strings.ToLower(system.Manufacturer)
+	switch {
+	case strings.Contains(manufacturer, "dell"):
+		return bmcQuirks{minimalInsert: true}
+	case manufacturer == "hpe":
+		return bmcQuirks{hpeOEM: "Hpe"}
+	case manufacturer == "hp":
+		return bmcQuirks{hpeOEM: "Hp"}
+	}
+	return bmcQuirks{}
+}
+
+// insertVirtualMedia inserts the image in config into vm
+// on HPE iLO, which may lack the InsertMedia action or reject it with 405, the OEM virtual media properties are
+// patched instead so the image is connected on the next server reset
+func insertVirtualMedia(ctx context.Context, log *logrus.Entry, client common.Client, vm *redfish.VirtualMedia, config redfish.VirtualMediaConfig, quirks bmcQuirks) error {
+	if quirks.hpeOEM == "" {
+		return insertVirtualMediaConfig(ctx, client, vm, config)
+	}
+	if vm.SupportsMediaInsert {
+		err := insertVirtualMediaConfig(ctx, client, vm, config)
+		var redfishErr *common.Error
+		if !errors.As(err, &redfishErr) || redfishErr.HTTPReturnedStatusCode != http.StatusMethodNotAllowed {
+			return err
+		}
+	}
+
+	log.Infof("InsertMedia is not available, inserting through the %s OEM virtual media properties", quirks.hpeOEM)
+	body := map[string]interface{}{
+		"Image": config.Image,
+		"Oem": map[string]interface{}{
+			quirks.hpeOEM: map[string]interface{}{"BootOnNextServerReset": true},
+		},
+	}
+	resp, err := client.Patch(vm.ODataID, body)
+	if err != nil {
+		return fmt.Errorf("failed to set %s OEM virtual media image: %w", quirks.hpeOEM, err)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/diskfs/go-diskfs"
+	"github.com/diskfs/go-diskfs/filesystem"
+)
+
+// isoContentEntry is a file, directory, or link of the work dir an iso is built from
+type isoContentEntry struct {
+	// in the work dir, which is the Rock Ridge path, and the ISO9660 one
+	path    string
+	isoPath string
+	dir     bool
+	// only regular files are compared by content, links just have to be there
+	regular bool
+	size    int64
+	sha256  string
+	// the BIOS boot image, whose boot info table is filled in when the iso is written
+	bootInfoTable bool
+}
+
+// boot info table diskfs writes into the BIOS boot image, bytes 8 to 64 of it
+const (
+	bootInfoTableStart = 8
+	bootInfoTableEnd   = 64
+)
+
+// bootInfoTableReader reads r with the bytes of the boot info table as zeros
+type bootInfoTableReader struct {
+	r      io.Reader
+	offset int64
+}
+
+func (r *bootInfoTableReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	for i := 0; i < n && r.offset+int64(i) < bootInfoTableEnd; i++ {
+		if r.offset+int64(i) >= bootInfoTableStart {
+			p[i] = 0
+		}
+	}
+	r.offset += int64(n)
+	return n, err
+}
+
+// contentSHA256 returns the size and sha256 of what's read from r, without the boot info table if bootInfoTable is set
+func contentSHA256(r io.Reader, bootInfoTable bool) (int64, string, error) {
+	if bootInfoTable {
+		r = &bootInfoTableReader{r: r}
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isoContentSnapshot returns the entries under workDir, regular files with their size and sha256
+// biosImage is the path in workDir of the BIOS boot image, if any, which is compared without its boot info table
+// it is read before finalizing as that removes workDir
+func isoContentSnapshot(workDir, biosImage string) ([]isoContentEntry, error) {
+	var entries []isoContentEntry
+	isoDirs := map[string]string{"/": "/"}
+	err := filepath.WalkDir(workDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(workDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := "/" + filepath.ToSlash(rel)
+		entry := isoContentEntry{
+			path:          name,
+			isoPath:       path.Join(isoDirs[path.Dir(name)], isoName(d.Name(), d.IsDir())),
+			dir:           d.IsDir(),
+			regular:       d.Type().IsRegular(),
+			bootInfoTable: name == biosImage,
+		}
+		if entry.dir {
+			isoDirs[name] = entry.isoPath
+		}
+		if entry.regular {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if entry.size, entry.sha256, err = contentSHA256(f, entry.bootInfoTable); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// verifyISOContent reads the iso at isoPath back and checks that it holds exactly entries, each file with the size
+// and contents it had in the work dir, looked up by their Rock Ridge names if it has them
+// so an iso diskfs or the Joliet rewrite got wrong fails the build rather than the boot
+func verifyISOContent(isoPath string, entries []isoContentEntry, rockRidge bool) error {
+	d, err := diskfs.Open(isoPath, diskfs.WithOpenMode(diskfs.ReadOnly))
+	if err != nil {
+		return err
+	}
+	defer d.File.Close()
+
+	d.LogicalBlocksize = isoBlockSize
+	isoFS, err := d.GetFilesystem(0)
+	if err != nil {
+		return err
+	}
+
+	// expected number of entries of each directory, so anything missing or extra in a listing is caught
+	children := map[string]int{"/": 0}
+	for _, e := range entries {
+		p := e.isoPath
+		if rockRidge {
+			p = e.path
+		}
+		children[path.Dir(p)]++
+		if e.dir {
+			children[p] += 0
+			continue
+		}
+		if e.regular {
+			if err := verifyISOFile(isoFS, p, e); err != nil {
+				return err
+			}
+		}
+	}
+	for dir, n := range children {
+		infos, err := isoFS.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %w", dir, err)
+		}
+		if len(infos) != n {
+			return fmt.Errorf("directory %s has %d entries, expected %d", dir, len(infos), n)
+		}
+	}
+	return nil
+}
+
+// verifyISOFile checks that the file at p in isoFS has the size and sha256 of e
+func verifyISOFile(isoFS filesystem.FileSystem, p string, e isoContentEntry) error {
+	f, err := isoFS.OpenFile(p, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", p, err)
+	}
+	n, sum, err := contentSHA256(f, e.bootInfoTable)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", p, err)
+	}
+	if n != e.size {
+		return fmt.Errorf("%s is %d bytes, expected %d", p, n, e.size)
+	}
+	if sum != e.sha256 {
+		return fmt.Errorf("%s has sha256 %s, expected %s", p, sum, e.sha256)
+	}
+	return nil
+}